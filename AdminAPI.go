@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// AdminAPI HTTP API for checking the status of BTCAgent
+type AdminAPI struct {
+	config *Config
+	mux    *http.ServeMux
+}
+
+func NewAdminAPI(config *Config) (api *AdminAPI) {
+	api = new(AdminAPI)
+	api.config = config
+	api.mux = http.NewServeMux()
+
+	api.mux.Handle("/metrics", expvar.Handler())
+	api.mux.HandleFunc("/proxies", api.handleProxies)
+	api.mux.HandleFunc("/workers", api.handleWorkers)
+	api.mux.HandleFunc("/traces", api.handleTraces)
+	return
+}
+
+// Run Start the HTTP service, blocking
+func (api *AdminAPI) Run() {
+	glog.Info("admin API enabled: ", api.config.AdminAPI.Listen)
+	err := http.ListenAndServe(api.config.AdminAPI.Listen, api.mux)
+	if err != nil {
+		glog.Error("launch admin API service failed: ", err.Error())
+	}
+}
+
+func (api *AdminAPI) writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		glog.Warning("[admin-api] failed to write response: ", err.Error())
+	}
+}
+
+func (api *AdminAPI) writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(JSONRPCObj{"error": message})
+}
+
+func (api *AdminAPI) handleProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	api.writeJSON(w, JSONRPCObj{
+		"selection":  api.config.ProxySelection,
+		"candidates": api.config.proxyManager.Candidates(),
+		"proxies":    api.config.proxyManager.Status(),
+	})
+}
+
+func (api *AdminAPI) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	monitor := api.config.workerMonitor
+	if monitor == nil {
+		api.writeError(w, http.StatusNotFound, "worker_monitor is disabled")
+		return
+	}
+	api.writeJSON(w, JSONRPCObj{
+		"sub_accounts": monitor.SubAccounts(),
+		"workers":      monitor.Workers(),
+	})
+}
+
+// TraceRequest Body of POST /traces
+type TraceRequest struct {
+	TraceFilter
+	MaxSizeKB int64 `json:"max_size_kb"`
+}
+
+// handleTraces GET: list traces, POST: start a trace, DELETE ?id=<id>: stop a trace
+func (api *AdminAPI) handleTraces(w http.ResponseWriter, r *http.Request) {
+	tracer := api.config.traceManager
+
+	switch r.Method {
+	case http.MethodGet:
+		api.writeJSON(w, JSONRPCObj{"traces": tracer.Traces()})
+
+	case http.MethodPost:
+		var request TraceRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		trace, err := tracer.Start(request.TraceFilter, request.MaxSizeKB*1024)
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		api.writeJSON(w, trace)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "invalid trace id")
+			return
+		}
+		trace, err := tracer.Stop(uint(id))
+		if err != nil {
+			api.writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		api.writeJSON(w, trace)
+
+	default:
+		api.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
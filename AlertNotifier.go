@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// AlertNotifierConfig A notifier in the config file
+type AlertNotifierConfig struct {
+	Type           string  `json:"type"`    // webhook, exec or syslog
+	URL            string  `json:"url"`     // webhook: the alert is POSTed as JSON
+	Command        string  `json:"command"` // exec: the alert is written to stdin as JSON
+	Tag            string  `json:"tag"`     // syslog: the tag of the messages
+	TimeoutSeconds Seconds `json:"timeout_seconds"`
+}
+
+// AlertNotifier Deliver worker alerts to somewhere outside of BTCAgent
+type AlertNotifier interface {
+	Name() string
+	Notify(alert *WorkerAlert) error
+}
+
+func NewAlertNotifier(conf AlertNotifierConfig) (AlertNotifier, error) {
+	timeout := conf.TimeoutSeconds.Get()
+	if timeout <= 0 {
+		timeout = AlertNotifierTimeoutSeconds.Get()
+	}
+
+	switch conf.Type {
+	case "webhook":
+		if len(conf.URL) < 1 {
+			return nil, fmt.Errorf("webhook notifier without url")
+		}
+		return &WebhookNotifier{URL: conf.URL, Client: &http.Client{Timeout: timeout}}, nil
+	case "exec":
+		if len(conf.Command) < 1 {
+			return nil, fmt.Errorf("exec notifier without command")
+		}
+		return &ExecNotifier{Command: conf.Command, Timeout: timeout}, nil
+	case "syslog":
+		tag := conf.Tag
+		if len(tag) < 1 {
+			tag = "btcagent"
+		}
+		return NewSyslogNotifier(tag)
+	default:
+		return nil, fmt.Errorf("unknown notifier type: %s", conf.Type)
+	}
+}
+
+// WebhookNotifier POST the alert as JSON
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (notifier *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (notifier *WebhookNotifier) Notify(alert *WorkerAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	response, err := notifier.Client.Post(notifier.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", notifier.URL, response.Status)
+	}
+	return nil
+}
+
+// ExecNotifier Run a command with the alert as JSON in stdin and the main fields in environment variables
+type ExecNotifier struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (notifier *ExecNotifier) Name() string {
+	return "exec"
+}
+
+func (notifier *ExecNotifier) Notify(alert *WorkerAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifier.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, notifier.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"BTCAGENT_ALERT_TYPE="+alert.Type,
+		"BTCAGENT_ALERT_SUB_ACCOUNT="+alert.SubAccount,
+		"BTCAGENT_ALERT_WORKER="+alert.Worker,
+		"BTCAGENT_ALERT_MESSAGE="+alert.Message,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v, output: %s", notifier.Command, err, output)
+	}
+	return nil
+}
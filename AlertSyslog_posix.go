@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogNotifier Write the alert as JSON to the local syslog
+type SyslogNotifier struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogNotifier(tag string) (AlertNotifier, error) {
+	writer, err := syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogNotifier{writer}, nil
+}
+
+func (notifier *SyslogNotifier) Name() string {
+	return "syslog"
+}
+
+func (notifier *SyslogNotifier) Notify(alert *WorkerAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	if alert.Type == AlertWorkerRecovered {
+		return notifier.writer.Info(string(body))
+	}
+	return notifier.writer.Warning(string(body))
+}
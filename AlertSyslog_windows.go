@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+func NewSyslogNotifier(tag string) (AlertNotifier, error) {
+	// There is no syslog on Windows
+	return nil, errors.New("syslog notifier is not supported on Windows")
+}
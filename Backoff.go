@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	jitterRandLock sync.Mutex
+	jitterRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// RandDuration Random duration in [0, max)
+func RandDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	defer jitterRandLock.Unlock()
+	jitterRandLock.Lock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// Backoff Exponential backoff with full jitter.
+// Not thread safe, should be owned by one goroutine.
+type Backoff struct {
+	Min        time.Duration
+	Max        time.Duration
+	Multiplier float64
+
+	attempt int
+}
+
+func NewBackoff(min time.Duration, max time.Duration, multiplier float64) *Backoff {
+	return &Backoff{Min: min, Max: max, Multiplier: multiplier}
+}
+
+// Next The delay before the next attempt, random in [0, min(Max, Min * Multiplier^attempt))
+func (b *Backoff) Next() time.Duration {
+	ceil := float64(b.Min)
+	for i := 0; i < b.attempt && ceil < float64(b.Max); i++ {
+		ceil *= b.Multiplier
+	}
+	if ceil > float64(b.Max) {
+		ceil = float64(b.Max)
+	}
+	b.attempt++
+	return RandDuration(time.Duration(ceil))
+}
+
+// Attempt Number of delays given since the last reset
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// CircuitBreaker Thread safe circuit breaker of a pool server.
+// After too many consecutive failures the pool is skipped for a while,
+// then a single attempt is allowed to check whether it has recovered.
+type CircuitBreaker struct {
+	lock sync.Mutex
+
+	maxFailures uint32
+	openTime    time.Duration
+
+	failures  uint32
+	openUntil time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(maxFailures uint32, openTime time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{maxFailures: maxFailures, openTime: openTime}
+}
+
+// Allow Whether a connection attempt is allowed now
+func (breaker *CircuitBreaker) Allow() bool {
+	defer breaker.lock.Unlock()
+	breaker.lock.Lock()
+
+	if breaker.maxFailures == 0 || breaker.failures < breaker.maxFailures {
+		return true
+	}
+	if time.Now().Before(breaker.openUntil) || breaker.probing {
+		return false
+	}
+	// half-open: let one attempt through
+	breaker.probing = true
+	return true
+}
+
+// Success Record a successful connection, close the breaker
+func (breaker *CircuitBreaker) Success() {
+	defer breaker.lock.Unlock()
+	breaker.lock.Lock()
+
+	breaker.failures = 0
+	breaker.probing = false
+}
+
+// Failure Record a failed connection, return true if the breaker has just been opened
+func (breaker *CircuitBreaker) Failure() (opened bool) {
+	defer breaker.lock.Unlock()
+	breaker.lock.Lock()
+
+	breaker.failures++
+	if breaker.maxFailures == 0 || breaker.failures < breaker.maxFailures {
+		return false
+	}
+	opened = breaker.failures == breaker.maxFailures
+	breaker.probing = false
+	breaker.openUntil = time.Now().Add(breaker.openTime + RandDuration(breaker.openTime/4))
+	return
+}
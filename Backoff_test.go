@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	b := NewBackoff(time.Second, 8*time.Second, 2)
+
+	ceils := []time.Duration{1, 2, 4, 8, 8, 8}
+	for i, ceil := range ceils {
+		delay := b.Next()
+		if delay < 0 || delay >= ceil*time.Second {
+			t.Errorf("attempt %d: delay %s out of range [0, %ds)", i, delay, ceil)
+		}
+	}
+
+	b.Reset()
+	if delay := b.Next(); delay >= time.Second {
+		t.Errorf("delay after reset should be less than 1s, got %s", delay)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(3, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if breaker.Failure() {
+			t.Fatalf("breaker opened too early at failure %d", i+1)
+		}
+		if !breaker.Allow() {
+			t.Fatalf("breaker should allow attempts before it opens")
+		}
+	}
+	if !breaker.Failure() {
+		t.Fatalf("breaker should open at the 3rd failure")
+	}
+	if breaker.Allow() {
+		t.Fatalf("open breaker should not allow attempts")
+	}
+
+	// skip the open time, only one probe is allowed
+	breaker.openUntil = time.Now()
+	if !breaker.Allow() {
+		t.Fatalf("breaker should allow a probe after the open time")
+	}
+	if breaker.Allow() {
+		t.Fatalf("breaker should allow only one probe")
+	}
+
+	breaker.Success()
+	if !breaker.Allow() {
+		t.Fatalf("breaker should be closed after a success")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"strings"
@@ -13,6 +14,9 @@ type PoolInfo struct {
 	Host       string
 	Port       uint16
 	SubAccount string
+	TLS        PoolTLSOptions
+
+	tlsConfig *tls.Config
 }
 
 func (r *PoolInfo) UnmarshalJSON(p []byte) error {
@@ -35,10 +39,18 @@ func (r *PoolInfo) UnmarshalJSON(p []byte) error {
 			return err
 		}
 	}
+	if len(tmp) > 3 {
+		if err := json.Unmarshal(tmp[3], &r.TLS); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (r *PoolInfo) MarshalJSON() ([]byte, error) {
+	if !r.TLS.IsEmpty() {
+		return json.Marshal([]interface{}{r.Host, r.Port, r.SubAccount, &r.TLS})
+	}
 	return json.Marshal([]interface{}{r.Host, r.Port, r.SubAccount})
 }
 
@@ -65,7 +77,42 @@ type Config struct {
 	DirectConnectAfterProxy     bool       `json:"direct_connect_after_proxy"`
 	PoolUseTls                  bool       `json:"pool_use_tls"`
 	Pools                       []PoolInfo `json:"pools"`
-	HTTPDebug                   struct {
+	AgentListenTLS              struct {
+		Enable           bool   `json:"enable"`
+		ListenIp         string `json:"listen_ip"`
+		ListenPort       uint16 `json:"listen_port"`
+		CertFile         string `json:"cert_file"`
+		KeyFile          string `json:"key_file"`
+		ClientCAFile     string `json:"client_ca_file"`
+		VerifyClientCert bool   `json:"verify_client_cert"`
+	} `json:"agent_listen_tls"`
+	ProxySelection string   `json:"proxy_selection"`
+	ProxyLocalDNS  bool     `json:"proxy_local_dns"` // resolve the pool host for socks5:// proxies locally
+	DNSServers     []string `json:"dns_servers"`
+	AdminAPI       struct {
+		Enable bool   `json:"enable"`
+		Listen string `json:"listen"`
+	} `json:"admin_api"`
+	ShareJournal struct {
+		Enable                bool    `json:"enable"`
+		Dir                   string  `json:"dir"`
+		MaxFileSizeMB         uint    `json:"max_file_size_mb"`
+		RotateIntervalSeconds Seconds `json:"rotate_interval_seconds"`
+	} `json:"share_journal"`
+	WorkerMonitor struct {
+		Enable               bool                  `json:"enable"`
+		CheckIntervalSeconds Seconds               `json:"check_interval_seconds"`
+		OfflineAfterSeconds  Seconds               `json:"offline_after_seconds"`
+		MinHashrateTHs       float64               `json:"min_hashrate_ths"`
+		Notifiers            []AlertNotifierConfig `json:"notifiers"`
+	} `json:"worker_monitor"`
+	EventSinks    []EventSinkConfig `json:"event_sinks"`
+	LogFormat     string            `json:"log_format"`
+	ProtocolTrace struct {
+		Dir           string `json:"dir"`
+		MaxFileSizeMB uint   `json:"max_file_size_mb"`
+	} `json:"protocol_trace"`
+	HTTPDebug struct {
 		Enable bool   `json:"enable"`
 		Listen string `json:"listen"`
 	} `json:"http_debug"`
@@ -78,8 +125,66 @@ type Config struct {
 		PoolConnectionReadTimeoutSeconds Seconds `json:"pool_connection_read_timeout_seconds"`
 		// Send cycle of false tasks (seconds)
 		FakeJobNotifyIntervalSeconds Seconds `json:"fake_job_notify_interval_seconds"`
-		// TLS certificate verification
+		// Skip the pool certificate verification, off by default
 		TLSSkipCertificateVerify bool `json:"tls_skip_certificate_verify"`
+		// Miner TLS handshake timeout
+		MinerTLSHandshakeTimeoutSeconds Seconds `json:"miner_tls_handshake_timeout_seconds"`
+		// Lines to a miner are dropped and the miner is disconnected if they cannot be written in time, 0 to disable
+		MinerWriteTimeoutSeconds Seconds `json:"miner_write_timeout_seconds"`
+		// A miner is disconnected if it is not subscribed / authorized in time after connecting, 0 to disable
+		MinerSubscribeTimeoutSeconds Seconds `json:"miner_subscribe_timeout_seconds"`
+		MinerAuthorizeTimeoutSeconds Seconds `json:"miner_authorize_timeout_seconds"`
+		// An authorized miner is disconnected if it submits no share for this long, 0 to disable
+		MinerIdleTimeoutSeconds Seconds `json:"miner_idle_timeout_seconds"`
+		// A miner is disconnected if it sends a longer line
+		MinerMaxLineBytes uint `json:"miner_max_line_bytes"`
+		// A miner is disconnected after sending this number of lines that are not valid JSON-RPC, 0 to disable
+		MinerMaxMalformedLines uint `json:"miner_max_malformed_lines"`
+		// The pool connection is reset if the pool sends a longer line
+		PoolMaxLineBytes uint `json:"pool_max_line_bytes"`
+		// Interval for checking whether the miner TLS certificate files have been changed
+		MinerTLSCertReloadIntervalSeconds Seconds `json:"miner_tls_cert_reload_interval_seconds"`
+
+		// Interval of proxy health checks, 0 to disable
+		ProxyHealthCheckIntervalSeconds Seconds `json:"proxy_health_check_interval_seconds"`
+		// A proxy is marked unhealthy after this number of consecutive failures
+		ProxyMaxConsecutiveFailures uint32 `json:"proxy_max_consecutive_failures"`
+
+		// How long resolved pool addresses are cached
+		DNSCacheTTLSeconds Seconds `json:"dns_cache_ttl_seconds"`
+		// DNS lookup timeout
+		DNSLookupTimeoutSeconds Seconds `json:"dns_lookup_timeout_seconds"`
+
+		// Delay before reconnecting a pool connection, random in [0, min(max_seconds, min_seconds * multiplier^attempt))
+		ReconnectBackoff struct {
+			MinSeconds Seconds `json:"min_seconds"`
+			MaxSeconds Seconds `json:"max_seconds"`
+			Multiplier float64 `json:"multiplier"`
+		} `json:"reconnect_backoff"`
+		// Skip a pool for a while after too many consecutive connection failures, 0 failures to disable
+		PoolCircuitBreaker struct {
+			Failures    uint32  `json:"failures"`
+			OpenSeconds Seconds `json:"open_seconds"`
+		} `json:"pool_circuit_breaker"`
+
+		// TCP keepalive period of pool connections, 0 to disable
+		PoolTCPKeepAliveSeconds Seconds `json:"pool_tcp_keepalive_seconds"`
+		// Application level ping to the pool, empty method to disable
+		PoolPing struct {
+			Method          string  `json:"method"`
+			IntervalSeconds Seconds `json:"interval_seconds"`
+		} `json:"pool_ping"`
+		// A pool connection without mining.notify for this long is degraded and its miners are moved, 0 to disable
+		PoolNotifyTimeoutSeconds Seconds `json:"pool_notify_timeout_seconds"`
+		// A slot follows client.reconnect of the pool to another host, and returns to the configured pools after
+		// this time. 0 to reconnect to the configured pools instead.
+		PoolRedirectSeconds Seconds `json:"pool_redirect_seconds"`
+
+		// Buffer shares of real jobs while all pool connections are lost, replay them if the pool session is resumed
+		ShareReplay struct {
+			BufferSize    uint    `json:"buffer_size"`
+			MaxAgeSeconds Seconds `json:"max_age_seconds"`
+		} `json:"share_replay"`
 
 		// Message queue size
 		MessageQueueSize struct {
@@ -88,9 +193,18 @@ type Config struct {
 			PoolSession        uint `json:"pool_session"`
 			MinerSession       uint `json:"miner_session"`
 		} `json:"message_queue_size"`
+		// What a full miner session queue does: drop_oldest_notify, coalesce_jobs or disconnect
+		MinerQueueOverflowPolicy string `json:"miner_queue_overflow_policy"`
 	} `json:"advanced"`
 
 	sessionFactory SessionFactory
+	proxyManager   *ProxyManager
+	resolver       *Resolver
+	shareJournal   *ShareJournal
+	workerMonitor  *WorkerMonitor
+	eventBus       *EventBus
+	traceManager   *TraceManager
+	poolDialer     Dialer // replaces direct pool connections, used by the replay harness
 }
 
 // NewConfig Create a configuration object and set the default value
@@ -102,17 +216,52 @@ func NewConfig() (config *Config) {
 	config.IpWorkerNameFormat = DefaultIpWorkerNameFormat
 	config.UseProxy = true
 	config.DirectConnectAfterProxy = true
+	config.ProxySelection = ProxySelectionFastest
+	config.LogFormat = LogFormatText
+	config.AdminAPI.Listen = DefaultAdminAPIListen
+	config.ShareJournal.Dir = DefaultShareJournalDir
+	config.ShareJournal.MaxFileSizeMB = ShareJournalMaxFileSizeMB
+	config.ShareJournal.RotateIntervalSeconds = ShareJournalRotateIntervalSeconds
+	config.WorkerMonitor.CheckIntervalSeconds = WorkerMonitorCheckIntervalSeconds
+	config.ProtocolTrace.Dir = DefaultProtocolTraceDir
+	config.ProtocolTrace.MaxFileSizeMB = ProtocolTraceMaxFileSizeMB
+	config.WorkerMonitor.OfflineAfterSeconds = WorkerMonitorOfflineAfterSeconds
 
 	config.Advanced.PoolConnectionNumberPerSubAccount = UpSessionNumPerSubAccount
 	config.Advanced.PoolConnectionDialTimeoutSeconds = UpSessionDialTimeoutSeconds
 	config.Advanced.PoolConnectionReadTimeoutSeconds = UpSessionReadTimeoutSeconds
 	config.Advanced.FakeJobNotifyIntervalSeconds = FakeJobNotifyIntervalSeconds
 	config.Advanced.TLSSkipCertificateVerify = UpSessionTLSInsecureSkipVerify
+	config.Advanced.MinerTLSHandshakeTimeoutSeconds = DownSessionTLSHandshakeTimeoutSeconds
+	config.Advanced.MinerWriteTimeoutSeconds = DownSessionWriteTimeoutSeconds
+	config.Advanced.MinerSubscribeTimeoutSeconds = DownSessionSubscribeTimeoutSeconds
+	config.Advanced.MinerAuthorizeTimeoutSeconds = DownSessionAuthorizeTimeoutSeconds
+	config.Advanced.MinerIdleTimeoutSeconds = DownSessionIdleTimeoutSeconds
+	config.Advanced.MinerMaxLineBytes = DownSessionMaxLineBytes
+	config.Advanced.MinerMaxMalformedLines = DownSessionMaxMalformedLines
+	config.Advanced.PoolMaxLineBytes = UpSessionMaxLineBytes
+	config.Advanced.MinerTLSCertReloadIntervalSeconds = DownSessionTLSCertReloadIntervalSeconds
+	config.Advanced.ProxyHealthCheckIntervalSeconds = ProxyHealthCheckIntervalSeconds
+	config.Advanced.ProxyMaxConsecutiveFailures = ProxyMaxConsecutiveFailures
+	config.Advanced.DNSCacheTTLSeconds = DNSCacheTTLSeconds
+	config.Advanced.DNSLookupTimeoutSeconds = DNSLookupTimeoutSeconds
+	config.Advanced.ReconnectBackoff.MinSeconds = UpSessionReconnectBackoffMinSeconds
+	config.Advanced.ReconnectBackoff.MaxSeconds = UpSessionReconnectBackoffMaxSeconds
+	config.Advanced.ReconnectBackoff.Multiplier = UpSessionReconnectBackoffMultiplier
+	config.Advanced.PoolCircuitBreaker.Failures = PoolCircuitBreakerFailures
+	config.Advanced.PoolCircuitBreaker.OpenSeconds = PoolCircuitBreakerOpenSeconds
+	config.Advanced.PoolTCPKeepAliveSeconds = UpSessionTCPKeepAliveSeconds
+	config.Advanced.PoolPing.IntervalSeconds = UpSessionPingIntervalSeconds
+	config.Advanced.PoolNotifyTimeoutSeconds = UpSessionNotifyTimeoutSeconds
+	config.Advanced.PoolRedirectSeconds = UpSessionRedirectSeconds
+	config.Advanced.ShareReplay.BufferSize = ShareReplayBufferSize
+	config.Advanced.ShareReplay.MaxAgeSeconds = ShareReplayMaxAgeSeconds
 
 	config.Advanced.MessageQueueSize.SessionManager = SessionManagerChannelCache
 	config.Advanced.MessageQueueSize.PoolSessionManager = UpSessionManagerChannelCache
 	config.Advanced.MessageQueueSize.PoolSession = UpSessionChannelCache
 	config.Advanced.MessageQueueSize.MinerSession = DownSessionChannelCache
+	config.Advanced.MinerQueueOverflowPolicy = DownSessionQueueOverflowPolicy
 
 	return
 }
@@ -128,6 +277,13 @@ func (conf *Config) LoadFromFile(file string) (err error) {
 }
 
 func (conf *Config) Init() {
+	err := SetLogFormat(conf.LogFormat)
+	if err != nil {
+		glog.Fatal("[OPTION] ", err)
+		return
+	}
+	glog.Info("[OPTION] Log format: ", conf.LogFormat)
+
 	conf.AgentType = strings.ToLower(conf.AgentType)
 	switch conf.AgentType {
 	case "btc":
@@ -145,8 +301,68 @@ func (conf *Config) Init() {
 	}
 
 	glog.Info("[OPTION] Connect to pool server with SSL/TLS encryption: ", IsEnabled(conf.PoolUseTls))
+	if conf.AgentListenTLS.Enable {
+		if len(conf.AgentListenTLS.CertFile) < 1 || len(conf.AgentListenTLS.KeyFile) < 1 {
+			glog.Fatal("[OPTION] agent_listen_tls enabled but cert_file or key_file is empty")
+			return
+		}
+		glog.Info("[OPTION] Accept miner connections with SSL/TLS encryption: Enabled, port: ", conf.AgentListenTLS.ListenPort)
+		glog.Info("[OPTION] Verify miner client certificate: ", IsEnabled(conf.AgentListenTLS.VerifyClientCert))
+	}
 	glog.Info("[OPTION] Always keep miner connections even if pool disconnected: ", IsEnabled(conf.AlwaysKeepDownconn))
+	if conf.AlwaysKeepDownconn && conf.Advanced.ShareReplay.BufferSize > 0 {
+		glog.Info("[OPTION] Replay up to ", conf.Advanced.ShareReplay.BufferSize, " shares submitted during pool outages to resumed pool sessions, max age: ", conf.Advanced.ShareReplay.MaxAgeSeconds.Get())
+	}
 	glog.Info("[OPTION] Disconnect if a miner lost its AsicBoost mid-way: ", IsEnabled(conf.DisconnectWhenLostAsicboost))
+	if !IsValidEventQueuePolicy(conf.Advanced.MinerQueueOverflowPolicy) {
+		glog.Fatal("[OPTION] Unknown miner_queue_overflow_policy: ", conf.Advanced.MinerQueueOverflowPolicy)
+	}
+	glog.Info("[OPTION] Miner message queue size: ", conf.Advanced.MessageQueueSize.MinerSession, ", overflow policy: ", conf.Advanced.MinerQueueOverflowPolicy)
+
+	if conf.ShareJournal.Enable {
+		journal, err := NewShareJournal(conf.ShareJournal.Dir, int64(conf.ShareJournal.MaxFileSizeMB)*1024*1024,
+			conf.ShareJournal.RotateIntervalSeconds.Get(), ShareJournalQueueSize)
+		if err != nil {
+			glog.Fatal("[OPTION] cannot open share journal in ", conf.ShareJournal.Dir, ": ", err)
+			return
+		}
+		conf.shareJournal = journal
+		glog.Info("[OPTION] Share journal: Enabled, dir: ", conf.ShareJournal.Dir)
+	}
+
+	if conf.WorkerMonitor.Enable {
+		var notifiers []AlertNotifier
+		for _, notifierConf := range conf.WorkerMonitor.Notifiers {
+			notifier, err := NewAlertNotifier(notifierConf)
+			if err != nil {
+				glog.Fatal("[OPTION] invalid worker_monitor notifier: ", err)
+				return
+			}
+			notifiers = append(notifiers, notifier)
+		}
+		conf.workerMonitor = NewWorkerMonitor(conf, notifiers)
+		glog.Info("[OPTION] Worker monitor: Enabled, offline after ", conf.WorkerMonitor.OfflineAfterSeconds.Get(), ", notifiers: ", len(notifiers))
+	}
+
+	if len(conf.EventSinks) > 0 {
+		var sinks []EventSink
+		for _, sinkConf := range conf.EventSinks {
+			sink, err := NewEventSink(sinkConf)
+			if err != nil {
+				glog.Fatal("[OPTION] invalid event sink: ", err)
+				return
+			}
+			sinks = append(sinks, sink)
+			glog.Info("[OPTION] Publish miner and pool events to ", sinkConf.Type, " ", sinkConf.URL, sinkConf.Path)
+		}
+		conf.eventBus = NewEventBus(sinks, EventBusQueueSize)
+	}
+
+	// Traces are started through the admin API
+	conf.traceManager = NewTraceManager(conf.ProtocolTrace.Dir, int64(conf.ProtocolTrace.MaxFileSizeMB)*1024*1024)
+	if conf.AdminAPI.Enable {
+		glog.Info("[OPTION] Protocol trace dir: ", conf.ProtocolTrace.Dir, ", max file size: ", conf.ProtocolTrace.MaxFileSizeMB, " MB")
+	}
 
 	if len(conf.FixedWorkerName) > 0 {
 		glog.Info("[OPTION] Fixed worker name enabled, all worker name will be replaced to ", conf.FixedWorkerName, " on the server.")
@@ -163,6 +379,26 @@ func (conf *Config) Init() {
 	}
 	if len(conf.Proxy) > 0 {
 		glog.Info("[OPTION] Connect to pool server with proxy ", conf.Proxy)
+		switch conf.ProxySelection {
+		case ProxySelectionFastest, ProxySelectionOrdered:
+			glog.Info("[OPTION] Proxy selection: ", conf.ProxySelection)
+			if conf.ProxyLocalDNS {
+				glog.Info("[OPTION] Resolve the pool host locally for socks5 proxies")
+			}
+		default:
+			glog.Fatal("[OPTION] Unknown proxy_selection: ", conf.ProxySelection)
+			return
+		}
+	}
+	conf.proxyManager = NewProxyManager(conf)
+
+	if len(conf.DNSServers) > 0 {
+		glog.Info("[OPTION] Resolve pool hosts with DNS servers ", conf.DNSServers)
+	}
+	conf.resolver = NewResolver(conf.DNSServers, conf.Advanced.DNSCacheTTLSeconds.Get(), conf.Advanced.DNSLookupTimeoutSeconds.Get())
+
+	if conf.Advanced.ReconnectBackoff.Multiplier < 1 {
+		conf.Advanced.ReconnectBackoff.Multiplier = 1
 	}
 
 	for i := range conf.Pools {
@@ -174,5 +410,23 @@ func (conf *Config) Init() {
 		} else {
 			glog.Info("add pool: ", pool.Host, ":", pool.Port, ", sub-account: ", pool.SubAccount)
 		}
+
+		if conf.PoolUseTls {
+			var err error
+			pool.tlsConfig, err = NewPoolTLSConfig(&pool.TLS, conf.Advanced.TLSSkipCertificateVerify)
+			if err != nil {
+				glog.Fatal("[OPTION] invalid TLS options of pool ", pool.Host, ":", pool.Port, ": ", err)
+				return
+			}
+			if pool.tlsConfig.InsecureSkipVerify {
+				if len(pool.TLS.Pins) > 0 {
+					glog.Info("[OPTION] pool ", pool.Host, ":", pool.Port, " TLS verification: certificate pinning only")
+				} else {
+					glog.Warning("[OPTION] pool ", pool.Host, ":", pool.Port, " TLS certificate will NOT be verified because advanced.tls_skip_certificate_verify is true, configure ca_file or pins instead")
+				}
+			} else {
+				glog.Info("[OPTION] pool ", pool.Host, ":", pool.Port, " TLS verification: Enabled")
+			}
+		}
 	}
 }
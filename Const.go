@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // AuthorizeStat 认证状态
 type AuthorizeStat uint8
 
@@ -30,9 +32,36 @@ const UpSessionChannelCache uint = 512
 const UpSessionManagerChannelCache uint = 64
 const SessionManagerChannelCache uint = 64
 
+// DownSessionQueueOverflowPolicy What a full miner session queue does
+const DownSessionQueueOverflowPolicy = EventQueueCoalesceJobs
+
 const UpSessionDialTimeoutSeconds Seconds = 15
 const UpSessionReadTimeoutSeconds Seconds = 60
 
+// UpSessionConnectFallbackDelay The next proxy is tried if the previous ones have not connected after this time
+const UpSessionConnectFallbackDelay = 2 * time.Second
+
+const UpSessionReconnectBackoffMinSeconds Seconds = 1
+const UpSessionReconnectBackoffMaxSeconds Seconds = 120
+const UpSessionReconnectBackoffMultiplier = 2.0
+
+const UpSessionTCPKeepAliveSeconds Seconds = 30
+const UpSessionPingIntervalSeconds Seconds = 30
+const UpSessionNotifyTimeoutSeconds Seconds = 90
+const UpSessionRedirectSeconds Seconds = 600
+
+// UpSessionRedirectMaxWait Limit of the wait time of client.reconnect
+const UpSessionRedirectMaxWait = 60 * time.Second
+
+// UpSessionHandOverTime A replaced pool connection still forwards the shares of its miners for this time
+const UpSessionHandOverTime = 5 * time.Second
+
+// UpSessionCheckAliveInterval Interval of the pool connection watchdog
+const UpSessionCheckAliveInterval = 5 * time.Second
+
+const PoolCircuitBreakerFailures uint32 = 5
+const PoolCircuitBreakerOpenSeconds Seconds = 60
+
 //btccom-agent/2.0.0-mu
 const UpSessionUserAgent = "oktapool-agent"
 
@@ -48,10 +77,52 @@ const (
 )
 
 const DownSessionDisconnectWhenLostAsicboost = true
-const UpSessionTLSInsecureSkipVerify = true
+const DownSessionTLSHandshakeTimeoutSeconds Seconds = 15
+const DownSessionWriteTimeoutSeconds Seconds = 10
+const DownSessionSubscribeTimeoutSeconds Seconds = 30
+const DownSessionAuthorizeTimeoutSeconds Seconds = 60
+const DownSessionIdleTimeoutSeconds Seconds = 900
+const DownSessionMaxLineBytes uint = 4096
+const DownSessionMaxMalformedLines uint = 10
+const UpSessionMaxLineBytes uint = 65536
+const DownSessionTLSCertReloadIntervalSeconds Seconds = 10
+const UpSessionTLSInsecureSkipVerify = false
+
+// DefaultVersionMask BIP320 general purpose bits, offered to miners until the version mask of the pool is known
+const DefaultVersionMask uint32 = 0x1fffe000
 
 const FakeJobNotifyIntervalSeconds Seconds = 30
 
+const ShareReplayBufferSize uint = 1000
+const ShareReplayMaxAgeSeconds Seconds = 60
+
+const ProxyHealthCheckIntervalSeconds Seconds = 60
+const ProxyMaxConsecutiveFailures uint32 = 3
+
+const DNSCacheTTLSeconds Seconds = 300
+const DNSLookupTimeoutSeconds Seconds = 5
+
+const DefaultShareJournalDir = "share_journal"
+const ShareJournalMaxFileSizeMB uint = 64
+const ShareJournalRotateIntervalSeconds Seconds = 86400
+const ShareJournalQueueSize uint = 4096
+
+const WorkerMonitorCheckIntervalSeconds Seconds = 30
+const WorkerMonitorOfflineAfterSeconds Seconds = 600
+const WorkerMonitorAlertQueueSize uint = 1024
+const AlertNotifierTimeoutSeconds Seconds = 10
+
+const EventBusQueueSize uint = 4096
+const EventSinkTimeoutSeconds Seconds = 10
+
+const LogRateLimitSeconds Seconds = 10
+const LogRateLimitMaxEntries = 4096
+
+const DefaultProtocolTraceDir = "traces"
+const ProtocolTraceMaxFileSizeMB uint = 16
+
+const DefaultAdminAPIListen = "127.0.0.1:9998"
+
 var FakeJobIDETHPrefixBin = []byte{
 	0xfa, 0x6e, 0x07, 0x0b, 0x00, 0x00, 0x00, 0x00,
 	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
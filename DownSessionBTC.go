@@ -3,35 +3,58 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"math"
+	"math/bits"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 )
 
 type DownSessionBTC struct {
-	id string // Connection identifier for printing logs
+	log     *Logger      // Logger with the miner connection context
+	readLog atomic.Value // *Logger, the same logger for the read loop
 
 	manager   *SessionManager // Session manager
 	upSession EventInterface  // Server session
 
 	sessionID       uint16        // Session ID
 	clientConn      net.Conn      // TCP connection to the mine machine
-	clientReader    *bufio.Reader // Read the content sent by the mine machine
+	clientReader    *LineReader   // Read the content sent by the mine machine
+	readDeadline    atomic.Value  // *downReadDeadline, set by the event loop and used by the read loop
+	connectedTime   time.Time     // Start of the subscribe and authorize deadlines
+	clientWriter    *bufio.Writer // Lines to the miner, flushed after each batch of events
+	writeTimeout    time.Duration // Write deadline of a batch
+	notifyTimes     []time.Time   // Fan-out start of the jobs in the current batch
 	readLoopRunning bool          // Is the TCP read loop running
+	malformedLines  uint          // Lines that are not valid JSON, counted by the read loop
 	stat            AuthorizeStat // Certification status
 
 	clientAgent    string // Mining software name
 	fullName       string // Complete miner name
 	subAccountName string // Sub-account name
 	workerName     string // Mining machine name
-	versionMask    uint32 // Bitcoin version mask(Asicboost)
+	versionMask    uint32 // Negotiated version mask (Asicboost), version bits of shares must be inside it
 
-	eventLoopRunning bool             // Whether the message loop is running
-	eventChannel     chan interface{} // Message channel
+	requestedVersionMask uint32 // Version mask requested by the miner, 0 if version rolling is not negotiated
+	minVersionBits       int    // version-rolling.min-bit-count of the miner
+	poolVersionMask      uint32 // Version mask allowed by the pool connection, DefaultVersionMask until it is known
+
+	minDifficulty atomic.Value // float64, minimum difficulty suggested by the miner, 0 if none. Read by the session managers
+
+	workerStatus *WorkerStatus // Entry of the connection in the worker monitor, nil if it is disabled. Read by the pool connection
+
+	eventLoopRunning bool        // Whether the message loop is running
+	eventQueue       *EventQueue // Bounded message queue, it never blocks the sender
 
 	versionRollingShareCounter uint64 // ASICBoost share Quantity
+
+	replayShares []*ReplayShareBTC // Shares submitted during a pool outage, handed to the next server session
+
+	traceTarget atomic.Value // *TraceTarget matched with protocol trace filters, replaced after authorization and read by the pool connection
 }
 
 // NewDownSessionBTC Create a new STRATUM session
@@ -40,13 +63,30 @@ func NewDownSessionBTC(manager *SessionManager, clientConn net.Conn, sessionID u
 	down.manager = manager
 	down.sessionID = sessionID
 	down.clientConn = clientConn
-	down.clientReader = bufio.NewReader(clientConn)
+	down.clientReader = NewLineReader(clientConn, int(manager.config.Advanced.MinerMaxLineBytes))
+	down.connectedTime = time.Now()
+	if manager.config.Advanced.MinerSubscribeTimeoutSeconds > 0 {
+		down.setReadDeadline(manager.config.Advanced.MinerSubscribeTimeoutSeconds.Get(), "subscribe_timeout")
+	} else {
+		down.setAuthorizeDeadline()
+	}
+	down.clientWriter = bufio.NewWriter(clientConn)
+	down.writeTimeout = manager.config.Advanced.MinerWriteTimeoutSeconds.Get()
 	down.stat = StatConnected
-	down.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.MinerSession)
+	down.poolVersionMask = DefaultVersionMask
+	down.eventQueue = NewEventQueue(int(manager.config.Advanced.MessageQueueSize.MinerSession), manager.config.Advanced.MinerQueueOverflowPolicy)
 
-	down.id = fmt.Sprintf("miner#%d (%s) ", down.sessionID, down.clientConn.RemoteAddr())
+	down.setLog(NewLogger("session_id", down.sessionID, "remote_addr", down.clientConn.RemoteAddr().String()))
+
+	ip, _, err := net.SplitHostPort(down.clientConn.RemoteAddr().String())
+	if err != nil {
+		ip = down.clientConn.RemoteAddr().String()
+	}
+	down.traceTarget.Store(&TraceTarget{SessionID: sessionID, IP: ip})
+	down.minDifficulty.Store(float64(0))
 
-	glog.Info(down.id, "miner connected")
+	down.log.Info("miner connected")
+	down.publishEvent(LifecycleMinerConnected, "")
 	return
 }
 
@@ -58,6 +98,16 @@ func (down *DownSessionBTC) SubAccountName() string {
 	return down.subAccountName
 }
 
+// TraceTarget The miner to be matched with protocol trace filters, safe to call from other goroutines
+func (down *DownSessionBTC) TraceTarget() *TraceTarget {
+	return down.traceTarget.Load().(*TraceTarget)
+}
+
+// MinDifficulty The minimum difficulty suggested by the miner, 0 if none, safe to call from other goroutines
+func (down *DownSessionBTC) MinDifficulty() float64 {
+	return down.minDifficulty.Load().(float64)
+}
+
 func (down *DownSessionBTC) Stat() AuthorizeStat {
 	return down.stat
 }
@@ -73,30 +123,85 @@ func (down *DownSessionBTC) Run() {
 
 func (down *DownSessionBTC) close() {
 	if down.upSession != nil && down.stat != StatExit {
-		go down.upSession.SendEvent(EventDownSessionBroken{down.sessionID})
+		down.upSession.SendEvent(EventDownSessionBroken{down.sessionID})
 	}
 
+	if monitor := down.manager.config.workerMonitor; monitor != nil && down.stat == StatAuthorized {
+		monitor.RemoveWorker(down.sessionID)
+	}
+	down.publishEvent(LifecycleMinerDisconnected, "")
+
 	down.eventLoopRunning = false
 	down.stat = StatDisconnected
+	// Lines such as client.reconnect may still be buffered
+	down.flush()
 	down.clientConn.Close()
+	// The read loop may still be waiting to queue a line or the broken connection
+	down.eventQueue.Close()
 
 	// release down id
 	down.manager.sessionIDManager.FreeSessionID(down.sessionID)
 }
 
+func (down *DownSessionBTC) setLog(log *Logger) {
+	down.log = log
+	down.readLog.Store(log)
+}
+
+func (down *DownSessionBTC) publishEvent(eventType string, message string) {
+	down.manager.config.eventBus.Publish(&LifecycleEvent{
+		Type: eventType,
+		Miner: &MinerEventInfo{
+			SessionID:   down.sessionID,
+			RemoteAddr:  down.clientConn.RemoteAddr().String(),
+			ClientAgent: down.clientAgent,
+			SubAccount:  down.subAccountName,
+			Worker:      down.workerName,
+		},
+		Message: message,
+	})
+}
+
 func (down *DownSessionBTC) writeJSONResponse(jsonData *JSONRPCResponse) (int, error) {
 	bytes, err := jsonData.ToJSONBytesLine()
 	if err != nil {
 		return 0, err
 	}
 	if glog.V(12) {
-		glog.Info(down.id, "writeJSONResponse: ", string(bytes))
+		down.log.Info("writeJSONResponse: ", string(bytes))
+	}
+	down.manager.config.traceManager.RecordMiner(down.TraceTarget(), TraceDirectionOut, bytes)
+	return down.write(bytes)
+}
+
+// write Buffer a line, the deadline is set at the first line of a batch
+func (down *DownSessionBTC) write(bytes []byte) (int, error) {
+	if down.clientWriter.Buffered() < 1 && down.writeTimeout > 0 {
+		down.clientConn.SetWriteDeadline(time.Now().Add(down.writeTimeout))
 	}
-	return down.clientConn.Write(bytes)
+	return down.clientWriter.Write(bytes)
+}
+
+// flush Write the buffered lines of the batch to the miner
+func (down *DownSessionBTC) flush() error {
+	if down.clientWriter.Buffered() < 1 {
+		return nil
+	}
+	err := down.clientWriter.Flush()
+	if err == nil && len(down.notifyTimes) > 0 {
+		now := time.Now()
+		for _, start := range down.notifyTimes {
+			metricNotifyFanout.Observe(now.Sub(start))
+		}
+	}
+	down.notifyTimes = down.notifyTimes[:0]
+	return err
 }
 
 func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, requestJSON []byte) (result interface{}, err *StratumError) {
-	glog.Info("DownStratumHandleRequest. request: ", *request, ", requestJSON: ", string(requestJSON))
+	if glog.V(11) {
+		down.log.Info("stratumHandleRequest: ", string(requestJSON))
+	}
 	switch request.Method {
 	case "mining.subscribe":
 		if down.stat != StatConnected {
@@ -106,6 +211,7 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 		result, err = down.parseSubscribeRequest(request)
 		if err == nil {
 			down.stat = StatSubScribed
+			down.setAuthorizeDeadline()
 		}
 		return
 
@@ -117,12 +223,23 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 		result, err = down.parseAuthorizeRequest(request)
 		if err == nil {
 			down.stat = StatAuthorized
+			down.setIdleDeadline()
 			//Let the init () function returns
 			down.eventLoopRunning = false
 
-			down.id += fmt.Sprintf("<%s> ", down.fullName)
+			down.setLog(down.log.With("sub_account", down.subAccountName, "worker", down.workerName))
+
+			down.log.Info("miner authorized")
+
+			target := *down.TraceTarget()
+			target.Worker = down.workerName
+			target.FullName = down.fullName
+			down.traceTarget.Store(&target)
 
-			glog.Info(down.id, "miner authorized")
+			if monitor := down.manager.config.workerMonitor; monitor != nil {
+				down.workerStatus = monitor.AddWorker(down.sessionID, down.subAccountName, down.workerName)
+			}
+			down.publishEvent(LifecycleMinerAuthorized, "")
 		}
 		return
 
@@ -133,20 +250,28 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 	case "mining.submit":
 		result, err = down.parseMiningSubmit(request)
 		if err != nil {
-			glog.Warning(down.id, "stratum error: ", err, "; ", string(requestJSON))
+			down.log.Every("miner.stratum_error", LogRateLimitSeconds.Get()).Warning("stratum error: ", err, "; ", string(requestJSON))
 		}
 		return
 
-	// ignore unimplemented methods
+	case "mining.ping":
+		result = "pong"
+		return
+
+	case "client.get_version":
+		result = UpSessionUserAgent
+		return
+
 	case "mining.multi_version":
-		fallthrough
+		result, err = down.parseMultiVersionRequest(request)
+		return
+
 	case "mining.suggest_difficulty":
-		// If no response, the miner may wait indefinitely
-		err = StratumErrIllegalParams
+		result, err = down.parseSuggestDifficultyRequest(request)
 		return
 
 	default:
-		glog.Warning(down.id, "unknown request: ", string(requestJSON))
+		down.log.Every("miner.unknown_request", LogRateLimitSeconds.Get()).Warning("unknown request: ", string(requestJSON))
 
 		// If no response, the miner may wait indefinitely
 		err = StratumErrIllegalParams
@@ -155,7 +280,9 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 }
 
 func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
-	glog.Info("(down *DownSessionBTC) parseMiningSubmit. request: ", request)
+	if glog.V(11) {
+		down.log.Info("parseMiningSubmit: ", *request)
+	}
 	if down.stat != StatAuthorized {
 		err = StratumErrNeedAuthorized
 
@@ -255,19 +382,28 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 		}
 		msg.VersionMask = uint32(versionMask)
 		hasVersionMask = true
+
+		if msg.VersionMask&^down.versionMask != 0 {
+			metricDownSession.Add("illegal_version_mask", 1)
+			down.log.Every("miner.illegal_version_mask", LogRateLimitSeconds.Get()).Warning("version bits ", versionMaskHex, " out of the negotiated mask ", down.versionMaskStr())
+			err = STATUS_ILLEGAL_VERMASK.ToStratumError()
+			return
+		}
 	}
 
 	// down id
 	msg.Base.SessionID = down.sessionID
 
-	go down.upSession.SendEvent(EventSubmitShareBTC{request.ID, &msg})
+	down.upSession.SendEvent(EventSubmitShareBTC{request.ID, &msg})
+	down.setIdleDeadline()
 
 	// If AsicBoost is lost, send a reconnection request
 	if down.manager.config.DisconnectWhenLostAsicboost {
 		if hasVersionMask {
 			down.versionRollingShareCounter++
 		} else if down.versionRollingShareCounter > 100 {
-			glog.Warning(down.id, "AsicBoost disabled mid-way after ", down.versionRollingShareCounter, " shares, send client.reconnect")
+			down.log.Warning("AsicBoost disabled mid-way after ", down.versionRollingShareCounter, " shares, send client.reconnect")
+			down.publishEvent(LifecycleMinerLostAsicBoost, fmt.Sprintf("AsicBoost disabled mid-way after %d shares", down.versionRollingShareCounter))
 
 			// send reconnect request to miner
 			down.sendReconnectRequest()
@@ -282,10 +418,10 @@ func (down *DownSessionBTC) sendReconnectRequest() {
 	reconnect.Params = JSONRPCArray{}
 	bytes, err := reconnect.ToJSONBytesLine()
 	if err != nil {
-		glog.Error(down.id, "failed to convert client.reconnect request to JSON: ", err.Error(), "; ", reconnect)
+		down.log.Error("failed to convert client.reconnect request to JSON: ", err.Error(), "; ", reconnect)
 		return
 	}
-	go down.SendEvent(EventSendBytes{bytes})
+	down.SendEvent(EventSendBytes{bytes})
 }
 
 func (down *DownSessionBTC) parseSubscribeRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
@@ -369,27 +505,153 @@ func (down *DownSessionBTC) parseConfigureRequest(request *JSONRPCLineBTC) (resu
 		return
 	}
 
-	if options, ok := request.Params[1].(map[string]interface{}); ok {
-		if obj, ok := options["version-rolling.mask"]; ok {
-			if versionMaskStr, ok := obj.(string); ok {
-				versionMask, err := strconv.ParseUint(versionMaskStr, 16, 32)
-				if err == nil {
-					down.versionMask = uint32(versionMask)
-				}
-			}
+	extensions, _ := request.Params[0].([]interface{})
+	options, _ := request.Params[1].(map[string]interface{})
+	_, hasMask := options["version-rolling.mask"]
+
+	// Unknown extensions are left out of the result
+	configured := JSONRPCObj{}
+	for _, extension := range extensions {
+		if extension == "version-rolling" {
+			hasMask = true
 		}
 	}
+	if hasMask {
+		err = down.negotiateVersionRolling(options, configured)
+		if err != nil {
+			return
+		}
+	}
+	result = configured
+	return
+}
+
+// negotiateVersionRolling BIP310: the mask is the requested one intersected with the mask of the pool.
+// If the pool connection of the miner is not known yet, the mask is updated with mining.set_version_mask later.
+func (down *DownSessionBTC) negotiateVersionRolling(options map[string]interface{}, result JSONRPCObj) *StratumError {
+	requested := uint64(0xffffffff)
+	if obj, ok := options["version-rolling.mask"]; ok {
+		versionMaskStr, ok := obj.(string)
+		if !ok {
+			return StratumErrIllegalParams
+		}
+		var err error
+		requested, err = strconv.ParseUint(versionMaskStr, 16, 32)
+		if err != nil {
+			return StratumErrIllegalParams
+		}
+	}
+	minBits := 0
+	if count, ok := options["version-rolling.min-bit-count"].(float64); ok && count > 0 {
+		minBits = int(count)
+	}
+
+	down.versionMask = NegotiateVersionMask(uint32(requested), down.poolVersionMask, minBits)
+	if down.versionMask == 0 {
+		// Not negotiated, the miner must not roll versions
+		down.requestedVersionMask = 0
+		result["version-rolling"] = false
+		return nil
+	}
+	down.requestedVersionMask = uint32(requested)
+	down.minVersionBits = minBits
+	result["version-rolling"] = true
+	result["version-rolling.mask"] = down.versionMaskStr()
+	return nil
+}
+
+// NegotiateVersionMask The bits allowed by both sides, 0 if there are less than minBits of them
+func NegotiateVersionMask(requested uint32, allowed uint32, minBits int) uint32 {
+	mask := requested & allowed
+	if bits.OnesCount32(mask) < minBits {
+		return 0
+	}
+	return mask
+}
+
+// setVersionMask Negotiate the mask again with the pool connection, sent if it changed
+func (down *DownSessionBTC) setVersionMask(e EventSetVersionMask) {
+	down.poolVersionMask = e.VersionMask
+	if down.requestedVersionMask == 0 {
+		return
+	}
+	versionMask := NegotiateVersionMask(down.requestedVersionMask, e.VersionMask, down.minVersionBits)
+	if versionMask == down.versionMask {
+		return
+	}
+	down.versionMask = versionMask
+	if glog.V(3) {
+		down.log.Info("version mask changed to ", down.versionMaskStr())
+	}
+
+	var request JSONRPCRequest
+	request.Method = "mining.set_version_mask"
+	request.SetParams(down.versionMaskStr())
+	bytes, err := request.ToJSONBytesLine()
+	if err != nil {
+		down.log.Error("failed to convert mining.set_version_mask request to JSON: ", err.Error(), "; ", request)
+		return
+	}
+	down.sendBytes(EventSendBytes{bytes})
+}
+
+func (down *DownSessionBTC) parseMultiVersionRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	// request:
+	//		{"id":2,"method":"mining.multi_version","params":[4]}
+	// response:
+	//		{"id":2,"result":true,"error":null}
+	//		{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}
 
-	if down.versionMask != 0 {
-		// The response here is a false version mask.After connecting the server mining.set_version_mask
-		// Update to a real version mask.
-		result = JSONRPCObj{
-			"version-rolling":      true,
-			"version-rolling.mask": down.versionMaskStr()}
+	if len(request.Params) < 1 {
+		err = StratumErrTooFewParams
+		return
+	}
+	versions, ok := request.Params[0].(float64)
+	if !ok || versions < 1 {
+		err = StratumErrIllegalParams
+		return
+	}
+
+	// The firmware rolls versions without mining.configure, the mask of the pool is sent after authorization.
+	// The miner has no mask until then, so mining.set_version_mask is always sent.
+	if versions > 1 && down.requestedVersionMask == 0 {
+		down.requestedVersionMask = 0xffffffff
+	}
+	result = true
+	return
+}
+
+func (down *DownSessionBTC) parseSuggestDifficultyRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	// request:
+	//		{"id":2,"method":"mining.suggest_difficulty","params":[8192]}
+	// response:
+	//		{"id":2,"result":true,"error":null}
+	//		{"id":null,"method":"mining.set_difficulty","params":[8192]}
+
+	if len(request.Params) < 1 {
+		err = StratumErrTooFewParams
+		return
+	}
+	difficulty, ok := request.Params[0].(float64)
+	if !ok {
+		// some firmware sends the difficulty as a string
+		if str, isStr := request.Params[0].(string); isStr {
+			var e error
+			difficulty, e = strconv.ParseFloat(str, 64)
+			ok = e == nil
+		}
+	}
+	if !ok || difficulty <= 0 || math.IsInf(difficulty, 0) || math.IsNaN(difficulty) {
+		err = StratumErrIllegalParams
 		return
 	}
 
-	// Unknown configuration content, no response
+	down.minDifficulty.Store(difficulty)
+	// Before authorization, the server session reads it when the miner is added
+	if down.upSession != nil {
+		down.upSession.SendEvent(EventSuggestDifficulty{down.sessionID, difficulty})
+	}
+	result = true
 	return
 }
 
@@ -399,35 +661,114 @@ func (down *DownSessionBTC) versionMaskStr() string {
 
 func (down *DownSessionBTC) setUpSession(e EventSetUpSession) {
 	down.upSession = e.Session
+	// The mask of the new pool connection is not known yet, it is offered again with EventSetVersionMask
+	down.poolVersionMask = DefaultVersionMask
 	down.upSession.SendEvent(EventAddDownSession{down})
+
+	if len(down.replayShares) > 0 {
+		down.upSession.SendEvent(EventReplaySharesBTC{down.replayShares})
+		down.replayShares = nil
+	}
+}
+
+func (down *DownSessionBTC) recvReplayShares(e EventReplaySharesBTC) {
+	down.replayShares = append(down.replayShares, e.Shares...)
+}
+
+// downReadDeadline The miner must send a line (or a share when it is authorized) before the deadline
+type downReadDeadline struct {
+	Time   time.Time // zero for no deadline
+	Reason string    // metric key when the deadline is exceeded
+}
+
+func (down *DownSessionBTC) setReadDeadline(timeout time.Duration, reason string) {
+	deadline := &downReadDeadline{Reason: reason}
+	if timeout > 0 {
+		deadline.Time = time.Now().Add(timeout)
+	}
+	down.readDeadline.Store(deadline)
+}
+
+// setAuthorizeDeadline The miner must be authorized in time after it connected
+func (down *DownSessionBTC) setAuthorizeDeadline() {
+	timeout := down.manager.config.Advanced.MinerAuthorizeTimeoutSeconds.Get()
+	if timeout > 0 {
+		timeout -= time.Since(down.connectedTime)
+		if timeout <= 0 {
+			timeout = time.Nanosecond
+		}
+	}
+	down.setReadDeadline(timeout, "authorize_timeout")
+}
+
+// setIdleDeadline The authorized miner must submit a share in time
+func (down *DownSessionBTC) setIdleDeadline() {
+	down.setReadDeadline(down.manager.config.Advanced.MinerIdleTimeoutSeconds.Get(), "idle_timeout")
+}
+
+func (down *DownSessionBTC) getReadDeadline() *downReadDeadline {
+	return down.readDeadline.Load().(*downReadDeadline)
 }
 
 func (down *DownSessionBTC) handleRequest() {
 	down.readLoopRunning = true
 
 	for down.readLoopRunning {
-		jsonBytes, err := down.clientReader.ReadBytes('\n')
+		deadline := down.getReadDeadline()
+		down.clientConn.SetReadDeadline(deadline.Time)
+
+		jsonBytes, err := down.clientReader.ReadLine()
+		log := down.readLog.Load().(*Logger)
 		if err != nil {
-			glog.Error(down.id, "failed to read request from miner: ", err.Error())
+			if IsTimeoutError(err) {
+				// The deadline may have been extended during the read
+				deadline = down.getReadDeadline()
+				if deadline.Time.IsZero() || time.Now().Before(deadline.Time) {
+					continue
+				}
+				metricDownSession.Add(deadline.Reason, 1)
+				log.Every("miner."+deadline.Reason, LogRateLimitSeconds.Get()).Warning("miner timeout (", deadline.Reason, "), disconnect it")
+			} else if err == ErrLineTooLong {
+				metricDownSession.Add("line_too_long", 1)
+				log.Every("miner.line_too_long", LogRateLimitSeconds.Get()).Warning("line from miner exceeds ", down.manager.config.Advanced.MinerMaxLineBytes, " bytes, disconnect it")
+			} else {
+				log.Error("failed to read request from miner: ", err.Error())
+			}
 			down.connBroken()
 			return
 		}
 		if glog.V(11) {
-			glog.Info(down.id, "handleRequest: ", string(jsonBytes))
+			log.Info("handleRequest: ", string(jsonBytes))
 		}
 
 		rpcData, err := NewJSONRPCLineBTC(jsonBytes)
+		// a line such as "null" or "{}" is decoded without error
+		if err == nil && len(rpcData.Method) < 1 {
+			err = ErrNotJSONRPCRequest
+		}
 
-		// ignore the json decode error
+		// ignore the malformed line, until there are too many of them
 		if err != nil {
-			glog.Warning(down.id, "failed to decode JSON from miner: ", err.Error(), "; ", string(jsonBytes))
+			down.malformedLines++
+			metricDownSession.Add("malformed_lines", 1)
+			maxMalformed := down.manager.config.Advanced.MinerMaxMalformedLines
+			if maxMalformed > 0 && down.malformedLines >= maxMalformed {
+				metricDownSession.Add("malformed", 1)
+				log.Every("miner.malformed", LogRateLimitSeconds.Get()).Warning("miner sent ", down.malformedLines, " malformed lines, disconnect it")
+				down.connBroken()
+				return
+			}
+			log.Every("miner.decode_error", LogRateLimitSeconds.Get()).Warning("failed to decode JSON from miner: ", err.Error(), "; ", string(jsonBytes))
+			continue
 		}
 
-		down.SendEvent(EventRecvJSONRPCBTC{rpcData, jsonBytes})
+		down.eventQueue.PushWait(EventRecvJSONRPCBTC{rpcData, jsonBytes})
 	}
 }
 
 func (down *DownSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
+	down.manager.config.traceManager.RecordMiner(down.TraceTarget(), TraceDirectionIn, e.JSONBytes)
+
 	// stat will be changed in stratumHandleRequest
 	result, stratumErr := down.stratumHandleRequest(e.RPCData, e.JSONBytes)
 
@@ -438,11 +779,13 @@ func (down *DownSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 		response.Result = result
 		response.Error = stratumErr.ToJSONRPCArray(nil)
 
-		glog.Info(fmt.Sprintf("recvJSONRPC response: %v", response))
+		if glog.V(12) {
+			down.log.Info("recvJSONRPC response: ", response)
+		}
 		_, err := down.writeJSONResponse(&response)
 
 		if err != nil {
-			glog.Error(down.id, "failed to send response to miner: ", err.Error())
+			down.log.Error("failed to send response to miner: ", err.Error())
 			down.close()
 			return
 		}
@@ -450,25 +793,33 @@ func (down *DownSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 }
 
 func (down *DownSessionBTC) SendEvent(event interface{}) {
-	down.eventChannel <- event
+	down.eventQueue.Push(event)
 }
 
 func (down *DownSessionBTC) connBroken() {
 	down.readLoopRunning = false
-	down.SendEvent(EventConnBroken{})
+	down.eventQueue.PushWait(EventConnBroken{})
 }
 
 func (down *DownSessionBTC) sendBytes(e EventSendBytes) {
 	if glog.V(12) {
-		glog.Info(down.id, "sendBytes: down.clientConn address:", down.clientConn.RemoteAddr().String(), " e.Content: ", string(e.Content))
+		down.log.Info("sendBytes: down.clientConn address:", down.clientConn.RemoteAddr().String(), " e.Content: ", string(e.Content))
 	}
-	_, err := down.clientConn.Write(e.Content)
+	down.manager.config.traceManager.RecordMiner(down.TraceTarget(), TraceDirectionOut, e.Content)
+	_, err := down.write(e.Content)
 	if err != nil {
-		glog.Error(down.id, "failed to send notify to miner: ", err.Error())
+		down.log.Error("failed to send notify to miner: ", err.Error())
 		down.close()
 	}
 }
 
+func (down *DownSessionBTC) sendNotify(e EventSendNotify) {
+	if !e.Time.IsZero() {
+		down.notifyTimes = append(down.notifyTimes, e.Time)
+	}
+	down.sendBytes(EventSendBytes{e.Content})
+}
+
 func (down *DownSessionBTC) submitResponse(e EventSubmitResponse) {
 	var response JSONRPCResponse
 	response.ID = e.ID
@@ -480,7 +831,7 @@ func (down *DownSessionBTC) submitResponse(e EventSubmitResponse) {
 
 	_, err := down.writeJSONResponse(&response)
 	if err != nil {
-		glog.Error(down.id, "failed to send share response to miner: ", err.Error())
+		down.log.Error("failed to send share response to miner: ", err.Error())
 		down.close()
 	}
 }
@@ -491,22 +842,33 @@ func (down *DownSessionBTC) exit() {
 }
 
 func (down *DownSessionBTC) poolNotReady() {
-	glog.Warning(down.id, "pool connection not ready")
+	down.log.Every("miner.pool_not_ready", LogRateLimitSeconds.Get()).Warning("pool connection not ready")
 	down.exit()
 }
 
+func (down *DownSessionBTC) queueOverflow() {
+	down.log.Every("miner.queue_overflow", LogRateLimitSeconds.Get()).Warning("too many pending messages, the miner is too slow, disconnect it")
+	down.close()
+}
+
 func (down *DownSessionBTC) handleEvent() {
 	down.eventLoopRunning = true
 	for down.eventLoopRunning {
-		event := <-down.eventChannel
+		event := down.eventQueue.Pop()
 
 		switch e := event.(type) {
 		case EventSetUpSession:
 			down.setUpSession(e)
+		case EventReplaySharesBTC:
+			down.recvReplayShares(e)
 		case EventRecvJSONRPCBTC:
 			down.recvJSONRPC(e)
 		case EventSendBytes:
 			down.sendBytes(e)
+		case EventSetVersionMask:
+			down.setVersionMask(e)
+		case EventSendNotify:
+			down.sendNotify(e)
 		case EventSubmitResponse:
 			down.submitResponse(e)
 		case EventConnBroken:
@@ -515,8 +877,19 @@ func (down *DownSessionBTC) handleEvent() {
 			down.exit()
 		case EventPoolNotReady:
 			down.poolNotReady()
+		case EventQueueOverflow:
+			down.queueOverflow()
 		default:
-			glog.Error(down.id, "unknown event: ", e)
+			down.log.Error("unknown event: ", e)
+		}
+
+		// Flush when the batch of queued events is written, or before Init() returns
+		if down.stat != StatDisconnected && (!down.eventLoopRunning || down.eventQueue.Len() < 1) {
+			err := down.flush()
+			if err != nil {
+				down.log.Error("failed to write to miner: ", err.Error())
+				down.close()
+			}
 		}
 	}
 }
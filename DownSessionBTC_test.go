@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStuckMinerDoesNotDelayOthers(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.MinerWriteTimeoutSeconds = 1
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	// the stuck miner stops reading after the handshake
+	stuckConn, agentConn := net.Pipe()
+	defer stuckConn.Close()
+	go manager.RunDownSession(agentConn)
+	stuckConn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" + `{"id":2,"method":"mining.authorize","params":["mock.stuck",""]}` + "\n"))
+	reader := bufio.NewReader(stuckConn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, `{"id":2,`) {
+			break
+		}
+	}
+
+	miner, _ := connectMockMiner(t, manager, "worker1")
+
+	fanout := metricNotifyFanout.Stats().Count
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		pool.Notify(false)
+		miner.expect("mining.notify", nil)
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("job %d delayed by the stuck miner for %v", i, elapsed)
+		}
+	}
+	// the latency is recorded after the write returned, which may be after the miner read the job
+	waitMockPool(t, func() bool { return metricNotifyFanout.Stats().Count >= fanout+5 })
+
+	// the stuck miner is disconnected after the write timeout
+	time.Sleep(1500 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(io.Discard, reader)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the stuck miner should be disconnected")
+	}
+}
+
+func TestMinerTimeouts(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.MinerSubscribeTimeoutSeconds = 1
+		config.Advanced.MinerAuthorizeTimeoutSeconds = 2
+		config.Advanced.MinerIdleTimeoutSeconds = 1
+		config.Advanced.MinerMaxLineBytes = 256
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	closed := func(conn net.Conn) chan bool {
+		done := make(chan bool)
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(done)
+		}()
+		return done
+	}
+	waitClosed := func(done chan bool, timeout time.Duration, what string) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			t.Fatal(what)
+		}
+	}
+
+	counted := func(reason string, before string) {
+		t.Helper()
+		waitMockPool(t, func() bool { return metricValue(metricDownSession, reason) != before })
+	}
+	subscribeTimeouts := metricValue(metricDownSession, "subscribe_timeout")
+	authorizeTimeouts := metricValue(metricDownSession, "authorize_timeout")
+	idleTimeouts := metricValue(metricDownSession, "idle_timeout")
+	longLines := metricValue(metricDownSession, "line_too_long")
+
+	// a miner that never subscribes
+	silentConn, agentConn := net.Pipe()
+	defer silentConn.Close()
+	go manager.RunDownSession(agentConn)
+	silentClosed := closed(silentConn)
+
+	// a miner sending a too long line
+	longConn, agentConn := net.Pipe()
+	defer longConn.Close()
+	go manager.RunDownSession(agentConn)
+	longClosed := closed(longConn)
+	longConn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":["` + strings.Repeat("x", 300)))
+	waitClosed(longClosed, 500*time.Millisecond, "a too long line should close the session")
+	counted("line_too_long", longLines)
+	waitClosed(silentClosed, 2*time.Second, "a miner that never subscribes should be disconnected")
+	counted("subscribe_timeout", subscribeTimeouts)
+
+	// a miner that never authorizes
+	unauthorized := newMockMiner(t, manager)
+	defer unauthorized.conn.Close()
+	unauthorized.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	unauthorized.expect("", float64(1))
+
+	// an authorized miner is kept while it submits shares
+	miner := newMockMiner(t, manager)
+	defer miner.conn.Close()
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	extraNonce1, _ := strconv.ParseUint(miner.expect("", float64(1)).Result.([]interface{})[1].(string), 16, 16)
+	miner.send(`{"id":2,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	miner.expect("", float64(2))
+	job := miner.expect("mining.notify", nil).Params[0].(string)
+
+	for i := 3; i < 7; i++ {
+		time.Sleep(300 * time.Millisecond)
+		miner.submit(i, job)
+	}
+	// no more shares
+	deadline := time.After(2 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-miner.lines:
+		case <-deadline:
+			t.Fatal("an idle miner should be disconnected")
+		}
+	}
+	counted("idle_timeout", idleTimeouts)
+	for open := true; open; {
+		select {
+		case _, open = <-unauthorized.lines:
+		case <-time.After(time.Second):
+			t.Fatal("a miner that never authorizes should be disconnected")
+		}
+	}
+	counted("authorize_timeout", authorizeTimeouts)
+
+	// the session ID is free again
+	var id uint16
+	waitMockPool(t, func() bool {
+		var err error
+		id, err = manager.sessionIDManager.AllocSessionIDFrom(uint16(extraNonce1))
+		return err == nil
+	})
+	if id != uint16(extraNonce1) {
+		t.Errorf("session id %d of the idle miner should be freed, got %d", extraNonce1, id)
+	}
+	manager.sessionIDManager.FreeSessionID(id)
+}
+
+// metricValue The value of a metric counter, "0" if it is not created yet
+func metricValue(metric *expvar.Map, key string) string {
+	if value := metric.Get(key); value != nil {
+		return value.String()
+	}
+	return "0"
+}
+
+func TestMalformedMinerIsDisconnected(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.MinerMaxMalformedLines = 4
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	miner := newMockMiner(t, manager)
+	defer miner.conn.Close()
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(1))
+
+	// malformed lines are ignored until the threshold,
+	// including valid JSON that is not a request
+	miner.send(`{"id":2,"method":"mining.authorize",`)
+	miner.send(`garbage`)
+	miner.send(`null`)
+	miner.send(`{"id":3,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	miner.expect("", float64(3))
+
+	malformed := metricValue(metricDownSession, "malformed")
+	miner.send(`{"id":4,`)
+	deadline := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-miner.lines:
+		case <-deadline:
+			t.Fatal("a miner sending malformed lines should be disconnected")
+		}
+	}
+	if malformed == metricValue(metricDownSession, "malformed") {
+		t.Error("the disconnection is not counted")
+	}
+}
+
+// authorizeSuggesting Connect a miner suggesting the minimum difficulty before authorization, 0 for none
+func authorizeSuggesting(t *testing.T, manager *SessionManager, worker string, difficulty float64) *mockMiner {
+	miner := newMockMiner(t, manager)
+	t.Cleanup(func() { miner.conn.Close() })
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(1))
+	if difficulty > 0 {
+		miner.send(fmt.Sprintf(`{"id":2,"method":"mining.suggest_difficulty","params":[%v]}`, difficulty))
+		if result := miner.expect("", float64(2)); result.Result != true {
+			t.Fatalf("suggest_difficulty should be accepted: %v", result.Error)
+		}
+	}
+	miner.send(fmt.Sprintf(`{"id":3,"method":"mining.authorize","params":["mock.%s",""]}`, worker))
+	miner.expect("", float64(3))
+	return miner
+}
+
+func TestSuggestDifficulty(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	// the miner keeps the pool difficulty until the pool follows the suggestion
+	miner := authorizeSuggesting(t, manager, "worker1", 1024)
+	if diff := miner.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1) {
+		t.Errorf("the miner should get the pool difficulty, got %v", diff)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().SuggestedDifficulty == 1024 })
+	if diff := miner.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1024) {
+		t.Errorf("the difficulty of the pool should be forwarded, got %v", diff)
+	}
+
+	// the highest minimum of the connection is suggested
+	other := authorizeSuggesting(t, manager, "worker2", 4096)
+	if diff := other.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1024) {
+		t.Errorf("the miner should get the pool difficulty, got %v", diff)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().SuggestedDifficulty == 4096 })
+	if diff := miner.expect("mining.set_difficulty", nil).Params[0]; diff != float64(4096) {
+		t.Errorf("the difficulty of the pool should be forwarded, got %v", diff)
+	}
+	other.send(`{"id":4,"method":"mining.suggest_difficulty","params":[-1]}`)
+	if result := other.expect("", float64(4)); result.Error == nil {
+		t.Error("a negative difficulty should be rejected")
+	}
+
+	// suggested again when the miner leaves
+	other.conn.Close()
+	waitMockPool(t, func() bool { return pool.Stats().SuggestedDifficulty == 1024 })
+	if diff := miner.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1024) {
+		t.Errorf("the difficulty of the pool should be forwarded, got %v", diff)
+	}
+}
+
+func TestSuggestDifficultySeparateConnections(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolConnectionNumberPerSubAccount = 2
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 1 })
+
+	miner := authorizeSuggesting(t, manager, "worker1", 1024)
+	waitMockPool(t, func() bool { return pool.Stats().SuggestedDifficulty == 1024 })
+	miner.expect("mining.set_difficulty", nil)
+	if diff := miner.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1024) {
+		t.Errorf("the difficulty of the pool should be forwarded, got %v", diff)
+	}
+
+	// miners without a minimum are not moved to the difficulty suggested for another one,
+	// even if the other connection has fewer miners
+	for i := 2; i <= 4; i++ {
+		other := authorizeSuggesting(t, manager, fmt.Sprint("worker", i), 0)
+		if diff := other.expect("mining.set_difficulty", nil).Params[0]; diff != float64(1) {
+			t.Errorf("worker%d should be on its own pool connection, got difficulty %v", i, diff)
+		}
+	}
+}
+
+func TestMultiVersion(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	miner := newMockMiner(t, manager)
+	defer miner.conn.Close()
+	miner.send(`{"id":1,"method":"mining.multi_version","params":[4]}`)
+	if result := miner.expect("", float64(1)); result.Result != true || result.Error != nil {
+		t.Errorf("multi_version should be accepted: %v %v", result.Result, result.Error)
+	}
+	miner.send(`{"id":2,"method":"mining.multi_version","params":[]}`)
+	if result := miner.expect("", float64(2)); result.Error == nil {
+		t.Error("multi_version without the version count should be rejected")
+	}
+	miner.send(`{"id":3,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(3))
+	miner.send(`{"id":4,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	miner.expect("", float64(4))
+	if mask := miner.expect("mining.set_version_mask", nil).Params[0]; mask != "1fffe000" {
+		t.Fatalf("the mask of the pool should be sent after authorization, got %v", mask)
+	}
+	job := miner.expect("mining.notify", nil).Params[0].(string)
+
+	// the firmware rolls versions inside the mask
+	miner.send(`{"id":5,"method":"mining.submit","params":["mock.worker1","` + job + `","00000001","60b5e80b","00000005","00002000"]}`)
+	if response := miner.expect("", float64(5)); response.Result != true {
+		t.Fatalf("share with version bits rejected: %v", response.Error)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+	if shares := pool.Shares(); shares[0].VersionMask != "00002000" {
+		t.Errorf("the version bits should be sent to the pool: %+v", shares[0])
+	}
+}
+
+func TestVersionRollingNegotiation(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	// too few bits left after the intersection
+	other := newMockMiner(t, manager)
+	defer other.conn.Close()
+	other.send(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"00003fff","version-rolling.min-bit-count":2}]}`)
+	if result := other.expect("", float64(1)).Result.(map[string]interface{}); result["version-rolling"] != false {
+		t.Errorf("version rolling should be refused: %v", result)
+	}
+
+	miner := newMockMiner(t, manager)
+	defer miner.conn.Close()
+	miner.send(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffff0000","version-rolling.min-bit-count":2}]}`)
+	result := miner.expect("", float64(1)).Result.(map[string]interface{})
+	if result["version-rolling"] != true || result["version-rolling.mask"] != "1fff0000" {
+		t.Fatalf("the mask should be the intersection: %v", result)
+	}
+	miner.send(`{"id":2,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(2))
+	miner.send(`{"id":3,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	miner.expect("", float64(3))
+	job := miner.expect("mining.notify", nil).Params[0].(string)
+
+	submit := func(id int, versionBits string) *JSONRPCLineBTC {
+		t.Helper()
+		miner.send(`{"id":` + strconv.Itoa(id) + `,"method":"mining.submit","params":["mock.worker1","` + job + `","00000001","60b5e80b","` + Uint32ToHex(uint32(id)) + `","` + versionBits + `"]}`)
+		return miner.expect("", float64(id))
+	}
+	if response := submit(4, "00010000"); response.Result != true {
+		t.Fatalf("share inside the mask rejected: %v", response.Error)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+	if shares := pool.Shares(); shares[0].VersionMask != "00010000" {
+		t.Errorf("the version bits should be sent to the pool: %+v", shares[0])
+	}
+	if response := submit(5, "00000001"); mockPoolErrorCode(response) != float64(STATUS_ILLEGAL_VERMASK) {
+		t.Errorf("share outside the mask should be rejected: %v", response.Error)
+	}
+
+	// the pool changes its mask
+	pool.SetVersionMask(0x00ff0000)
+	if mask := miner.expect("mining.set_version_mask", nil).Params[0]; mask != "00ff0000" {
+		t.Errorf("wrong mask %v", mask)
+	}
+	if response := submit(6, "01000000"); mockPoolErrorCode(response) != float64(STATUS_ILLEGAL_VERMASK) {
+		t.Errorf("share outside the new mask should be rejected: %v", response.Error)
+	}
+	if pool.Stats().Rejected > 0 {
+		t.Error("shares outside the mask should not reach the pool")
+	}
+}
+
+func TestVersionRollingPerPool(t *testing.T) {
+	optionsA := NewMockPoolOptions()
+	optionsA.VersionMask = 0
+	poolA := NewMockPool(optionsA)
+	poolB := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", poolA)
+	network.Add("pool-b:3333", poolB)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a", "pool-b")
+	waitMockPool(t, func() bool { return poolA.Stats().Authorizes > 0 })
+
+	configure := func(miner *mockMiner) {
+		t.Helper()
+		miner.send(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffff0000","version-rolling.min-bit-count":2}]}`)
+		// the pool of the miner is not known yet, the default mask is offered
+		if result := miner.expect("", float64(1)).Result.(map[string]interface{}); result["version-rolling"] != true || result["version-rolling.mask"] != "1fff0000" {
+			t.Fatalf("version rolling should be negotiated with the default mask: %v", result)
+		}
+	}
+
+	miner := newMockMiner(t, manager)
+	defer miner.conn.Close()
+	configure(miner)
+	miner.send(`{"id":2,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(2))
+	miner.send(`{"id":3,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	miner.expect("", float64(3))
+	if mask := miner.expect("mining.set_version_mask", nil).Params[0]; mask != "00000000" {
+		t.Errorf("pool A does not roll versions, got mask %v", mask)
+	}
+
+	// a pool without version rolling does not disable it for the next miners
+	other := newMockMiner(t, manager)
+	defer other.conn.Close()
+	configure(other)
+
+	// pool A goes down, the mask of pool B is offered again
+	network.SetDown("pool-a:3333", true)
+	poolA.DisconnectAll()
+	if mask := miner.expect("mining.set_version_mask", nil).Params[0]; mask != "1fff0000" {
+		t.Fatalf("the mask should be negotiated again with pool B, got %v", mask)
+	}
+	var job string
+	for job == "" {
+		if id := miner.expect("mining.notify", nil).Params[0].(string); !strings.HasPrefix(id, "f") {
+			job = id
+		}
+	}
+	miner.send(`{"id":4,"method":"mining.submit","params":["mock.worker1","` + job + `","00000001","60b5e80b","00000004","00010000"]}`)
+	if response := miner.expect("", float64(4)); response.Result != true {
+		t.Fatalf("share with version bits rejected at pool B: %v", response.Error)
+	}
+	waitMockPool(t, func() bool { return poolB.Stats().Accepted == 1 })
+	if shares := poolB.Shares(); shares[0].VersionMask != "00010000" {
+		t.Errorf("the version bits should be sent to pool B: %+v", shares[0])
+	}
+}
@@ -4,6 +4,7 @@ type DownSession interface {
 	SessionID() uint16
 	SubAccountName() string
 	Stat() AuthorizeStat
+	MinDifficulty() float64
 	Init()
 	Run()
 	SendEvent(event interface{})
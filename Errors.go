@@ -48,6 +48,10 @@ var (
 	ErrAuthorizeFailed = errors.New("authorize failed")
 	// ErrTooMuchPendingAutoRegReq Too many pending auto-registration requests
 	ErrTooMuchPendingAutoRegReq = errors.New("too much pending auto reg request")
+	// ErrLineTooLong A line exceeds the size limit
+	ErrLineTooLong = errors.New("line too long")
+	// ErrNotJSONRPCRequest The line is valid JSON but not a request with a method
+	ErrNotJSONRPCRequest = errors.New("not a JSON-RPC request")
 )
 
 var (
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"net"
+	"time"
 )
 
 type EventType uint8
@@ -16,6 +17,7 @@ type EventInitFinished struct{}
 type EventUpSessionReady struct {
 	Slot    int
 	Session UpSession
+	Pool    string // host:port
 }
 
 type EventUpSessionInitFailed struct {
@@ -41,19 +43,56 @@ type EventSendBytes struct {
 	Content []byte
 }
 
+// EventSendNotify A mining.notify line, queued jobs may be dropped or coalesced if the miner is too slow
+type EventSendNotify struct {
+	Content []byte
+	Clean   bool
+	Time    time.Time // when the fan-out to all miners started, zero if it is not a fan-out
+}
+
 type EventDownSessionBroken struct {
 	SessionID uint16
 }
 
 type EventUpSessionBroken struct {
-	Slot int
+	Slot    int
+	Session UpSession
+}
+
+// EventUpSessionRedirect Connect the slot to another host, or back to the configured pools if Host is empty
+type EventUpSessionRedirect struct {
+	Slot      int
+	Session   UpSession
+	PoolIndex int
+	Host      string
+	Port      uint16
+	Wait      time.Duration
 }
 
+// EventUpSessionRedirected Session is nil if the new connection failed
+type EventUpSessionRedirected struct {
+	Slot    int
+	Old     UpSession
+	Session UpSession
+	Pool    string // host:port
+}
+
+// EventUpSessionReplaced The miners go to Session, which replaces the pool connection
+type EventUpSessionReplaced struct {
+	Session UpSession
+}
+
+type EventRedirectExpired struct{}
+
 type EventSubmitShareBTC struct {
 	ID      interface{}
 	Message *ExMessageSubmitShareBTC
 }
 
+type EventReplaySharesBTC struct {
+	Shares []*ReplayShareBTC
+}
+
 type EventSubmitResponse struct {
 	ID     interface{}
 	Status StratumStatus
@@ -77,7 +116,9 @@ type EventStopUpSessionManager struct {
 }
 
 type EventUpdateFakeJobBTC struct {
-	FakeJob *StratumJobBTC
+	FakeJob      *StratumJobBTC
+	PoolSession  *PoolSessionBTC // the pool connection that sent the job
+	DownSessions []uint16        // the miners of the connection, they are moved to the fake session next
 }
 
 type EventTransferDownSessions struct{}
@@ -91,6 +132,24 @@ type EventUpSessionConnection struct {
 	Error    error
 }
 
+type EventCheckAlive struct{}
+
+type EventUpSessionDegraded struct {
+	Slot int
+}
+
+type EventMigrateDownSessions struct{}
+
+// EventSetVersionMask The version mask allowed by the pool connection of a miner, the miner gets its part of it
+type EventSetVersionMask struct {
+	VersionMask uint32
+}
+
+type EventSuggestDifficulty struct {
+	SessionID  uint16
+	Difficulty float64
+}
+
 type EventSetDifficulty struct {
 	Difficulty uint64
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+)
+
+// Lifecycle event types
+const (
+	LifecycleMinerConnected     = "miner_connected"
+	LifecycleMinerAuthorized    = "miner_authorized"
+	LifecycleMinerDisconnected  = "miner_disconnected"
+	LifecycleMinerLostAsicBoost = "miner_lost_asicboost"
+	LifecyclePoolConnected      = "pool_connected"
+	LifecyclePoolConnectFailed  = "pool_connect_failed"
+	LifecyclePoolDisconnected   = "pool_disconnected"
+	LifecyclePoolDegraded       = "pool_degraded"
+)
+
+// MinerEventInfo The miner of a lifecycle event
+type MinerEventInfo struct {
+	SessionID   uint16 `json:"session_id"`
+	RemoteAddr  string `json:"remote_addr"`
+	ClientAgent string `json:"client_agent,omitempty"`
+	SubAccount  string `json:"sub_account,omitempty"`
+	Worker      string `json:"worker,omitempty"`
+}
+
+// PoolEventInfo The pool connection of a lifecycle event
+type PoolEventInfo struct {
+	SubAccount string `json:"sub_account"`
+	Slot       int    `json:"slot"`
+	Pool       string `json:"pool,omitempty"`
+}
+
+// LifecycleEvent A change of a miner or pool connection, published to the event sinks as JSON
+type LifecycleEvent struct {
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Miner   *MinerEventInfo `json:"miner,omitempty"`
+	Pool    *PoolEventInfo  `json:"pool,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// EventSink Deliver lifecycle events to somewhere outside of BTCAgent
+type EventSink interface {
+	Name() string
+	// Run Deliver events until the channel is closed
+	Run(events <-chan *LifecycleEvent)
+}
+
+// EventBus Publish lifecycle events to all sinks, each sink has its own queue
+// so that a slow sink never blocks sessions or other sinks.
+type EventBus struct {
+	sinks  []EventSink
+	queues []chan *LifecycleEvent
+}
+
+func NewEventBus(sinks []EventSink, queueSize uint) (bus *EventBus) {
+	bus = new(EventBus)
+	bus.sinks = sinks
+	for range sinks {
+		bus.queues = append(bus.queues, make(chan *LifecycleEvent, queueSize))
+	}
+	return
+}
+
+// Run Start all sinks in the background
+func (bus *EventBus) Run() {
+	for i, sink := range bus.sinks {
+		go sink.Run(bus.queues[i])
+	}
+}
+
+// Publish Send the event to all sinks. Safe to call on a nil bus, the event is discarded.
+func (bus *EventBus) Publish(event *LifecycleEvent) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	metricEventBus.Add(MetricKey("published", event.Type), 1)
+
+	for i, queue := range bus.queues {
+		select {
+		case queue <- event:
+		default:
+			metricEventBus.Add(MetricKey(bus.sinks[i].Name(), "dropped"), 1)
+		}
+	}
+}
+
+// PublishPoolEvent Publish an event of a pool connection slot
+func (bus *EventBus) PublishPoolEvent(eventType string, subAccount string, slot int, pool string, message string) {
+	bus.Publish(&LifecycleEvent{
+		Type:    eventType,
+		Pool:    &PoolEventInfo{SubAccount: subAccount, Slot: slot, Pool: pool},
+		Message: message,
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventBusUnixSocketAndWebhook(t *testing.T) {
+	// The webhook fails once, the event must be retried
+	var requests int32
+	received := make(chan LifecycleEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event LifecycleEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "events.sock")
+	socketSink, err := NewEventSink(EventSinkConfig{Type: "unix_socket", Path: socketPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookSink, err := NewEventSink(EventSinkConfig{Type: "webhook", URL: server.URL, MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewEventBus([]EventSink{socketSink, webhookSink}, 16)
+	bus.Run()
+
+	client, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// wait until the client is accepted
+	unixSink := socketSink.(*UnixSocketEventSink)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		unixSink.lock.Lock()
+		n := len(unixSink.clients)
+		unixSink.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unix socket client not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bus.PublishPoolEvent(LifecyclePoolDisconnected, "sub", 2, "pool:3333", "")
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event LifecycleEvent
+	if err := json.Unmarshal(line, &event); err != nil {
+		t.Fatalf("invalid event line %q: %v", line, err)
+	}
+	if event.Type != LifecyclePoolDisconnected || event.Pool == nil || event.Pool.Slot != 2 || event.Pool.Pool != "pool:3333" {
+		t.Errorf("wrong event from unix socket: %s", line)
+	}
+
+	select {
+	case event := <-received:
+		if event.Type != LifecyclePoolDisconnected {
+			t.Errorf("wrong event from webhook: %+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook event not retried")
+	}
+
+	// publishing to a disabled bus is a no-op
+	var disabled *EventBus
+	disabled.Publish(&LifecycleEvent{Type: LifecycleMinerConnected})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sync"
+)
+
+// What a full event queue does with a new event
+const (
+	// EventQueueDropOldestNotify Drop the oldest queued job, a clean job only if a newer clean job follows
+	EventQueueDropOldestNotify = "drop_oldest_notify"
+	// EventQueueCoalesceJobs Drop queued jobs superseded by newer ones, the last clean job is kept
+	EventQueueCoalesceJobs = "coalesce_jobs"
+	// EventQueueDisconnect Disconnect the slow consumer
+	EventQueueDisconnect = "disconnect"
+)
+
+func IsValidEventQueuePolicy(policy string) bool {
+	switch policy {
+	case EventQueueDropOldestNotify, EventQueueCoalesceJobs, EventQueueDisconnect:
+		return true
+	}
+	return false
+}
+
+// EventQueueOverflow Returned by Pop after the queue overflowed and no event could be dropped,
+// the consumer should close its session
+type EventQueueOverflow struct{}
+
+// EventQueue Bounded event queue of a session. Push never blocks: when the queue is full,
+// jobs are dropped or coalesced by the policy, and the consumer is disconnected if that is not enough.
+type EventQueue struct {
+	lock       sync.Mutex
+	events     []interface{}
+	size       int
+	policy     string
+	overflowed bool
+	closed     bool
+
+	ready chan struct{} // signaled when an event is pushed
+	space chan struct{} // signaled when an event is popped
+	done  chan struct{} // closed by Close, releases the waiting PushWait calls
+}
+
+func NewEventQueue(size int, policy string) (queue *EventQueue) {
+	if size < 1 {
+		size = 1
+	}
+	queue = new(EventQueue)
+	queue.events = make([]interface{}, 0, size)
+	queue.size = size
+	queue.policy = policy
+	queue.ready = make(chan struct{}, 1)
+	queue.space = make(chan struct{}, 1)
+	queue.done = make(chan struct{})
+	return
+}
+
+func wakeUp(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Push Add an event without blocking
+func (queue *EventQueue) Push(event interface{}) {
+	queue.lock.Lock()
+	defer wakeUp(queue.ready)
+	defer queue.lock.Unlock()
+
+	if queue.overflowed || queue.closed {
+		return
+	}
+	if len(queue.events) >= queue.size && !queue.makeRoom(event) {
+		metricEventQueue.Add("overflows", 1)
+		metricEventQueue.Add("disconnected", 1)
+		queue.overflowed = true
+		queue.events = nil
+		wakeUp(queue.space)
+		return
+	}
+	queue.events = append(queue.events, event)
+}
+
+// PushWait Add an event, wait while the queue is full. For the session's own reader,
+// so that a fast client is slowed down by TCP instead of being disconnected.
+// It returns without adding the event after the queue is closed.
+func (queue *EventQueue) PushWait(event interface{}) {
+	for {
+		queue.lock.Lock()
+		if queue.closed {
+			queue.lock.Unlock()
+			return
+		}
+		if queue.overflowed || len(queue.events) < queue.size {
+			queue.lock.Unlock()
+			queue.Push(event)
+			return
+		}
+		queue.lock.Unlock()
+		select {
+		case <-queue.space:
+		case <-queue.done:
+		}
+	}
+}
+
+// Close Drop the queued events, later events are dropped as well. Called when the consumer exits,
+// so that the producers never wait for it. Pop must not be called after Close.
+func (queue *EventQueue) Close() {
+	defer queue.lock.Unlock()
+	queue.lock.Lock()
+
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+	queue.events = nil
+	close(queue.done)
+}
+
+// Pop Take the oldest event, wait if the queue is empty
+func (queue *EventQueue) Pop() interface{} {
+	for {
+		queue.lock.Lock()
+		if queue.overflowed {
+			queue.lock.Unlock()
+			return EventQueueOverflow{}
+		}
+		if len(queue.events) > 0 {
+			event := queue.events[0]
+			queue.events[0] = nil
+			queue.events = queue.events[1:]
+			queue.lock.Unlock()
+			wakeUp(queue.space)
+			return event
+		}
+		queue.lock.Unlock()
+		<-queue.ready
+	}
+}
+
+func (queue *EventQueue) Len() int {
+	defer queue.lock.Unlock()
+	queue.lock.Lock()
+	return len(queue.events)
+}
+
+// makeRoom Drop events by the policy, return false if nothing can be dropped
+func (queue *EventQueue) makeRoom(event interface{}) bool {
+	switch queue.policy {
+	case EventQueueDropOldestNotify:
+		// A clean job tells the miner to abandon the older ones, it can only be dropped
+		// if a newer clean job does the same.
+		oldestClean, cleanJobs := -1, 0
+		if notify, ok := event.(EventSendNotify); ok && notify.Clean {
+			cleanJobs++
+		}
+		for i, queued := range queue.events {
+			notify, ok := queued.(EventSendNotify)
+			if !ok {
+				continue
+			}
+			if !notify.Clean {
+				queue.dropNotify(i)
+				return true
+			}
+			if oldestClean < 0 {
+				oldestClean = i
+			}
+			cleanJobs++
+		}
+		if cleanJobs > 1 {
+			queue.dropNotify(oldestClean)
+			return true
+		}
+
+	case EventQueueCoalesceJobs:
+		// Keep the newest job (the new event if it is a job), and the last clean job before it
+		// unless the newest job is clean itself. The miner works on the newest job anyway.
+		newest, newestClean := -1, false
+		if notify, ok := event.(EventSendNotify); ok {
+			newest, newestClean = len(queue.events), notify.Clean
+		} else {
+			for i := len(queue.events) - 1; i >= 0; i-- {
+				if notify, ok := queue.events[i].(EventSendNotify); ok {
+					newest, newestClean = i, notify.Clean
+					break
+				}
+			}
+		}
+		keepClean := -1
+		if !newestClean {
+			for i := newest - 1; i >= 0; i-- {
+				if notify, ok := queue.events[i].(EventSendNotify); ok && notify.Clean {
+					keepClean = i
+					break
+				}
+			}
+		}
+		kept := queue.events[:0]
+		dropped := 0
+		for i, queued := range queue.events {
+			if _, ok := queued.(EventSendNotify); ok && i < newest && i != keepClean {
+				dropped++
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		for i := len(kept); i < len(queue.events); i++ {
+			queue.events[i] = nil
+		}
+		queue.events = kept
+		if dropped > 0 && len(queue.events) < queue.size {
+			metricEventQueue.Add("overflows", 1)
+			metricEventQueue.Add("coalesced_notify", int64(dropped))
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *EventQueue) dropNotify(i int) {
+	queue.remove(i)
+	metricEventQueue.Add("overflows", 1)
+	metricEventQueue.Add("dropped_notify", 1)
+}
+
+func (queue *EventQueue) remove(i int) {
+	copy(queue.events[i:], queue.events[i+1:])
+	queue.events[len(queue.events)-1] = nil
+	queue.events = queue.events[:len(queue.events)-1]
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func notifyEvent(id string, clean bool) EventSendNotify {
+	return EventSendNotify{[]byte(id), clean, time.Time{}}
+}
+
+func popNotifyIDs(t *testing.T, queue *EventQueue) (ids []string) {
+	for queue.Len() > 0 {
+		switch e := queue.Pop().(type) {
+		case EventSendNotify:
+			ids = append(ids, string(e.Content))
+		case EventSubmitResponse:
+			ids = append(ids, "response")
+		default:
+			t.Fatalf("unexpected event %#v", e)
+		}
+	}
+	return
+}
+
+func TestEventQueueDropOldestNotify(t *testing.T) {
+	queue := NewEventQueue(3, EventQueueDropOldestNotify)
+	queue.Push(EventSubmitResponse{1, STATUS_ACCEPT})
+	queue.Push(notifyEvent("1", true))
+	queue.Push(notifyEvent("2", false))
+	queue.Push(notifyEvent("3", false))
+
+	ids := popNotifyIDs(t, queue)
+	if len(ids) != 3 || ids[0] != "response" || ids[1] != "1" || ids[2] != "3" {
+		t.Errorf("the oldest job that is not clean should be dropped: %v", ids)
+	}
+
+	// a clean job is only dropped for a newer clean job
+	queue.Push(notifyEvent("4", true))
+	queue.Push(notifyEvent("5", true))
+	queue.Push(notifyEvent("6", true))
+	queue.Push(notifyEvent("7", false))
+	ids = popNotifyIDs(t, queue)
+	if len(ids) != 3 || ids[0] != "5" || ids[1] != "6" || ids[2] != "7" {
+		t.Errorf("the oldest clean job should be dropped: %v", ids)
+	}
+	queue.Push(notifyEvent("8", true))
+	queue.Push(EventSubmitResponse{1, STATUS_ACCEPT})
+	queue.Push(EventSubmitResponse{2, STATUS_ACCEPT})
+	queue.Push(notifyEvent("9", false))
+	if _, ok := queue.Pop().(EventQueueOverflow); !ok {
+		t.Error("the only clean job must not be dropped for a job that is not clean")
+	}
+	queue = NewEventQueue(3, EventQueueDropOldestNotify)
+
+	// nothing to drop, the consumer is disconnected
+	for i := 0; i < 4; i++ {
+		queue.Push(EventSubmitResponse{i, STATUS_ACCEPT})
+	}
+	if _, ok := queue.Pop().(EventQueueOverflow); !ok {
+		t.Error("overflow should be reported")
+	}
+}
+
+func TestEventQueueCoalesceJobs(t *testing.T) {
+	queue := NewEventQueue(4, EventQueueCoalesceJobs)
+	queue.Push(notifyEvent("1", false))
+	queue.Push(notifyEvent("2", true))
+	queue.Push(EventSubmitResponse{1, STATUS_ACCEPT})
+	queue.Push(notifyEvent("3", false))
+	queue.Push(notifyEvent("4", false))
+
+	// job 1 and 3 are superseded, the clean job 2 is kept because job 4 is not clean
+	ids := popNotifyIDs(t, queue)
+	if len(ids) != 3 || ids[0] != "2" || ids[1] != "response" || ids[2] != "4" {
+		t.Errorf("wrong coalesced jobs: %v", ids)
+	}
+
+	queue.Push(notifyEvent("5", true))
+	queue.Push(notifyEvent("6", false))
+	queue.Push(notifyEvent("7", false))
+	queue.Push(notifyEvent("8", false))
+	queue.Push(notifyEvent("9", true))
+	if ids := popNotifyIDs(t, queue); len(ids) != 1 || ids[0] != "9" {
+		t.Errorf("a clean job supersedes all jobs: %v", ids)
+	}
+}
+
+func TestEventQueueDisconnect(t *testing.T) {
+	queue := NewEventQueue(2, EventQueueDisconnect)
+	queue.Push(notifyEvent("1", false))
+	queue.Push(notifyEvent("2", false))
+
+	done := make(chan bool)
+	go func() {
+		// the reader waits for space, it is released by the overflow
+		queue.PushWait(EventConnBroken{})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.Push(notifyEvent("3", false))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PushWait should return after the overflow")
+	}
+	if _, ok := queue.Pop().(EventQueueOverflow); !ok {
+		t.Error("overflow should be reported")
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	queue := NewEventQueue(1, EventQueueDisconnect)
+	queue.Push(EventSubmitResponse{1, STATUS_ACCEPT})
+
+	done := make(chan bool)
+	go func() {
+		// the reader of a closed session must not wait for the consumer forever
+		queue.PushWait(EventConnBroken{})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PushWait should return after Close")
+	}
+	queue.Push(EventSubmitResponse{2, STATUS_ACCEPT})
+	queue.PushWait(EventConnBroken{})
+	if queue.Len() != 0 {
+		t.Errorf("a closed queue should drop events, %d queued", queue.Len())
+	}
+}
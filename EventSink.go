@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// EventSinkConfig An event sink in the config file
+type EventSinkConfig struct {
+	Type           string  `json:"type"` // webhook, unix_socket or file
+	URL            string  `json:"url"`  // webhook: each event is POSTed as JSON
+	Path           string  `json:"path"` // unix_socket: the socket to listen on, file: the file to append to
+	MaxRetries     int     `json:"max_retries"`
+	TimeoutSeconds Seconds `json:"timeout_seconds"`
+}
+
+func NewEventSink(conf EventSinkConfig) (EventSink, error) {
+	timeout := conf.TimeoutSeconds.Get()
+	if timeout <= 0 {
+		timeout = EventSinkTimeoutSeconds.Get()
+	}
+
+	switch conf.Type {
+	case "webhook":
+		if len(conf.URL) < 1 {
+			return nil, fmt.Errorf("webhook event sink without url")
+		}
+		maxRetries := conf.MaxRetries
+		if maxRetries < 0 {
+			maxRetries = 0
+		}
+		return &WebhookEventSink{URL: conf.URL, MaxRetries: maxRetries, Client: &http.Client{Timeout: timeout}}, nil
+	case "unix_socket":
+		if len(conf.Path) < 1 {
+			return nil, fmt.Errorf("unix_socket event sink without path")
+		}
+		return NewUnixSocketEventSink(conf.Path, timeout)
+	case "file":
+		if len(conf.Path) < 1 {
+			return nil, fmt.Errorf("file event sink without path")
+		}
+		return NewFileEventSink(conf.Path)
+	default:
+		return nil, fmt.Errorf("unknown event sink type: %s", conf.Type)
+	}
+}
+
+// WebhookEventSink POST each event as JSON, retry with backoff if the server fails
+type WebhookEventSink struct {
+	URL        string
+	MaxRetries int
+	Client     *http.Client
+}
+
+func (sink *WebhookEventSink) Name() string {
+	return "webhook"
+}
+
+func (sink *WebhookEventSink) Run(events <-chan *LifecycleEvent) {
+	backoff := NewBackoff(time.Second, 30*time.Second, 2)
+	for event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			glog.Error("[event-bus] failed to encode event: ", err.Error())
+			continue
+		}
+
+		backoff.Reset()
+		for {
+			err = sink.post(body)
+			if err == nil {
+				metricEventBus.Add(MetricKey(sink.Name(), "sent"), 1)
+				break
+			}
+			if backoff.Attempt() >= sink.MaxRetries {
+				glog.Warning("[event-bus] webhook failed, event dropped after ", backoff.Attempt(), " retries: ", err.Error())
+				metricEventBus.Add(MetricKey(sink.Name(), "failures"), 1)
+				break
+			}
+			metricEventBus.Add(MetricKey(sink.Name(), "retries"), 1)
+			time.Sleep(backoff.Next())
+		}
+	}
+}
+
+func (sink *WebhookEventSink) post(body []byte) error {
+	response, err := sink.Client.Post(sink.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", sink.URL, response.Status)
+	}
+	return nil
+}
+
+// UnixSocketEventSink Write newline-delimited JSON to every client of a Unix socket.
+// Clients that cannot keep up are disconnected.
+type UnixSocketEventSink struct {
+	listener     net.Listener
+	writeTimeout time.Duration
+
+	lock    sync.Mutex
+	clients map[net.Conn]bool
+}
+
+func NewUnixSocketEventSink(path string, writeTimeout time.Duration) (sink *UnixSocketEventSink, err error) {
+	// The socket file of the last run
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+	sink = &UnixSocketEventSink{listener: listener, writeTimeout: writeTimeout, clients: make(map[net.Conn]bool)}
+	return
+}
+
+func (sink *UnixSocketEventSink) Name() string {
+	return "unix_socket"
+}
+
+func (sink *UnixSocketEventSink) Run(events <-chan *LifecycleEvent) {
+	go sink.acceptLoop()
+
+	for event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			glog.Error("[event-bus] failed to encode event: ", err.Error())
+			continue
+		}
+		line = append(line, '\n')
+
+		sink.lock.Lock()
+		for conn := range sink.clients {
+			conn.SetWriteDeadline(time.Now().Add(sink.writeTimeout))
+			_, err := conn.Write(line)
+			if err != nil {
+				glog.Info("[event-bus] unix socket client removed: ", err.Error())
+				conn.Close()
+				delete(sink.clients, conn)
+				metricEventBus.Add(MetricKey(sink.Name(), "failures"), 1)
+			}
+		}
+		sink.lock.Unlock()
+		metricEventBus.Add(MetricKey(sink.Name(), "sent"), 1)
+	}
+	sink.listener.Close()
+}
+
+func (sink *UnixSocketEventSink) acceptLoop() {
+	for {
+		conn, err := sink.listener.Accept()
+		if err != nil {
+			glog.Warning("[event-bus] unix socket closed: ", err.Error())
+			return
+		}
+		sink.lock.Lock()
+		sink.clients[conn] = true
+		sink.lock.Unlock()
+	}
+}
+
+// FileEventSink Append newline-delimited JSON to a file
+type FileEventSink struct {
+	file *os.File
+}
+
+func NewFileEventSink(path string) (sink *FileEventSink, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	sink = &FileEventSink{file}
+	return
+}
+
+func (sink *FileEventSink) Name() string {
+	return "file"
+}
+
+func (sink *FileEventSink) Run(events <-chan *LifecycleEvent) {
+	encoder := json.NewEncoder(sink.file)
+	for event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			glog.Error("[event-bus] failed to write event file: ", err.Error())
+			metricEventBus.Add(MetricKey(sink.Name(), "failures"), 1)
+			continue
+		}
+		metricEventBus.Add(MetricKey(sink.Name(), "sent"), 1)
+	}
+	sink.file.Close()
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // ex-message的magic number
 
 type ExMessageSubmitShareBTC struct {
@@ -15,3 +17,18 @@ type ExMessageSubmitShareBTC struct {
 
 	IsFakeJob bool
 }
+
+// PoolSessionBTC A lost pool connection. Its jobs stay valid only if the next connection resumes the session,
+// by sending the extranonce1 with mining.subscribe, and the pool gives the same extranonce1 back.
+type PoolSessionBTC struct {
+	Pool      string          // host:port
+	SessionID uint32          // extranonce1
+	JobIDs    map[string]bool // jobs since the last clean job
+}
+
+// ReplayShareBTC A share submitted during a pool outage, replayed after reconnecting
+type ReplayShareBTC struct {
+	Message     *ExMessageSubmitShareBTC
+	Time        time.Time
+	PoolSession *PoolSessionBTC // the pool connection the job came from
+}
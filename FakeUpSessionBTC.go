@@ -11,9 +11,17 @@ type FakeUpSessionBTC struct {
 	downSessions map[uint16]DownSession
 	eventChannel chan interface{}
 
+	// Miners given back to UpSessionManager, their shares sent before they learn about the new pool session are answered
+	movedDownSessions map[uint16]DownSession
+
 	fakeJob     *StratumJobBTC
 	exitChannel chan bool
 
+	// The pool session each miner came from, its shares may be replayed when the session is resumed
+	poolSessions map[uint16]*PoolSessionBTC
+	// Shares of real jobs submitted during the outage, oldest first
+	replayBuffer []*ReplayShareBTC
+
 	// Used to count the number of disconnected miners and synchronize to UpSessionManager
 	disconnectedMinerCounter int
 }
@@ -22,6 +30,8 @@ func NewFakeUpSessionBTC(manager *UpSessionManager) (up *FakeUpSessionBTC) {
 	up = new(FakeUpSessionBTC)
 	up.manager = manager
 	up.downSessions = make(map[uint16]DownSession)
+	up.movedDownSessions = make(map[uint16]DownSession)
+	up.poolSessions = make(map[uint16]*PoolSessionBTC)
 	up.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSession)
 	up.exitChannel = make(chan bool, 1)
 	return
@@ -41,12 +51,13 @@ func (up *FakeUpSessionBTC) SendEvent(event interface{}) {
 
 func (up *FakeUpSessionBTC) addDownSession(e EventAddDownSession) {
 	up.downSessions[e.Session.SessionID()] = e.Session
+	delete(up.movedDownSessions, e.Session.SessionID())
 
 	if up.manager.config.AlwaysKeepDownconn && up.fakeJob != nil {
 		up.fakeJob.ToNewFakeJob()
 		bytes, err := up.fakeJob.ToNotifyLine(true)
 		if err == nil {
-			e.Session.SendEvent(EventSendBytes{bytes})
+			e.Session.SendEvent(EventSendNotify{bytes, true, time.Time{}})
 		} else {
 			glog.Warning("[fake-pool-connection] failed to convert fake job to JSON:", err.Error(), "; ", up.fakeJob)
 		}
@@ -54,8 +65,19 @@ func (up *FakeUpSessionBTC) addDownSession(e EventAddDownSession) {
 }
 
 func (up *FakeUpSessionBTC) transferDownSessions() {
-	for _, down := range up.downSessions {
-		go up.manager.SendEvent(EventAddDownSession{down})
+	replayShares := up.takeReplayShares()
+
+	for sessionID, down := range up.downSessions {
+		up.movedDownSessions[sessionID] = down
+		delete(up.poolSessions, sessionID)
+		shares := replayShares[sessionID]
+		go func(down DownSession) {
+			// The down session must hold the shares before it is assigned to the new pool connection
+			if len(shares) > 0 {
+				down.SendEvent(EventReplaySharesBTC{shares})
+			}
+			up.manager.SendEvent(EventAddDownSession{down})
+		}(down)
 	}
 	// 与 UpSessionManager 同步矿机数量
 	go up.manager.SendEvent(EventUpdateFakeMinerNum{len(up.downSessions)})
@@ -69,12 +91,15 @@ func (up *FakeUpSessionBTC) exit() {
 	}
 
 	for _, down := range up.downSessions {
-		go down.SendEvent(EventExit{})
+		down.SendEvent(EventExit{})
 	}
 }
 
 func (up *FakeUpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{}, status StratumStatus) {
 	down, ok := up.downSessions[sessionID]
+	if !ok {
+		down, ok = up.movedDownSessions[sessionID]
+	}
 	if !ok {
 		// The client has been disconnected, ignored
 		if glog.V(3) {
@@ -82,15 +107,74 @@ func (up *FakeUpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{},
 		}
 		return
 	}
-	go down.SendEvent(EventSubmitResponse{id, status})
+	down.SendEvent(EventSubmitResponse{id, status})
 }
 
 func (up *FakeUpSessionBTC) handleSubmitShare(e EventSubmitShareBTC) {
+	if pool, ok := up.poolSessions[e.Message.Base.SessionID]; ok && !e.Message.IsFakeJob {
+		if pool.JobIDs[e.Message.Base.JobID] {
+			up.bufferShare(&ReplayShareBTC{e.Message, time.Now(), pool})
+		} else {
+			metricShareReplay.Add("dropped_stale", 1)
+		}
+	}
 	up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
 }
 
+// bufferShare Keep a share of a real job, it may still be accepted if the pool session is resumed
+func (up *FakeUpSessionBTC) bufferShare(share *ReplayShareBTC) {
+	bufferSize := int(up.manager.config.Advanced.ShareReplay.BufferSize)
+	if bufferSize < 1 {
+		return
+	}
+	if len(up.replayBuffer) >= bufferSize {
+		up.replayBuffer = up.replayBuffer[1:]
+		metricShareReplay.Add("dropped_full", 1)
+	}
+	up.replayBuffer = append(up.replayBuffer, share)
+	metricShareReplay.Add("buffered", 1)
+}
+
+// takeReplayShares Empty the buffer and group the unexpired shares by session ID
+func (up *FakeUpSessionBTC) takeReplayShares() (shares map[uint16][]*ReplayShareBTC) {
+	shares = make(map[uint16][]*ReplayShareBTC)
+	maxAge := up.manager.config.Advanced.ShareReplay.MaxAgeSeconds.Get()
+
+	for _, share := range up.replayBuffer {
+		if time.Since(share.Time) > maxAge {
+			metricShareReplay.Add("dropped_expired", 1)
+			continue
+		}
+		if _, ok := up.downSessions[share.Message.Base.SessionID]; !ok {
+			// the miner has been disconnected
+			metricShareReplay.Add("dropped_miner_gone", 1)
+			continue
+		}
+		shares[share.Message.Base.SessionID] = append(shares[share.Message.Base.SessionID], share)
+	}
+
+	if len(up.replayBuffer) > 0 {
+		glog.Info("[fake-pool-connection] ", len(up.replayBuffer), " shares submitted during the outage, ", len(shares), " miners have shares to replay")
+	}
+	up.replayBuffer = nil
+	return
+}
+
+// recvReplayShares Shares that could not be replayed because the new pool connection was lost again
+func (up *FakeUpSessionBTC) recvReplayShares(e EventReplaySharesBTC) {
+	for _, share := range e.Shares {
+		up.bufferShare(share)
+	}
+}
+
 func (up *FakeUpSessionBTC) downSessionBroken(e EventDownSessionBroken) {
+	if _, ok := up.movedDownSessions[e.SessionID]; ok {
+		// counted by the pool session it moved to
+		delete(up.movedDownSessions, e.SessionID)
+		return
+	}
 	delete(up.downSessions, e.SessionID)
+	delete(up.poolSessions, e.SessionID)
 
 	if up.disconnectedMinerCounter == 0 {
 		go func() {
@@ -108,6 +192,9 @@ func (up *FakeUpSessionBTC) sendUpdateMinerNum() {
 
 func (up *FakeUpSessionBTC) updateFakeJob(e EventUpdateFakeJobBTC) {
 	up.fakeJob = e.FakeJob
+	for _, sessionID := range e.DownSessions {
+		up.poolSessions[sessionID] = e.PoolSession
+	}
 }
 
 func (up *FakeUpSessionBTC) fakeNotifyTicker() {
@@ -137,8 +224,9 @@ func (up *FakeUpSessionBTC) sendFakeNotify() {
 		return
 	}
 
+	e := EventSendNotify{bytes, up.fakeJob.IsClean(), time.Now()}
 	for _, down := range up.downSessions {
-		go down.SendEvent(EventSendBytes{bytes})
+		down.SendEvent(e)
 	}
 }
 
@@ -151,10 +239,14 @@ func (up *FakeUpSessionBTC) handleEvent() {
 			up.addDownSession(e)
 		case EventSubmitShareBTC:
 			up.handleSubmitShare(e)
+		case EventReplaySharesBTC:
+			up.recvReplayShares(e)
 		case EventDownSessionBroken:
 			up.downSessionBroken(e)
 		case EventSendUpdateMinerNum:
 			up.sendUpdateMinerNum()
+		case EventSuggestDifficulty:
+			// the difficulty of fake jobs does not matter, the miner's minimum is read again by the next pool session
 		case EventTransferDownSessions:
 			up.transferDownSessions()
 		case EventUpdateFakeJobBTC:
@@ -85,9 +85,10 @@ func NewJSONRPC2Error(v1Err interface{}) (err *JSONRPC2Error) {
 	return
 }
 
+// NewJSONRPCLineBTC Parse a Stratum line. A "null" line gives an empty object rather than nil.
 func NewJSONRPCLineBTC(rpcJSON []byte) (rpcData *JSONRPCLineBTC, err error) {
 	rpcData = new(JSONRPCLineBTC)
-	err = json.Unmarshal(rpcJSON, &rpcData)
+	err = json.Unmarshal(rpcJSON, rpcData)
 	return
 }
 
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// Latency buckets grow by 2^(1/4) from 1µs, the last bucket is about 33s
+const (
+	latencyBucketsPerOctave = 4
+	latencyBucketNum        = 25*latencyBucketsPerOctave + 1
+)
+
+// LatencyStats Summary of a latency histogram, in milliseconds
+type LatencyStats struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// LatencyHistogram Thread safe latency histogram with logarithmic buckets, percentiles are the upper bounds
+// of the buckets (within 19%). It can be published with expvar.Publish.
+type LatencyHistogram struct {
+	lock    sync.Mutex
+	buckets [latencyBucketNum]uint64
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return new(LatencyHistogram)
+}
+
+func latencyBucket(d time.Duration) int {
+	if d <= time.Microsecond {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(float64(d)/float64(time.Microsecond)) * latencyBucketsPerOctave))
+	if i >= latencyBucketNum {
+		i = latencyBucketNum - 1
+	}
+	return i
+}
+
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(float64(time.Microsecond) * math.Exp2(float64(i)/latencyBucketsPerOctave))
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := latencyBucket(d)
+
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Stats Summary of the latencies observed since the last reset
+func (h *LatencyHistogram) Stats() (stats LatencyStats) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	stats.Count = h.count
+	if h.count < 1 {
+		return
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	percentile := func(p float64) float64 {
+		rank := uint64(math.Ceil(p * float64(h.count)))
+		var sum uint64
+		for i, n := range h.buckets {
+			sum += n
+			if sum >= rank {
+				bound := latencyBucketBound(i)
+				if bound > h.max {
+					bound = h.max
+				}
+				return ms(bound)
+			}
+		}
+		return ms(h.max)
+	}
+	stats.Mean = ms(h.sum / time.Duration(h.count))
+	stats.P50 = percentile(0.5)
+	stats.P90 = percentile(0.9)
+	stats.P99 = percentile(0.99)
+	stats.Max = ms(h.max)
+	return
+}
+
+// Reset Forget all observed latencies
+func (h *LatencyHistogram) Reset() {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.buckets = [latencyBucketNum]uint64{}
+	h.count = 0
+	h.sum = 0
+	h.max = 0
+}
+
+// String JSON of the stats, for expvar
+func (h *LatencyHistogram) String() string {
+	bytes, _ := json.Marshal(h.Stats())
+	return string(bytes)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+)
+
+// LineReader Read lines ending with '\n' with a size limit.
+// A line interrupted by a read deadline is kept, and completed by the next call.
+type LineReader struct {
+	reader  *bufio.Reader
+	maxSize int
+	partial []byte
+}
+
+// NewLineReader The buffer has the size of the limit, so a too long line is detected without waiting for its end.
+// maxSize 0 for no limit.
+func NewLineReader(r io.Reader, maxSize int) *LineReader {
+	if maxSize > 0 {
+		return &LineReader{reader: bufio.NewReaderSize(r, maxSize), maxSize: maxSize}
+	}
+	return &LineReader{reader: bufio.NewReader(r)}
+}
+
+// ReadLine Read a line including its '\n', ErrLineTooLong if it exceeds the size limit
+func (r *LineReader) ReadLine() (line []byte, err error) {
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if r.maxSize > 0 && (err == bufio.ErrBufferFull || len(r.partial)+len(chunk) > r.maxSize) {
+			r.partial = nil
+			return nil, ErrLineTooLong
+		}
+		if err == nil {
+			// chunk belongs to the buffer of the reader
+			line = append(r.partial, chunk...)
+			r.partial = nil
+			return line, nil
+		}
+		r.partial = append(r.partial, chunk...)
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+// IsTimeoutError Whether err is caused by a deadline
+func IsTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLineReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	reader := NewLineReader(server, 32)
+
+	go client.Write([]byte(`{"id":1,`))
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := reader.ReadLine(); !IsTimeoutError(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// the partial line is completed after the timeout
+	go client.Write([]byte("\"result\":true}\n{\"id\":2}\n"))
+	server.SetReadDeadline(time.Time{})
+	line, err := reader.ReadLine()
+	if err != nil || string(line) != "{\"id\":1,\"result\":true}\n" {
+		t.Fatalf("wrong line %q, %v", line, err)
+	}
+	line, err = reader.ReadLine()
+	if err != nil || string(line) != "{\"id\":2}\n" {
+		t.Fatalf("wrong line %q, %v", line, err)
+	}
+
+	go client.Write([]byte(`{"id":3,"method":"mining.subscribe","params":[]}` + "\n"))
+	if _, err := reader.ReadLine(); err != ErrLineTooLong {
+		t.Fatalf("expected ErrLineTooLong, got %v", err)
+	}
+}
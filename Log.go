@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Log formats of the structured logger
+const (
+	// LogFormatText Message followed by key=value fields
+	LogFormatText = "text"
+	// LogFormatLogfmt level=... msg="..." key=value
+	LogFormatLogfmt = "logfmt"
+	// LogFormatJSON One JSON object per record
+	LogFormatJSON = "json"
+)
+
+// logFormat The format of all structured loggers, it is read on every record by the session goroutines
+var logFormat atomic.Value
+
+func init() {
+	logFormat.Store(LogFormatText)
+}
+
+// SetLogFormat Change the format of all structured loggers
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText, LogFormatLogfmt, LogFormatJSON:
+		logFormat.Store(format)
+		return nil
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger Structured logger on top of glog.
+// Every record carries the context fields of its session, such as session_id, worker, sub_account and pool_slot.
+// The arguments of Info/Warning/Error are joined as glog does. All methods are safe on a nil logger, which discards the record.
+type Logger struct {
+	fields []logField
+}
+
+// NewLogger Create a logger with key, value pairs as context fields, fields with empty string values are omitted
+func NewLogger(keyValues ...interface{}) *Logger {
+	return new(Logger).With(keyValues...)
+}
+
+// With A copy of the logger with more context fields
+func (logger *Logger) With(keyValues ...interface{}) *Logger {
+	if logger == nil {
+		return nil
+	}
+	fields := make([]logField, len(logger.fields), len(logger.fields)+len(keyValues)/2)
+	copy(fields, logger.fields)
+
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		if str, ok := keyValues[i+1].(string); ok && len(str) < 1 {
+			continue
+		}
+		// a new value replaces the old one
+		replaced := false
+		for j := range fields {
+			if fields[j].key == key {
+				fields[j].value = keyValues[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			fields = append(fields, logField{key, keyValues[i+1]})
+		}
+	}
+	return &Logger{fields}
+}
+
+func (logger *Logger) Info(args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	glog.InfoDepth(1, logger.format("info", fmt.Sprint(args...)))
+}
+
+func (logger *Logger) Warning(args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	glog.WarningDepth(1, logger.format("warning", fmt.Sprint(args...)))
+}
+
+func (logger *Logger) Error(args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	glog.ErrorDepth(1, logger.format("error", fmt.Sprint(args...)))
+}
+
+func (logger *Logger) format(level string, message string) string {
+	var builder strings.Builder
+
+	switch logFormat.Load().(string) {
+	case LogFormatJSON:
+		builder.WriteString(`{"level":`)
+		writeJSONValue(&builder, level)
+		builder.WriteString(`,"msg":`)
+		writeJSONValue(&builder, message)
+		for _, field := range logger.fields {
+			builder.WriteByte(',')
+			writeJSONValue(&builder, field.key)
+			builder.WriteByte(':')
+			writeJSONValue(&builder, field.value)
+		}
+		builder.WriteByte('}')
+
+	case LogFormatLogfmt:
+		builder.WriteString("level=")
+		builder.WriteString(level)
+		builder.WriteString(" msg=")
+		builder.WriteString(logfmtValue(message))
+		for _, field := range logger.fields {
+			builder.WriteByte(' ')
+			builder.WriteString(field.key)
+			builder.WriteByte('=')
+			builder.WriteString(logfmtValue(fmt.Sprint(field.value)))
+		}
+
+	default:
+		builder.WriteString(message)
+		for _, field := range logger.fields {
+			builder.WriteByte(' ')
+			builder.WriteString(field.key)
+			builder.WriteByte('=')
+			builder.WriteString(logfmtValue(fmt.Sprint(field.value)))
+		}
+	}
+	return builder.String()
+}
+
+func writeJSONValue(builder *strings.Builder, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		bytes, _ = json.Marshal(fmt.Sprint(value))
+	}
+	builder.Write(bytes)
+}
+
+func logfmtValue(value string) string {
+	if len(value) < 1 || strings.ContainsAny(value, " =\"\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+type logRateLimitEntry struct {
+	last       time.Time
+	interval   time.Duration
+	suppressed uint64
+}
+
+var (
+	logRateLimitLock    sync.Mutex
+	logRateLimitEntries = make(map[string]*logRateLimitEntry)
+)
+
+// Every Rate limited logging: nil (so the record is discarded) if a record with the same key has been logged
+// by the same session within the interval. The first record after the interval carries the number of suppressed records.
+// The session is told by the context fields, a noisy miner does not hide the records of the others.
+func (logger *Logger) Every(key string, interval time.Duration) *Logger {
+	if logger == nil {
+		return nil
+	}
+	key = logger.scopeKey(key)
+
+	defer logRateLimitLock.Unlock()
+	logRateLimitLock.Lock()
+
+	now := time.Now()
+	entry, ok := logRateLimitEntries[key]
+	if !ok {
+		if len(logRateLimitEntries) >= LogRateLimitMaxEntries {
+			pruneLogRateLimitEntries(now)
+		}
+		entry = &logRateLimitEntry{interval: interval}
+		logRateLimitEntries[key] = entry
+	} else if now.Sub(entry.last) < interval {
+		entry.suppressed++
+		metricLog.Add("suppressed", 1)
+		return nil
+	}
+
+	entry.last = now
+	if entry.suppressed > 0 {
+		suppressed := entry.suppressed
+		entry.suppressed = 0
+		return logger.With("suppressed", suppressed)
+	}
+	return logger
+}
+
+// scopeKey The rate limit key within the session of the logger
+func (logger *Logger) scopeKey(key string) string {
+	if len(logger.fields) < 1 {
+		return key
+	}
+	var builder strings.Builder
+	for _, field := range logger.fields {
+		builder.WriteString(field.key)
+		builder.WriteByte('=')
+		builder.WriteString(fmt.Sprint(field.value))
+		builder.WriteByte(' ')
+	}
+	builder.WriteString(key)
+	return builder.String()
+}
+
+// pruneLogRateLimitEntries Forget the sessions that have been quiet for their interval, the lock must be held
+func pruneLogRateLimitEntries(now time.Time) {
+	for key, entry := range logRateLimitEntries {
+		if now.Sub(entry.last) >= entry.interval {
+			delete(logRateLimitEntries, key)
+		}
+	}
+}
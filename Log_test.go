@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLoggerFormat(t *testing.T) {
+	defer SetLogFormat(LogFormatText)
+	logger := NewLogger("session_id", uint16(3), "worker", "").With("sub_account", "sub a", "pool_slot", 1)
+
+	SetLogFormat(LogFormatText)
+	if line := logger.format("info", "miner authorized"); line != `miner authorized session_id=3 sub_account="sub a" pool_slot=1` {
+		t.Errorf("wrong text record: %s", line)
+	}
+
+	SetLogFormat(LogFormatLogfmt)
+	if line := logger.format("warning", "unknown request"); line != `level=warning msg="unknown request" session_id=3 sub_account="sub a" pool_slot=1` {
+		t.Errorf("wrong logfmt record: %s", line)
+	}
+
+	SetLogFormat(LogFormatJSON)
+	var record map[string]interface{}
+	line := logger.format("error", `bad "json"`)
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("invalid JSON record %s: %v", line, err)
+	}
+	if record["level"] != "error" || record["msg"] != `bad "json"` || record["session_id"] != float64(3) || record["sub_account"] != "sub a" {
+		t.Errorf("wrong JSON record: %s", line)
+	}
+	if _, ok := record["worker"]; ok {
+		t.Errorf("empty fields should be omitted: %s", line)
+	}
+
+	if SetLogFormat("xml") == nil {
+		t.Errorf("unknown format should be rejected")
+	}
+}
+
+func TestLoggerEvery(t *testing.T) {
+	logger := NewLogger()
+	key := "test.every"
+	logRateLimitLock.Lock()
+	delete(logRateLimitEntries, key)
+	logRateLimitLock.Unlock()
+
+	if logger.Every(key, time.Hour) == nil {
+		t.Fatal("the first record should be logged")
+	}
+	for i := 0; i < 3; i++ {
+		if logger.Every(key, time.Hour) != nil {
+			t.Fatal("records within the interval should be suppressed")
+		}
+	}
+
+	logRateLimitEntries[key].last = time.Now().Add(-2 * time.Hour)
+	next := logger.Every(key, time.Hour)
+	if next == nil || len(next.fields) != 1 || next.fields[0].value != uint64(3) {
+		t.Fatalf("the next record should carry the suppressed count: %+v", next)
+	}
+
+	// a nil logger discards records
+	var disabled *Logger
+	disabled.With("k", "v").Every(key, 0).Info("discarded")
+}
+
+func TestLoggerEveryPerSession(t *testing.T) {
+	key := "test.every_session"
+	first := NewLogger("session_id", "0001")
+	second := NewLogger("session_id", "0002")
+
+	if first.Every(key, time.Hour) == nil {
+		t.Fatal("the first record should be logged")
+	}
+	if first.Every(key, time.Hour) != nil {
+		t.Fatal("records of the same session within the interval should be suppressed")
+	}
+	if second.Every(key, time.Hour) == nil {
+		t.Fatal("another session should not be suppressed by the first one")
+	}
+}
@@ -13,6 +13,22 @@ import (
 )
 
 func main() {
+	// Subcommands, they have their own parameters
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "journal":
+			os.Exit(RunShareJournalCommand(os.Args[2:]))
+		case "trace":
+			os.Exit(RunTraceCommand(os.Args[2:]))
+		case "replay":
+			os.Exit(RunReplayCommand(os.Args[2:]))
+		case "minersim":
+			os.Exit(RunMinerSimCommand(os.Args[2:]))
+		case "mockpool":
+			os.Exit(RunMockPoolCommand(os.Args[2:]))
+		}
+	}
+
 	// Resolving command line parameters
 	configFilePath := flag.String("c", "agent_conf.json", "Path of config file")
 	logDir := flag.String("l", "", "Log directory")
@@ -53,6 +69,11 @@ func main() {
 		}()
 	}
 
+	// Start admin API service
+	if config.AdminAPI.Enable {
+		go NewAdminAPI(config).Run()
+	}
+
 	// Session manager
 	manager := NewSessionManager(config)
 
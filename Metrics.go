@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Runtime counters, published by expvar at /debug/vars of the HTTP debug service
+var (
+	// Upstream TLS handshake and certificate verification results, keyed by "<host:port>.<result>"
+	metricUpSessionTLS = expvar.NewMap("up_session_tls")
+	// DNS cache and lookup results of pool hosts
+	metricDNS = expvar.NewMap("dns")
+	// Pool connection attempts of all slots, failures are also keyed by "<host:port>.failures"
+	metricReconnect = expvar.NewMap("up_session_reconnect")
+	// Pool connection liveness: pings, pongs, degraded connections and migrated miners
+	metricUpSessionHealth = expvar.NewMap("up_session_health")
+	// Shares buffered during pool outages and the result of replaying them
+	metricShareReplay = expvar.NewMap("share_replay")
+	// Records written to the share journal, dropped records and write errors
+	metricShareJournal = expvar.NewMap("share_journal")
+	// Worker alerts by type and notifier failures
+	metricWorkerMonitor = expvar.NewMap("worker_monitor")
+	// Lifecycle events published by type, and sent, retried, dropped or failed events of each sink
+	metricEventBus = expvar.NewMap("event_bus")
+	// Log records suppressed by rate limiting
+	metricLog = expvar.NewMap("log")
+	// Protocol traces started, records written, traces stopped by their size limit or write errors
+	metricTrace = expvar.NewMap("trace")
+	// Miner event queue overflows, jobs dropped or coalesced and miners disconnected by the overflow policy
+	metricEventQueue = expvar.NewMap("event_queue")
+	// Miners disconnected by subscribe, authorize and idle timeouts, for too long lines or too many malformed lines
+	metricDownSession = expvar.NewMap("down_session")
+	// Requests from pools by method, such as mining.ping and client.reconnect
+	metricUpSessionRequests = expvar.NewMap("up_session_requests")
+	// Lines from pools that are too long or malformed, and known quirks fixed, keyed by "quirk.<name>"
+	metricUpSessionParse = expvar.NewMap("up_session_parse")
+	// Time from receiving a job to writing it to each miner socket, in milliseconds
+	metricNotifyFanout = NewLatencyMetric("notify_fanout_latency")
+)
+
+// NewLatencyMetric A latency histogram published by expvar
+func NewLatencyMetric(name string) *LatencyHistogram {
+	h := NewLatencyHistogram()
+	expvar.Publish(name, h)
+	return h
+}
+
+// MetricKey Join a metric name with its label
+func MetricKey(label string, name string) string {
+	return label + "." + name
+}
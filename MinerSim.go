@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MinerSimOptions Behaviour of the simulated miners
+type MinerSimOptions struct {
+	Agent         string        // host:port of the agent
+	Miners        int           // number of concurrent miner sessions
+	Ramp          time.Duration // connect the miners evenly over this time
+	ShareInterval time.Duration // mean interval between shares of a miner, shares are a Poisson process
+	VersionMask   uint32        // AsicBoost mask requested with mining.configure, 0 to skip mining.configure
+	Lifetime      time.Duration // mean lifetime of a session before the miner reconnects (churn), 0 to keep sessions
+	SubAccount    string
+	WorkerPrefix  string
+	Timeout       time.Duration // timeout of the handshake and of share responses
+}
+
+func NewMinerSimOptions() MinerSimOptions {
+	return MinerSimOptions{
+		Agent:         "127.0.0.1:3333",
+		Miners:        100,
+		Ramp:          10 * time.Second,
+		ShareInterval: 5 * time.Second,
+		VersionMask:   0x1fffe000,
+		SubAccount:    "sim",
+		WorkerPrefix:  "w",
+		Timeout:       30 * time.Second,
+	}
+}
+
+// MinerSimStats Counters of the simulator
+type MinerSimStats struct {
+	Connected     int64 // sessions currently authorized
+	Connects      uint64
+	ConnectErrors uint64
+	Disconnects   uint64 // sessions closed by the agent or by errors
+	Churns        uint64 // sessions closed by the simulator at the end of their lifetime
+	Jobs          uint64
+	Submitted     uint64
+	Accepted      uint64
+	Rejected      uint64
+	Timeouts      uint64 // shares without response before the timeout
+}
+
+// MinerSimulator Opens many concurrent Stratum sessions to the agent and measures latency and throughput
+type MinerSimulator struct {
+	Options MinerSimOptions
+
+	// Latency of the TCP connection, the subscribe and authorize responses, the first job and share responses
+	ConnectLatency   *LatencyHistogram
+	SubscribeLatency *LatencyHistogram
+	AuthorizeLatency *LatencyHistogram
+	FirstJobLatency  *LatencyHistogram
+	SubmitLatency    *LatencyHistogram
+
+	stats               MinerSimStats
+	recentSubmitLatency *LatencyHistogram // since the last progress report
+	dial                func() (net.Conn, error)
+	stop                chan bool
+	wg                  sync.WaitGroup
+}
+
+func NewMinerSimulator(options MinerSimOptions) (sim *MinerSimulator) {
+	sim = new(MinerSimulator)
+	sim.Options = options
+	sim.ConnectLatency = NewLatencyHistogram()
+	sim.SubscribeLatency = NewLatencyHistogram()
+	sim.AuthorizeLatency = NewLatencyHistogram()
+	sim.FirstJobLatency = NewLatencyHistogram()
+	sim.SubmitLatency = NewLatencyHistogram()
+	sim.recentSubmitLatency = NewLatencyHistogram()
+	sim.dial = func() (net.Conn, error) {
+		return net.DialTimeout("tcp", sim.Options.Agent, sim.Options.Timeout)
+	}
+	sim.stop = make(chan bool)
+	return
+}
+
+// Start Start the miners, they are connected evenly over the ramp time
+func (sim *MinerSimulator) Start() {
+	for i := 0; i < sim.Options.Miners; i++ {
+		sim.wg.Add(1)
+		go func(i int) {
+			defer sim.wg.Done()
+			if sim.Options.Miners > 1 && !sim.sleep(sim.Options.Ramp*time.Duration(i)/time.Duration(sim.Options.Miners)) {
+				return
+			}
+			worker := fmt.Sprintf("%s.%s%d", sim.Options.SubAccount, sim.Options.WorkerPrefix, i)
+			for sim.runSession(worker) {
+			}
+		}(i)
+	}
+}
+
+// Stop Close all sessions and wait for the miners to exit
+func (sim *MinerSimulator) Stop() {
+	close(sim.stop)
+	sim.wg.Wait()
+}
+
+func (sim *MinerSimulator) Stats() (stats MinerSimStats) {
+	stats.Connected = atomic.LoadInt64(&sim.stats.Connected)
+	stats.Connects = atomic.LoadUint64(&sim.stats.Connects)
+	stats.ConnectErrors = atomic.LoadUint64(&sim.stats.ConnectErrors)
+	stats.Disconnects = atomic.LoadUint64(&sim.stats.Disconnects)
+	stats.Churns = atomic.LoadUint64(&sim.stats.Churns)
+	stats.Jobs = atomic.LoadUint64(&sim.stats.Jobs)
+	stats.Submitted = atomic.LoadUint64(&sim.stats.Submitted)
+	stats.Accepted = atomic.LoadUint64(&sim.stats.Accepted)
+	stats.Rejected = atomic.LoadUint64(&sim.stats.Rejected)
+	stats.Timeouts = atomic.LoadUint64(&sim.stats.Timeouts)
+	return
+}
+
+// sleep Return false if the simulator is stopped during the sleep
+func (sim *MinerSimulator) sleep(d time.Duration) bool {
+	select {
+	case <-sim.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// expDuration Random duration of an exponential distribution with the mean
+func expDuration(mean time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(mean))
+}
+
+// runSession Run a miner session until it ends, return false if the simulator is stopped
+func (sim *MinerSimulator) runSession(worker string) bool {
+	start := time.Now()
+	conn, err := sim.dial()
+	if err != nil {
+		atomic.AddUint64(&sim.stats.ConnectErrors, 1)
+		if glog.V(1) {
+			glog.Warning("[miner-sim] ", worker, " connect failed: ", err.Error())
+		}
+		return sim.sleep(time.Second)
+	}
+	sim.ConnectLatency.Observe(time.Since(start))
+	atomic.AddUint64(&sim.stats.Connects, 1)
+
+	session := &minerSimSession{sim: sim, worker: worker, conn: conn, lines: make(chan *JSONRPCLineBTC, 64), done: make(chan bool), pending: make(map[uint64]minerSimRequest)}
+	go session.readLoop()
+	defer close(session.done)
+	defer conn.Close()
+
+	ok := session.run()
+	if ok {
+		atomic.AddUint64(&sim.stats.Churns, 1)
+	} else {
+		select {
+		case <-sim.stop:
+			return false
+		default:
+		}
+		atomic.AddUint64(&sim.stats.Disconnects, 1)
+		return sim.sleep(time.Second)
+	}
+	return true
+}
+
+type minerSimRequest struct {
+	method string
+	time   time.Time
+}
+
+type minerSimSession struct {
+	sim    *MinerSimulator
+	worker string
+	conn   net.Conn
+	lines  chan *JSONRPCLineBTC
+	done   chan bool // closed when the session ends
+
+	nextID      uint64
+	pending     map[uint64]minerSimRequest
+	versionMask uint32
+	authorized  bool
+	connected   time.Time
+	gotJob      bool
+	jobID       string
+	nTime       string
+	extraNonce2 uint32
+}
+
+func (session *minerSimSession) readLoop() {
+	defer close(session.lines)
+	reader := bufio.NewReader(session.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		rpcData, err := NewJSONRPCLineBTC(line)
+		if err != nil {
+			glog.Warning("[miner-sim] ", session.worker, " invalid line: ", string(line))
+			continue
+		}
+		select {
+		case session.lines <- rpcData:
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (session *minerSimSession) send(method string, params ...interface{}) error {
+	session.nextID++
+	var request JSONRPCRequest
+	request.ID = session.nextID
+	request.Method = method
+	request.SetParams(params...)
+	bytes, err := request.ToJSONBytesLine()
+	if err != nil {
+		return err
+	}
+	session.pending[session.nextID] = minerSimRequest{method, time.Now()}
+	_, err = session.conn.Write(bytes)
+	return err
+}
+
+// run Return true if the session ended at the end of its lifetime, false if it was closed or the simulator is stopped
+func (session *minerSimSession) run() bool {
+	sim := session.sim
+	options := &sim.Options
+	session.connected = time.Now()
+
+	if options.VersionMask != 0 {
+		if session.send("mining.configure", JSONRPCArray{"version-rolling"}, JSONRPCObj{"version-rolling.mask": Uint32ToHex(options.VersionMask), "version-rolling.min-bit-count": 2}) != nil {
+			return false
+		}
+	}
+	if session.send("mining.subscribe", "btcagent-minersim") != nil {
+		return false
+	}
+	if session.send("mining.authorize", session.worker, "") != nil {
+		return false
+	}
+	defer func() {
+		if session.authorized {
+			atomic.AddInt64(&sim.stats.Connected, -1)
+		}
+	}()
+
+	var lifetime <-chan time.Time
+	if options.Lifetime > 0 {
+		lifetime = time.After(expDuration(options.Lifetime))
+	}
+	shareTimer := time.NewTimer(expDuration(options.ShareInterval))
+	defer shareTimer.Stop()
+	timeoutTicker := time.NewTicker(time.Second)
+	defer timeoutTicker.Stop()
+
+	for {
+		select {
+		case <-sim.stop:
+			return false
+
+		case <-lifetime:
+			return true
+
+		case rpcData, ok := <-session.lines:
+			if !ok || !session.handleLine(rpcData) {
+				return false
+			}
+
+		case <-shareTimer.C:
+			shareTimer.Reset(expDuration(options.ShareInterval))
+			if session.gotJob && session.submit() != nil {
+				return false
+			}
+
+		case now := <-timeoutTicker.C:
+			if !session.checkTimeouts(now) {
+				return false
+			}
+		}
+	}
+}
+
+// handleLine Return false to close the session
+func (session *minerSimSession) handleLine(rpcData *JSONRPCLineBTC) bool {
+	sim := session.sim
+
+	switch rpcData.Method {
+	case "mining.notify":
+		if len(rpcData.Params) < 9 {
+			return true
+		}
+		atomic.AddUint64(&sim.stats.Jobs, 1)
+		if !session.gotJob {
+			session.gotJob = true
+			sim.FirstJobLatency.Observe(time.Since(session.connected))
+		}
+		session.jobID, _ = rpcData.Params[0].(string)
+		session.nTime, _ = rpcData.Params[7].(string)
+		return true
+	case "mining.set_version_mask":
+		if len(rpcData.Params) > 0 {
+			if hex, ok := rpcData.Params[0].(string); ok {
+				mask, _ := strconv.ParseUint(hex, 16, 32)
+				session.versionMask = uint32(mask) & sim.Options.VersionMask
+			}
+		}
+		return true
+	case "client.reconnect":
+		return false
+	}
+	if len(rpcData.Method) > 0 {
+		// mining.set_difficulty etc.
+		return true
+	}
+
+	id, ok := rpcData.ID.(float64)
+	if !ok {
+		return true
+	}
+	request, ok := session.pending[uint64(id)]
+	if !ok {
+		return true
+	}
+	delete(session.pending, uint64(id))
+	latency := time.Since(request.time)
+	success := rpcData.Result == true
+
+	switch request.method {
+	case "mining.configure":
+		if result, ok := rpcData.Result.(map[string]interface{}); ok {
+			if hex, ok := result["version-rolling.mask"].(string); ok {
+				mask, _ := strconv.ParseUint(hex, 16, 32)
+				session.versionMask = uint32(mask) & sim.Options.VersionMask
+			}
+		}
+	case "mining.subscribe":
+		sim.SubscribeLatency.Observe(latency)
+		if rpcData.Result == nil {
+			glog.Warning("[miner-sim] ", session.worker, " subscribe failed: ", rpcData.Error)
+			return false
+		}
+	case "mining.authorize":
+		sim.AuthorizeLatency.Observe(latency)
+		if !success {
+			glog.Warning("[miner-sim] ", session.worker, " authorize failed: ", rpcData.Error)
+			return false
+		}
+		session.authorized = true
+		atomic.AddInt64(&sim.stats.Connected, 1)
+	case "mining.submit":
+		sim.SubmitLatency.Observe(latency)
+		sim.recentSubmitLatency.Observe(latency)
+		if success {
+			atomic.AddUint64(&sim.stats.Accepted, 1)
+		} else {
+			atomic.AddUint64(&sim.stats.Rejected, 1)
+		}
+	}
+	return true
+}
+
+func (session *minerSimSession) submit() error {
+	session.extraNonce2++
+	params := []interface{}{session.worker, session.jobID, Uint32ToHex(session.extraNonce2), session.nTime, Uint32ToHex(rand.Uint32())}
+	if session.versionMask != 0 {
+		params = append(params, Uint32ToHex(rand.Uint32()&session.versionMask))
+	}
+	atomic.AddUint64(&session.sim.stats.Submitted, 1)
+	return session.send("mining.submit", params...)
+}
+
+// checkTimeouts Drop requests without response, return false if the handshake timed out
+func (session *minerSimSession) checkTimeouts(now time.Time) bool {
+	for id, request := range session.pending {
+		if now.Sub(request.time) < session.sim.Options.Timeout {
+			continue
+		}
+		if request.method != "mining.submit" {
+			glog.Warning("[miner-sim] ", session.worker, " ", request.method, " timeout")
+			return false
+		}
+		delete(session.pending, id)
+		atomic.AddUint64(&session.sim.stats.Timeouts, 1)
+	}
+	return true
+}
+
+func formatLatencyStats(name string, stats LatencyStats) string {
+	return fmt.Sprintf("%-10s count %-8d mean %8.2fms  p50 %8.2fms  p90 %8.2fms  p99 %8.2fms  max %8.2fms",
+		name, stats.Count, stats.Mean, stats.P50, stats.P90, stats.P99, stats.Max)
+}
+
+// RunMinerSimCommand Subcommand "minersim": simulate miners connected to an agent for benchmarking
+func RunMinerSimCommand(args []string) int {
+	options := NewMinerSimOptions()
+
+	flags := flag.NewFlagSet("minersim", flag.ExitOnError)
+	flags.StringVar(&options.Agent, "agent", options.Agent, "Address of the agent")
+	flags.IntVar(&options.Miners, "miners", options.Miners, "Number of concurrent miners")
+	flags.DurationVar(&options.Ramp, "ramp", options.Ramp, "Connect the miners evenly over this time")
+	flags.DurationVar(&options.ShareInterval, "share-interval", options.ShareInterval, "Mean interval between shares of a miner")
+	versionMask := flags.String("version-mask", fmt.Sprintf("%08x", options.VersionMask), "AsicBoost version mask requested by the miners, 00000000 to disable")
+	flags.DurationVar(&options.Lifetime, "lifetime", 0, "Mean session lifetime before a miner reconnects, 0 to keep sessions")
+	flags.StringVar(&options.SubAccount, "sub-account", options.SubAccount, "Sub-account of the worker names")
+	flags.StringVar(&options.WorkerPrefix, "worker-prefix", options.WorkerPrefix, "Prefix of the worker names, followed by the miner number")
+	flags.DurationVar(&options.Timeout, "timeout", options.Timeout, "Timeout of the handshake and of share responses")
+	duration := flags.Duration("duration", 0, "Stop after this time, 0 to run until interrupted")
+	report := flags.Duration("report", 10*time.Second, "Interval of progress reports")
+	mockPool := flags.String("mockpool", "", "Also run a mock pool listening on this address, for the agent to connect to")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: btcagent minersim [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	flag.CommandLine.Parse([]string{"-logtostderr"})
+
+	mask, err := strconv.ParseUint(*versionMask, 16, 32)
+	if err != nil || options.Miners < 1 || options.ShareInterval <= 0 || *report <= 0 {
+		flags.Usage()
+		return 2
+	}
+	options.VersionMask = uint32(mask)
+
+	IncreaseFDLimit()
+
+	if *mockPool != "" {
+		listener, err := net.Listen("tcp", *mockPool)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		poolOptions := NewMockPoolOptions()
+		poolOptions.NotifyInterval = 30 * time.Second
+		pool := NewMockPool(poolOptions)
+		go pool.Serve(listener)
+		defer pool.Close()
+		glog.Info("[miner-sim] mock pool listening on ", listener.Addr())
+	}
+
+	sim := NewMinerSimulator(options)
+	start := time.Now()
+	sim.Start()
+	glog.Info("[miner-sim] starting ", options.Miners, " miners connecting to ", options.Agent, " in ", options.Ramp)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+
+	var last MinerSimStats
+	lastTime := start
+	running := true
+	for running {
+		select {
+		case <-signals:
+			running = false
+		case <-deadline:
+			running = false
+		case now := <-ticker.C:
+			stats := sim.Stats()
+			seconds := now.Sub(lastTime).Seconds()
+			submit := sim.recentSubmitLatency.Stats()
+			sim.recentSubmitLatency.Reset()
+			fmt.Printf("%6.0fs  miners %d  connects %d (%d errors)  disconnects %d  jobs %.1f/s  shares %.1f/s  accepted %.1f/s  rejected %.1f/s  timeouts %d  submit p50 %.2fms p99 %.2fms\n",
+				now.Sub(start).Seconds(), stats.Connected, stats.Connects, stats.ConnectErrors, stats.Disconnects,
+				float64(stats.Jobs-last.Jobs)/seconds, float64(stats.Submitted-last.Submitted)/seconds,
+				float64(stats.Accepted-last.Accepted)/seconds, float64(stats.Rejected-last.Rejected)/seconds,
+				stats.Timeouts, submit.P50, submit.P99)
+			last = stats
+			lastTime = now
+		}
+	}
+	sim.Stop()
+
+	stats := sim.Stats()
+	seconds := time.Since(start).Seconds()
+	fmt.Printf("\n%d miners, %.0fs, %d connects (%d errors), %d disconnects, %d churns\n",
+		options.Miners, seconds, stats.Connects, stats.ConnectErrors, stats.Disconnects, stats.Churns)
+	fmt.Printf("shares submitted %d (%.1f/s), accepted %d, rejected %d, timeouts %d, jobs %d\n",
+		stats.Submitted, float64(stats.Submitted)/seconds, stats.Accepted, stats.Rejected, stats.Timeouts, stats.Jobs)
+	fmt.Println(formatLatencyStats("connect", sim.ConnectLatency.Stats()))
+	fmt.Println(formatLatencyStats("subscribe", sim.SubscribeLatency.Stats()))
+	fmt.Println(formatLatencyStats("authorize", sim.AuthorizeLatency.Stats()))
+	fmt.Println(formatLatencyStats("first job", sim.FirstJobLatency.Stats()))
+	fmt.Println(formatLatencyStats("submit", sim.SubmitLatency.Stats()))
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := NewLatencyHistogram()
+	if stats := h.Stats(); stats.Count != 0 || stats.P99 != 0 {
+		t.Fatalf("empty histogram: %+v", stats)
+	}
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+	stats := h.Stats()
+	if stats.Count != 100 || stats.Max != 100 || stats.Mean != 50.5 {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+	// percentiles are bucket bounds, within 19% above the exact value
+	if stats.P50 < 50 || stats.P50 > 50*1.19 || stats.P99 < 99 || stats.P99 > 100 {
+		t.Errorf("wrong percentiles: %+v", stats)
+	}
+	h.Reset()
+	if h.Stats().Count != 0 {
+		t.Error("reset should forget all latencies")
+	}
+}
+
+func TestMinerSimulator(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	simOptions := NewMinerSimOptions()
+	simOptions.Miners = 20
+	simOptions.Ramp = 100 * time.Millisecond
+	simOptions.ShareInterval = 20 * time.Millisecond
+	simOptions.Lifetime = 300 * time.Millisecond
+	simOptions.SubAccount = "mock"
+	sim := NewMinerSimulator(simOptions)
+	sim.dial = func() (net.Conn, error) {
+		minerConn, agentConn := net.Pipe()
+		go manager.RunDownSession(agentConn)
+		return minerConn, nil
+	}
+
+	sim.Start()
+	time.Sleep(time.Second)
+	sim.Stop()
+
+	stats := sim.Stats()
+	if stats.Connected != 0 {
+		t.Errorf("all sessions should be closed, %d connected", stats.Connected)
+	}
+	if stats.Connects <= uint64(simOptions.Miners) || stats.Churns < 1 {
+		t.Errorf("miners should reconnect after their lifetime: %+v", stats)
+	}
+	if stats.Accepted < 1 || stats.Jobs < uint64(simOptions.Miners) || pool.Stats().Accepted < 1 {
+		t.Errorf("shares should be accepted: %+v", stats)
+	}
+	rolled := 0
+	for _, share := range pool.Shares() {
+		if share.VersionMask != "" {
+			rolled++
+		}
+	}
+	if rolled < 1 || stats.Rejected > 0 {
+		t.Errorf("shares should roll version bits inside the negotiated mask, %d rolled, %d rejected", rolled, stats.Rejected)
+	}
+	if latency := sim.SubmitLatency.Stats(); latency.Count != stats.Accepted+stats.Rejected {
+		t.Errorf("submit latency of %d shares, %d responses", latency.Count, stats.Accepted+stats.Rejected)
+	}
+	if sim.AuthorizeLatency.Stats().Count < uint64(simOptions.Miners) {
+		t.Error("authorize latency not measured")
+	}
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MockPoolStep A scripted step, the steps are run one after another on every authorized connection
+type MockPoolStep struct {
+	DelayMs    int64   `json:"delay_ms"`             // wait before the step
+	Difficulty float64 `json:"difficulty,omitempty"` // send mining.set_difficulty
+	Notify     bool    `json:"notify,omitempty"`     // send a new job
+	Clean      bool    `json:"clean,omitempty"`      // the new job invalidates older jobs
+	Disconnect bool    `json:"disconnect,omitempty"` // close the connection
+}
+
+// MockPoolOptions Behaviour of the mock pool
+type MockPoolOptions struct {
+	ExtraNonce2Size int           // extranonce2 size in the subscribe response, BTCAgent needs 4
+	VersionMask     uint32        // the pool's version rolling mask, 0 to refuse version rolling
+	Difficulty      float64       // difficulty sent after authorization
+	NotifyInterval  time.Duration // send a new job at this interval after the script, 0 to disable
+	Script          []MockPoolStep
+
+	RejectAuthorize bool          // all workers are unauthorized
+	RejectEvery     int           // reject every Nth share of a connection, 0 to disable
+	RejectRatio     float64       // reject shares randomly with this probability
+	RejectStale     bool          // reject shares of unknown jobs and jobs before the last clean job
+	Latency         time.Duration // delay of every line sent by the pool
+
+	DisconnectAfterShares int           // close a connection after this number of shares, 0 to disable
+	DisconnectAfter       time.Duration // close a connection this long after authorization, 0 to disable
+
+	ResumeSessions bool // mining.subscribe with the extranonce1 of a closed connection resumes it, with its jobs
+}
+
+// NewMockPoolOptions Options of a well-behaved pool
+func NewMockPoolOptions() MockPoolOptions {
+	return MockPoolOptions{
+		ExtraNonce2Size: 4,
+		VersionMask:     0x1fffe000,
+		Difficulty:      1,
+		RejectStale:     true,
+	}
+}
+
+// MockPoolShare A share received by the mock pool
+type MockPoolShare struct {
+	Worker      string
+	JobID       string
+	ExtraNonce2 string
+	NTime       string
+	Nonce       string
+	VersionMask string
+	Accepted    bool
+}
+
+// MockPoolStats Counters of the mock pool
+type MockPoolStats struct {
+	Connections uint64
+	Subscribes  uint64
+	Resumes     uint64 // subscribes that resumed a closed connection
+	Authorizes  uint64
+	Accepted    uint64
+	Rejected    uint64
+	Disconnects uint64 // connections closed by the pool
+
+	SuggestedDifficulty float64 // the last mining.suggest_difficulty
+}
+
+// MockPool A Stratum V1 pool for integration tests. Connections come from Serve (TCP)
+// or from MockPoolNetwork (in-memory), so tests need no network access.
+type MockPool struct {
+	Options MockPoolOptions
+
+	lock            sync.Mutex
+	conns           map[*mockPoolConn]bool
+	nextExtraNonce1 uint32
+	closedSessions  map[uint32]map[string]bool // jobs of the closed connections by extranonce1, with ResumeSessions
+	jobIndex        uint64
+	stats           MockPoolStats
+	shares          []MockPoolShare
+	responses       []*JSONRPCLineBTC
+	listener        net.Listener
+}
+
+func NewMockPool(options MockPoolOptions) (pool *MockPool) {
+	pool = new(MockPool)
+	pool.Options = options
+	pool.conns = make(map[*mockPoolConn]bool)
+	pool.closedSessions = make(map[uint32]map[string]bool)
+	pool.nextExtraNonce1 = 1
+	return
+}
+
+// Serve Accept connections from the listener until it is closed
+func (pool *MockPool) Serve(listener net.Listener) error {
+	pool.lock.Lock()
+	pool.listener = listener
+	pool.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go pool.ServeConn(conn)
+	}
+}
+
+// ServeConn Handle a connection until it is closed
+func (pool *MockPool) ServeConn(conn net.Conn) {
+	c := &mockPoolConn{pool: pool, conn: conn, jobs: make(map[string]bool), submitted: make(map[string]bool), done: make(chan bool)}
+
+	pool.lock.Lock()
+	pool.conns[c] = true
+	pool.stats.Connections++
+	c.extraNonce1 = pool.nextExtraNonce1
+	pool.nextExtraNonce1++
+	pool.lock.Unlock()
+
+	c.readLoop()
+
+	pool.lock.Lock()
+	delete(pool.conns, c)
+	pool.lock.Unlock()
+}
+
+// DisconnectAll Close all connections, as if the pool went down
+func (pool *MockPool) DisconnectAll() {
+	pool.lock.Lock()
+	conns := make([]*mockPoolConn, 0, len(pool.conns))
+	for c := range pool.conns {
+		conns = append(conns, c)
+	}
+	pool.lock.Unlock()
+
+	for _, c := range conns {
+		c.disconnect()
+	}
+}
+
+// Notify Send a new job to all authorized connections
+func (pool *MockPool) Notify(clean bool) {
+	pool.lock.Lock()
+	conns := make([]*mockPoolConn, 0, len(pool.conns))
+	for c := range pool.conns {
+		conns = append(conns, c)
+	}
+	pool.lock.Unlock()
+
+	for _, c := range conns {
+		if c.isAuthorized() {
+			c.notify(clean)
+		}
+	}
+}
+
+// Request Send a request of the pool, such as client.reconnect, to all authorized connections
+func (pool *MockPool) Request(id interface{}, method string, params ...interface{}) {
+	pool.lock.Lock()
+	conns := make([]*mockPoolConn, 0, len(pool.conns))
+	for c := range pool.conns {
+		conns = append(conns, c)
+	}
+	pool.lock.Unlock()
+
+	request := JSONRPCRequest{id, method, params}
+	if params == nil {
+		request.Params = JSONRPCArray{}
+	}
+	for _, c := range conns {
+		if c.isAuthorized() {
+			c.send(&request)
+		}
+	}
+}
+
+// SendLine Send a raw line to all authorized connections, such as a malformed one
+func (pool *MockPool) SendLine(line string) {
+	pool.lock.Lock()
+	conns := make([]*mockPoolConn, 0, len(pool.conns))
+	for c := range pool.conns {
+		conns = append(conns, c)
+	}
+	pool.lock.Unlock()
+
+	for _, c := range conns {
+		if c.isAuthorized() {
+			c.write([]byte(line + "\n"))
+		}
+	}
+}
+
+// SetVersionMask Change the version mask of the connections that negotiated version rolling
+func (pool *MockPool) SetVersionMask(mask uint32) {
+	pool.lock.Lock()
+	pool.Options.VersionMask = mask
+	conns := make([]*mockPoolConn, 0, len(pool.conns))
+	for c := range pool.conns {
+		conns = append(conns, c)
+	}
+	pool.lock.Unlock()
+
+	for _, c := range conns {
+		c.stateLock.Lock()
+		negotiated := c.versionMask != 0
+		if negotiated {
+			c.versionMask = mask
+		}
+		c.stateLock.Unlock()
+		if negotiated {
+			c.send(&JSONRPCRequest{nil, "mining.set_version_mask", JSONRPCArray{fmt.Sprintf("%08x", mask)}})
+		}
+	}
+}
+
+// connByExtraNonce1 The open connection with the extranonce1, nil if there is none
+func (pool *MockPool) connByExtraNonce1(extraNonce1 uint32) *mockPoolConn {
+	defer pool.lock.Unlock()
+	pool.lock.Lock()
+	for c := range pool.conns {
+		if c.extraNonce1 == extraNonce1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// Mute Stop sending jobs on the connection with the extranonce1, as a pool server that hangs
+func (pool *MockPool) Mute(extraNonce1 uint32) {
+	if c := pool.connByExtraNonce1(extraNonce1); c != nil {
+		c.stateLock.Lock()
+		c.muted = true
+		c.stateLock.Unlock()
+	}
+}
+
+// Disconnect Close the connection with the extranonce1, the other connections are kept
+func (pool *MockPool) Disconnect(extraNonce1 uint32) {
+	if c := pool.connByExtraNonce1(extraNonce1); c != nil {
+		c.disconnect()
+	}
+}
+
+// Close Stop accepting and close all connections
+func (pool *MockPool) Close() {
+	pool.lock.Lock()
+	listener := pool.listener
+	pool.lock.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	pool.DisconnectAll()
+}
+
+func (pool *MockPool) Stats() MockPoolStats {
+	defer pool.lock.Unlock()
+	pool.lock.Lock()
+	return pool.stats
+}
+
+// Shares All shares received, oldest first
+func (pool *MockPool) Shares() []MockPoolShare {
+	defer pool.lock.Unlock()
+	pool.lock.Lock()
+	return append([]MockPoolShare(nil), pool.shares...)
+}
+
+// Responses Responses to the requests of the pool, oldest first
+func (pool *MockPool) Responses() []*JSONRPCLineBTC {
+	defer pool.lock.Unlock()
+	pool.lock.Lock()
+	return append([]*JSONRPCLineBTC(nil), pool.responses...)
+}
+
+func (pool *MockPool) newJobID() string {
+	defer pool.lock.Unlock()
+	pool.lock.Lock()
+	pool.jobIndex++
+	return strconv.FormatUint(pool.jobIndex, 16)
+}
+
+// judge Accept or reject a share by the policies
+func (pool *MockPool) judge(c *mockPoolConn, share *MockPoolShare) *StratumError {
+	options := &pool.Options
+
+	key := share.JobID + "/" + share.ExtraNonce2 + "/" + share.NTime + "/" + share.Nonce + "/" + share.VersionMask
+	versionBits, _ := strconv.ParseUint(share.VersionMask, 16, 32)
+	switch {
+	case uint32(versionBits)&^c.versionMask != 0:
+		return STATUS_ILLEGAL_VERMASK.ToStratumError()
+	case options.RejectStale && !c.jobs[share.JobID]:
+		return StratumErrJobNotFound
+	case c.submitted[key]:
+		return STATUS_DUPLICATE_SHARE.ToStratumError()
+	case options.RejectEvery > 0 && c.shareCounter%options.RejectEvery == 0:
+		return STATUS_LOW_DIFFICULTY.ToStratumError()
+	case options.RejectRatio > 0 && rand.Float64() < options.RejectRatio:
+		return STATUS_LOW_DIFFICULTY.ToStratumError()
+	}
+	c.submitted[key] = true
+	return nil
+}
+
+type mockPoolConn struct {
+	pool *MockPool
+	conn net.Conn
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	done      chan bool
+
+	// owned by the read loop, and the script goroutine after authorization
+	stateLock    sync.Mutex
+	extraNonce1  uint32
+	versionMask  uint32 // negotiated by mining.configure, or sent by SetVersionMask
+	authorized   bool
+	muted        bool // no more jobs are sent
+	resumed      bool // the session of a closed connection, its jobs stay valid
+	jobs         map[string]bool
+	submitted    map[string]bool
+	shareCounter int
+}
+
+func (c *mockPoolConn) readLoop() {
+	defer c.close(false)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		request, err := NewJSONRPCLineBTC(line)
+		if err != nil {
+			glog.Warning("[mock-pool] invalid line: ", string(line))
+			continue
+		}
+		if !c.handleRequest(request) {
+			return
+		}
+	}
+}
+
+// handleRequest Return false to close the connection
+func (c *mockPoolConn) handleRequest(request *JSONRPCLineBTC) bool {
+	options := &c.pool.Options
+
+	switch request.Method {
+	case "":
+		// a response to Request
+		c.pool.lock.Lock()
+		c.pool.responses = append(c.pool.responses, request)
+		c.pool.lock.Unlock()
+
+	case "mining.configure":
+		c.respond(request.ID, c.configureResult(request), nil)
+
+	case "mining.subscribe":
+		c.pool.lock.Lock()
+		c.pool.stats.Subscribes++
+		c.pool.lock.Unlock()
+		c.resume(request)
+
+		c.stateLock.Lock()
+		extraNonce1 := Uint32ToHex(c.extraNonce1)
+		c.stateLock.Unlock()
+		c.respond(request.ID, JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", extraNonce1}, JSONRPCArray{"mining.notify", extraNonce1}}, extraNonce1, options.ExtraNonce2Size}, nil)
+
+	case "mining.authorize":
+		if options.RejectAuthorize {
+			c.respond(request.ID, false, StratumErrNeedAuthorized)
+			return true
+		}
+		c.pool.lock.Lock()
+		c.pool.stats.Authorizes++
+		c.pool.lock.Unlock()
+
+		c.respond(request.ID, true, nil)
+
+		c.stateLock.Lock()
+		started := c.authorized
+		c.authorized = true
+		c.stateLock.Unlock()
+		if !started {
+			go c.runScript()
+		}
+
+	case "mining.submit":
+		return c.handleSubmit(request)
+
+	case "mining.suggest_difficulty":
+		var difficulty float64
+		if len(request.Params) > 0 {
+			difficulty, _ = request.Params[0].(float64)
+		}
+		c.pool.lock.Lock()
+		c.pool.stats.SuggestedDifficulty = difficulty
+		c.pool.lock.Unlock()
+
+		c.respond(request.ID, true, nil)
+		// the difficulty is raised to the suggested minimum
+		if c.isAuthorized() && difficulty > options.Difficulty {
+			c.setDifficulty(difficulty)
+		}
+
+	default:
+		// pings and unknown requests get an error, which is still a response
+		c.respond(request.ID, nil, STATUS_ILLEGAL_METHOD.ToStratumError())
+	}
+	return true
+}
+
+// resume Take the extranonce1 and the jobs of a closed connection, if the subscribe asks for it with ResumeSessions
+func (c *mockPoolConn) resume(request *JSONRPCLineBTC) {
+	if !c.pool.Options.ResumeSessions || len(request.Params) < 2 {
+		return
+	}
+	hex, _ := request.Params[1].(string)
+	extraNonce1, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return
+	}
+
+	// extraNonce1 is read with either lock
+	c.stateLock.Lock()
+	c.pool.lock.Lock()
+	if jobs, ok := c.pool.closedSessions[uint32(extraNonce1)]; ok {
+		delete(c.pool.closedSessions, uint32(extraNonce1))
+		c.pool.stats.Resumes++
+		c.extraNonce1 = uint32(extraNonce1)
+		c.jobs = jobs
+		c.resumed = true
+	}
+	c.pool.lock.Unlock()
+	c.stateLock.Unlock()
+}
+
+// configureResult BIP310 version rolling: the mask is the pool mask intersected with the requested one
+func (c *mockPoolConn) configureResult(request *JSONRPCLineBTC) JSONRPCObj {
+	result := JSONRPCObj{}
+	if len(request.Params) < 1 {
+		return result
+	}
+	extensions, _ := request.Params[0].([]interface{})
+	for _, extension := range extensions {
+		if extension != "version-rolling" {
+			continue
+		}
+		requested := uint64(0xffffffff)
+		if len(request.Params) > 1 {
+			if params, ok := request.Params[1].(map[string]interface{}); ok {
+				if hex, ok := params["version-rolling.mask"].(string); ok {
+					requested, _ = strconv.ParseUint(hex, 16, 32)
+				}
+			}
+		}
+		c.pool.lock.Lock()
+		mask := c.pool.Options.VersionMask & uint32(requested)
+		c.pool.lock.Unlock()
+		c.stateLock.Lock()
+		c.versionMask = mask
+		c.stateLock.Unlock()
+		result["version-rolling"] = mask != 0
+		if mask != 0 {
+			result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+		}
+	}
+	return result
+}
+
+func (c *mockPoolConn) handleSubmit(request *JSONRPCLineBTC) bool {
+	options := &c.pool.Options
+	if !c.isAuthorized() {
+		c.respond(request.ID, nil, StratumErrNeedAuthorized)
+		return true
+	}
+	if len(request.Params) < 5 {
+		c.respond(request.ID, nil, StratumErrTooFewParams)
+		return true
+	}
+
+	var share MockPoolShare
+	share.Worker, _ = request.Params[0].(string)
+	share.JobID, _ = request.Params[1].(string)
+	share.ExtraNonce2, _ = request.Params[2].(string)
+	share.NTime, _ = request.Params[3].(string)
+	share.Nonce, _ = request.Params[4].(string)
+	if len(request.Params) > 5 {
+		share.VersionMask, _ = request.Params[5].(string)
+	}
+
+	c.stateLock.Lock()
+	c.shareCounter++
+	stratumErr := c.pool.judge(c, &share)
+	counter := c.shareCounter
+	c.stateLock.Unlock()
+
+	share.Accepted = stratumErr == nil
+	c.pool.lock.Lock()
+	c.pool.shares = append(c.pool.shares, share)
+	if share.Accepted {
+		c.pool.stats.Accepted++
+	} else {
+		c.pool.stats.Rejected++
+	}
+	c.pool.lock.Unlock()
+
+	if share.Accepted {
+		c.respond(request.ID, true, nil)
+	} else {
+		c.respond(request.ID, nil, stratumErr)
+	}
+
+	if options.DisconnectAfterShares > 0 && counter >= options.DisconnectAfterShares {
+		c.disconnect()
+		return false
+	}
+	return true
+}
+
+// runScript Send the difficulty, the first job and the scripted steps, then new jobs at the notify interval
+func (c *mockPoolConn) runScript() {
+	options := &c.pool.Options
+
+	var disconnectTimer <-chan time.Time
+	if options.DisconnectAfter > 0 {
+		disconnectTimer = time.After(options.DisconnectAfter)
+	}
+	wait := func(delay time.Duration) bool {
+		select {
+		case <-c.done:
+			return false
+		case <-disconnectTimer:
+			c.disconnect()
+			return false
+		case <-time.After(delay):
+			return true
+		}
+	}
+
+	c.setDifficulty(options.Difficulty)
+	// the jobs of a resumed session are still valid
+	c.stateLock.Lock()
+	resumed := c.resumed
+	c.stateLock.Unlock()
+	c.notify(!resumed)
+
+	for _, step := range options.Script {
+		if !wait(time.Duration(step.DelayMs) * time.Millisecond) {
+			return
+		}
+		if step.Difficulty > 0 {
+			c.setDifficulty(step.Difficulty)
+		}
+		if step.Notify {
+			c.notify(step.Clean)
+		}
+		if step.Disconnect {
+			c.disconnect()
+			return
+		}
+	}
+
+	if options.NotifyInterval <= 0 {
+		// only wait for the forced disconnection
+		wait(time.Duration(1<<63 - 1))
+		return
+	}
+	for wait(options.NotifyInterval) {
+		c.notify(false)
+	}
+}
+
+func (c *mockPoolConn) isAuthorized() bool {
+	defer c.stateLock.Unlock()
+	c.stateLock.Lock()
+	return c.authorized
+}
+
+func (c *mockPoolConn) setDifficulty(difficulty float64) {
+	var request JSONRPCRequest
+	request.Method = "mining.set_difficulty"
+	request.SetParams(difficulty)
+	c.send(&request)
+}
+
+func (c *mockPoolConn) notify(clean bool) {
+	c.stateLock.Lock()
+	if c.muted {
+		c.stateLock.Unlock()
+		return
+	}
+	c.stateLock.Unlock()
+	jobID := c.pool.newJobID()
+
+	c.stateLock.Lock()
+	if clean {
+		c.jobs = make(map[string]bool)
+	}
+	c.jobs[jobID] = true
+	c.stateLock.Unlock()
+
+	var request JSONRPCRequest
+	request.Method = "mining.notify"
+	request.SetParams(
+		jobID,
+		fmt.Sprintf("%064s", jobID),
+		"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff",
+		"ffffffff0100f2052a01000000434104",
+		JSONRPCArray{},
+		"20000000",
+		"1d00ffff",
+		Uint32ToHex(uint32(time.Now().Unix())),
+		clean)
+	c.send(&request)
+}
+
+func (c *mockPoolConn) respond(id interface{}, result interface{}, stratumErr *StratumError) {
+	var response JSONRPCResponse
+	response.ID = id
+	response.Result = result
+	response.Error = stratumErr.ToJSONRPCArray(nil)
+	bytes, err := response.ToJSONBytesLine()
+	if err == nil {
+		c.write(bytes)
+	}
+}
+
+func (c *mockPoolConn) send(request *JSONRPCRequest) {
+	bytes, err := request.ToJSONBytesLine()
+	if err == nil {
+		c.write(bytes)
+	}
+}
+
+func (c *mockPoolConn) write(bytes []byte) {
+	if latency := c.pool.Options.Latency; latency > 0 {
+		time.Sleep(latency)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.Write(bytes)
+}
+
+// disconnect Close the connection from the pool side
+func (c *mockPoolConn) disconnect() {
+	c.close(true)
+}
+
+func (c *mockPoolConn) close(byPool bool) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		if c.pool.Options.ResumeSessions {
+			c.stateLock.Lock()
+			c.pool.lock.Lock()
+			c.pool.closedSessions[c.extraNonce1] = c.jobs
+			c.pool.lock.Unlock()
+			c.stateLock.Unlock()
+		}
+		if byPool {
+			c.pool.lock.Lock()
+			c.pool.stats.Disconnects++
+			c.pool.lock.Unlock()
+		}
+	})
+}
+
+// MockPoolNetwork In-memory network of mock pools, implements Dialer for the pool connections of the agent
+type MockPoolNetwork struct {
+	lock  sync.Mutex
+	pools map[string]*MockPool
+	down  map[string]bool
+}
+
+func NewMockPoolNetwork() *MockPoolNetwork {
+	return &MockPoolNetwork{pools: make(map[string]*MockPool), down: make(map[string]bool)}
+}
+
+// Add Make the pool reachable at addr (host:port)
+func (network *MockPoolNetwork) Add(addr string, pool *MockPool) {
+	defer network.lock.Unlock()
+	network.lock.Lock()
+	network.pools[addr] = pool
+}
+
+// SetDown Refuse new connections to addr, existing connections are not affected
+func (network *MockPoolNetwork) SetDown(addr string, down bool) {
+	defer network.lock.Unlock()
+	network.lock.Lock()
+	network.down[addr] = down
+}
+
+func (network *MockPoolNetwork) Dial(_, addr string) (net.Conn, error) {
+	network.lock.Lock()
+	pool, ok := network.pools[addr]
+	down := network.down[addr]
+	network.lock.Unlock()
+
+	if !ok || down {
+		return nil, errors.New("connection refused: " + addr)
+	}
+	agentConn, poolConn := net.Pipe()
+	go pool.ServeConn(poolConn)
+	return agentConn, nil
+}
+
+// RunMockPoolCommand Subcommand "mockpool": run a mock pool on a TCP port
+func RunMockPoolCommand(args []string) int {
+	options := NewMockPoolOptions()
+
+	flags := flag.NewFlagSet("mockpool", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:3333", "Listen address")
+	versionMask := flags.String("version-mask", fmt.Sprintf("%08x", options.VersionMask), "Version rolling mask of the pool, 00000000 to refuse version rolling")
+	flags.Float64Var(&options.Difficulty, "difficulty", options.Difficulty, "Difficulty sent after authorization")
+	flags.DurationVar(&options.NotifyInterval, "notify-interval", 30*time.Second, "Interval of new jobs, 0 to only send scripted jobs")
+	scriptFile := flags.String("script", "", "JSON file with an array of steps: {\"delay_ms\", \"difficulty\", \"notify\", \"clean\", \"disconnect\"}")
+	flags.BoolVar(&options.RejectAuthorize, "reject-authorize", false, "Reject all workers")
+	flags.IntVar(&options.RejectEvery, "reject-every", 0, "Reject every Nth share of a connection, 0 to disable")
+	flags.Float64Var(&options.RejectRatio, "reject-ratio", 0, "Reject shares randomly with this probability")
+	flags.BoolVar(&options.RejectStale, "reject-stale", options.RejectStale, "Reject shares of unknown or outdated jobs")
+	flags.DurationVar(&options.Latency, "latency", 0, "Delay of every line sent by the pool")
+	flags.IntVar(&options.DisconnectAfterShares, "disconnect-after-shares", 0, "Close a connection after this number of shares, 0 to disable")
+	flags.DurationVar(&options.DisconnectAfter, "disconnect-after", 0, "Close a connection this long after authorization, 0 to disable")
+	flags.BoolVar(&options.ResumeSessions, "resume-sessions", false, "Resume a closed connection for a mining.subscribe with its extranonce1")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: btcagent mockpool [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	flag.CommandLine.Parse([]string{"-logtostderr"})
+
+	mask, err := strconv.ParseUint(*versionMask, 16, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -version-mask: %v\n", err)
+		return 2
+	}
+	options.VersionMask = uint32(mask)
+
+	if *scriptFile != "" {
+		content, err := os.ReadFile(*scriptFile)
+		if err == nil {
+			err = json.Unmarshal(content, &options.Script)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -script: %v\n", err)
+			return 2
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pool := NewMockPool(options)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		pool.Close()
+	}()
+
+	glog.Info("[mock-pool] listening on ", listener.Addr())
+	pool.Serve(listener)
+
+	stats := pool.Stats()
+	glog.Info("[mock-pool] connections: ", stats.Connections, ", authorized: ", stats.Authorizes,
+		", accepted: ", stats.Accepted, ", rejected: ", stats.Rejected, ", disconnected by pool: ", stats.Disconnects)
+	return 0
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockMiner A miner connected to the agent through an in-memory pipe
+type mockMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	lines  chan *JSONRPCLineBTC
+	worker string // full worker name of the shares
+}
+
+func newMockMiner(t *testing.T, manager *SessionManager) *mockMiner {
+	minerConn, agentConn := net.Pipe()
+	go manager.RunDownSession(agentConn)
+	return newMockMinerConn(t, minerConn)
+}
+
+// connectMockMiner Subscribe and authorize a miner of the sub-account mock, and wait for its first job
+func connectMockMiner(t *testing.T, manager *SessionManager, worker string) (miner *mockMiner, notify *JSONRPCLineBTC) {
+	t.Helper()
+	miner = newMockMiner(t, manager)
+	t.Cleanup(func() { miner.conn.Close() })
+	miner.worker = "mock." + worker
+
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(1))
+	miner.send(`{"id":2,"method":"mining.authorize","params":["` + miner.worker + `",""]}`)
+	if response := miner.expect("", float64(2)); response.Result != true {
+		t.Fatalf("authorize failed: %+v", response)
+	}
+	notify = miner.expect("mining.notify", nil)
+	return
+}
+
+// newMockMinerConn A miner on a connection to the agent made by the test, such as a TLS one
+func newMockMinerConn(t *testing.T, conn net.Conn) *mockMiner {
+	miner := &mockMiner{t, conn, make(chan *JSONRPCLineBTC, 256), "mock.worker1"}
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				close(miner.lines)
+				return
+			}
+			rpcData, err := NewJSONRPCLineBTC(line)
+			if err == nil {
+				miner.lines <- rpcData
+			}
+		}
+	}()
+	return miner
+}
+
+func (miner *mockMiner) send(line string) {
+	miner.conn.Write([]byte(line + "\n"))
+}
+
+// expect Wait for a request with the method, or a response with the ID if method is empty
+func (miner *mockMiner) expect(method string, id interface{}) *JSONRPCLineBTC {
+	miner.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case rpcData, ok := <-miner.lines:
+			if !ok {
+				miner.t.Fatalf("connection closed while waiting for %q %v", method, id)
+			}
+			if method != "" && rpcData.Method == method {
+				return rpcData
+			}
+			if method == "" && rpcData.Method == "" && rpcData.ID == id {
+				return rpcData
+			}
+		case <-timeout:
+			miner.t.Fatalf("timeout waiting for %q %v", method, id)
+		}
+	}
+}
+
+func (miner *mockMiner) submit(id int, jobID string) *JSONRPCLineBTC {
+	miner.t.Helper()
+	params, _ := json.Marshal([]string{miner.worker, jobID, "00000001", "60b5e80b", Uint32ToHex(uint32(id))})
+	request, _ := json.Marshal(map[string]interface{}{"id": id, "method": "mining.submit", "params": json.RawMessage(params)})
+	miner.send(string(request))
+	return miner.expect("", float64(id))
+}
+
+// startMockPoolAgent Run the sessions of an agent connected to the mock pools, configure may change the config before Init
+func startMockPoolAgent(t *testing.T, network *MockPoolNetwork, configure func(config *Config), hosts ...string) *SessionManager {
+	config := NewConfig()
+	config.MultiUserMode = false
+	config.AlwaysKeepDownconn = true
+	config.Pools = nil
+	for _, host := range hosts {
+		config.Pools = append(config.Pools, PoolInfo{Host: host, Port: 3333, SubAccount: "mock"})
+	}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.Advanced.PoolPing.Method = ""
+	config.Advanced.PoolNotifyTimeoutSeconds = 0
+	config.Advanced.ReconnectBackoff.MinSeconds = 0
+	config.Advanced.ReconnectBackoff.MaxSeconds = 0
+	if configure != nil {
+		configure(config)
+	}
+	config.Init()
+	config.poolDialer = network
+
+	manager := NewSessionManager(config)
+	if err := manager.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { manager.SendEvent(EventExit{}) })
+	return manager
+}
+
+func waitMockPool(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the mock pool")
+		}
+	}
+}
+
+func TestMockPoolFailover(t *testing.T) {
+	poolA := NewMockPool(NewMockPoolOptions())
+	poolB := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", poolA)
+	network.Add("pool-b:3333", poolB)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a", "pool-b")
+	waitMockPool(t, func() bool { return poolA.Stats().Authorizes > 0 })
+
+	miner, notify := connectMockMiner(t, manager, "worker1")
+	jobA := notify.Params[0].(string)
+	if !strings.HasSuffix(notify.Params[2].(string), "00000001") {
+		t.Errorf("pool extranonce1 should be appended to coinbase1: %v", notify.Params[2])
+	}
+
+	if response := miner.submit(3, jobA); response.Result != true {
+		t.Fatalf("share rejected by pool A: %+v", response)
+	}
+	if shares := poolA.Shares(); len(shares) != 1 || shares[0].JobID != jobA || shares[0].Worker != "mock.worker1" {
+		t.Fatalf("wrong shares at pool A: %+v", shares)
+	}
+
+	// pool A goes down, the miner is kept with a fake job until pool B is connected
+	network.SetDown("pool-a:3333", true)
+	poolA.DisconnectAll()
+
+	fake := miner.expect("mining.notify", nil)
+	if !strings.HasPrefix(fake.Params[0].(string), "f") {
+		t.Fatalf("expected a fake job, got %v", fake.Params[0])
+	}
+	var jobB string
+	for jobB == "" {
+		notify = miner.expect("mining.notify", nil)
+		if id := notify.Params[0].(string); !strings.HasPrefix(id, "f") {
+			jobB = id
+		}
+	}
+	if poolB.Stats().Authorizes < 1 {
+		t.Fatal("the agent should fail over to pool B")
+	}
+	if response := miner.submit(4, jobB); response.Result != true {
+		t.Fatalf("share rejected by pool B: %+v", response)
+	}
+	waitMockPool(t, func() bool { return poolB.Stats().Accepted == 1 })
+}
+
+func TestMockPoolOutageShares(t *testing.T) {
+	for _, resume := range []bool{true, false} {
+		t.Run(fmt.Sprintf("resume=%v", resume), func(t *testing.T) {
+			options := NewMockPoolOptions()
+			options.ResumeSessions = resume
+			pool := NewMockPool(options)
+			network := NewMockPoolNetwork()
+			network.Add("pool-a:3333", pool)
+
+			manager := startMockPoolAgent(t, network, func(config *Config) {
+				config.Advanced.PoolCircuitBreaker.Failures = 0
+			}, "pool-a")
+			waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+			miner, notify := connectMockMiner(t, manager, "worker1")
+			jobA := notify.Params[0].(string)
+
+			// the pool connection is lost, a late share of the last real job is answered by the agent and kept
+			network.SetDown("pool-a:3333", true)
+			pool.DisconnectAll()
+			if fake := miner.expect("mining.notify", nil); !strings.HasPrefix(fake.Params[0].(string), "f") {
+				t.Fatalf("expected a fake job, got %v", fake.Params[0])
+			}
+			replayed := metricValue(metricShareReplay, "accepted")
+			stale := metricValue(metricShareReplay, "dropped_stale")
+			if response := miner.submit(3, jobA); response.Result != true {
+				t.Fatalf("share during the outage should be accepted: %+v", response)
+			}
+
+			// the agent asks for the lost session with mining.subscribe
+			network.SetDown("pool-a:3333", false)
+			for notify = nil; notify == nil || strings.HasPrefix(notify.Params[0].(string), "f"); {
+				notify = miner.expect("mining.notify", nil)
+			}
+			if response := miner.submit(4, notify.Params[0].(string)); response.Result != true {
+				t.Fatalf("share rejected after reconnecting: %+v", response)
+			}
+
+			if resume {
+				// the same extranonce1, the kept share is still valid and replayed
+				if !strings.HasSuffix(notify.Params[2].(string), "00000001") || pool.Stats().Resumes != 1 {
+					t.Errorf("the pool session should be resumed: %v", notify.Params[2])
+				}
+				waitMockPool(t, func() bool { return pool.Stats().Accepted == 2 })
+				if shares := pool.Shares(); len(shares) != 2 || (shares[0].JobID != jobA && shares[1].JobID != jobA) {
+					t.Errorf("the share of the outage should be replayed: %+v", shares)
+				}
+				if metricValue(metricShareReplay, "accepted") == replayed {
+					t.Error("the accepted replay should be counted")
+				}
+			} else {
+				// another extranonce1 and other jobs, the kept share is dropped
+				if !strings.HasSuffix(notify.Params[2].(string), "00000002") {
+					t.Errorf("the new pool connection should have another extranonce1: %v", notify.Params[2])
+				}
+				waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+				if shares := pool.Shares(); len(shares) != 1 || shares[0].JobID == jobA {
+					t.Errorf("only the share of the new connection should reach the pool: %+v", shares)
+				}
+				if metricValue(metricShareReplay, "dropped_stale") == stale {
+					t.Error("the dropped share should be counted")
+				}
+			}
+		})
+	}
+}
+
+func TestMockPoolPolicies(t *testing.T) {
+	options := NewMockPoolOptions()
+	options.RejectEvery = 2
+	options.DisconnectAfterShares = 3
+	options.Script = []MockPoolStep{{DelayMs: 10, Difficulty: 64, Notify: true, Clean: true}}
+	pool := NewMockPool(options)
+
+	agentConn, poolConn := net.Pipe()
+	defer agentConn.Close()
+	go pool.ServeConn(poolConn)
+
+	lines := make(chan *JSONRPCLineBTC, 64)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(agentConn)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			rpcData, err := NewJSONRPCLineBTC(line)
+			if err == nil {
+				lines <- rpcData
+			}
+		}
+	}()
+	next := func() *JSONRPCLineBTC {
+		select {
+		case rpcData, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			return rpcData
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the mock pool")
+			return nil
+		}
+	}
+	send := func(line string) { agentConn.Write([]byte(line + "\n")) }
+
+	send(`{"id":"conf","method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffffffff","version-rolling.min-bit-count":2}]}`)
+	if result, _ := next().Result.(map[string]interface{}); result["version-rolling.mask"] != "1fffe000" {
+		t.Errorf("wrong version-rolling result: %v", result)
+	}
+	send(`{"id":"sub","method":"mining.subscribe","params":["test"]}`)
+	if result, _ := next().Result.([]interface{}); len(result) != 3 || result[1] != "00000001" {
+		t.Errorf("wrong subscribe result: %v", result)
+	}
+	send(`{"id":"auth","method":"mining.authorize","params":["mock.worker1",""]}`)
+	if next().Result != true {
+		t.Fatal("authorize failed")
+	}
+	if difficulty := next(); difficulty.Method != "mining.set_difficulty" || difficulty.Params[0] != float64(1) {
+		t.Fatalf("expected the initial difficulty, got %+v", difficulty)
+	}
+	first := next().Params[0].(string)
+	if difficulty := next(); difficulty.Params[0] != float64(64) {
+		t.Fatalf("expected the scripted difficulty, got %+v", difficulty)
+	}
+	second := next().Params[0].(string)
+
+	// the scripted job was clean, the first one is stale
+	send(`{"id":1,"method":"mining.submit","params":["mock.worker1","` + first + `","00000001","60b5e80b","00000001"]}`)
+	if response := next(); mockPoolErrorCode(response) != 21 {
+		t.Errorf("stale share should be rejected: %+v", response)
+	}
+	send(`{"id":2,"method":"mining.submit","params":["mock.worker1","` + second + `","00000001","60b5e80b","00000002"]}`)
+	if response := next(); mockPoolErrorCode(response) != 23 {
+		t.Errorf("every second share should be rejected: %+v", response)
+	}
+	send(`{"id":3,"method":"mining.submit","params":["mock.worker1","` + second + `","00000001","60b5e80b","00000003"]}`)
+	if response := next(); response.Result != true {
+		t.Errorf("share should be accepted: %+v", response)
+	}
+	if next() != nil {
+		t.Error("the pool should disconnect after 3 shares")
+	}
+	if stats := pool.Stats(); stats.Accepted != 1 || stats.Rejected != 2 || stats.Disconnects != 1 {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+}
+
+func mockPoolErrorCode(response *JSONRPCLineBTC) float64 {
+	if errData, ok := response.Error.([]interface{}); ok && len(errData) > 0 {
+		code, _ := errData[0].(float64)
+		return code
+	}
+	return 0
+}
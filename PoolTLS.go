@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// PoolTLSOptions Per-pool TLS settings, the optional 4th item of a pool entry
+type PoolTLSOptions struct {
+	// PEM bundle used to verify the pool certificate instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// Base64 SHA-256 hashes of the SubjectPublicKeyInfo, with or without the "sha256/" prefix
+	Pins []string `json:"pins,omitempty"`
+	// Client certificate and key for pools that require mTLS
+	ClientCertFile string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string `json:"client_key_file,omitempty"`
+	// "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `json:"min_version,omitempty"`
+	// Override the server name used for SNI and verification
+	ServerName string `json:"server_name,omitempty"`
+}
+
+func (opts *PoolTLSOptions) IsEmpty() bool {
+	return len(opts.CAFile) < 1 && len(opts.Pins) < 1 && len(opts.ClientCertFile) < 1 &&
+		len(opts.ClientKeyFile) < 1 && len(opts.MinVersion) < 1 && len(opts.ServerName) < 1
+}
+
+var (
+	// ErrTLSPinMismatch None of the pool certificates match the configured pins
+	ErrTLSPinMismatch = errors.New("certificate public key does not match any configured pin")
+)
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version '%s'", version)
+}
+
+func parseSPKIPins(pins []string) (hashes [][]byte, err error) {
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		hash, e := base64.StdEncoding.DecodeString(pin)
+		if e != nil || len(hash) != sha256.Size {
+			err = fmt.Errorf("invalid SPKI pin '%s', should be base64 of a SHA-256 hash", pin)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+	return
+}
+
+// NewPoolTLSConfig Build the tls.Config template for a pool. Files are loaded here, once.
+func NewPoolTLSConfig(opts *PoolTLSOptions, insecureSkipVerify bool) (config *tls.Config, err error) {
+	config = new(tls.Config)
+	config.ServerName = opts.ServerName
+	config.InsecureSkipVerify = insecureSkipVerify
+
+	config.MinVersion, err = parseTLSVersion(opts.MinVersion)
+	if err != nil {
+		return
+	}
+
+	if len(opts.CAFile) > 0 {
+		pemBytes, e := ioutil.ReadFile(opts.CAFile)
+		if e != nil {
+			err = e
+			return
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemBytes) {
+			err = fmt.Errorf("no certificate found in %s", opts.CAFile)
+			return
+		}
+		// a custom CA means the operator wants verification
+		config.InsecureSkipVerify = false
+	}
+
+	if len(opts.ClientCertFile) > 0 || len(opts.ClientKeyFile) > 0 {
+		cert, e := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if e != nil {
+			err = e
+			return
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) > 0 {
+		hashes, e := parseSPKIPins(opts.Pins)
+		if e != nil {
+			err = e
+			return
+		}
+		// Pins are checked even if the chain verification is skipped,
+		// so a self-signed pool certificate can still be trusted safely.
+		// Without a verified chain, the other certificates sent by the pool prove nothing,
+		// so only the pool's own certificate may match a pin.
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			if len(verifiedChains) > 0 {
+				for _, chain := range verifiedChains {
+					certs = append(certs, chain...)
+				}
+			} else if len(rawCerts) > 0 {
+				cert, e := x509.ParseCertificate(rawCerts[0])
+				if e != nil {
+					return e
+				}
+				certs = append(certs, cert)
+			}
+			for _, cert := range certs {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, hash := range hashes {
+					if string(sum[:]) == string(hash) {
+						return nil
+					}
+				}
+			}
+			return ErrTLSPinMismatch
+		}
+	}
+	return
+}
+
+// IsTLSVerifyError Whether the error is caused by the pool certificate rather than the network
+func IsTLSVerifyError(err error) bool {
+	if errors.Is(err, ErrTLSPinMismatch) {
+		return true
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// RedirectTLSConfig The TLS config for a host the pool sent the agent to with client.reconnect.
+// server_name belongs to the configured host, so the redirected host is checked by its own name.
+// The CA bundle, pins and client certificate are kept, a redirection cannot weaken the verification.
+func RedirectTLSConfig(template *tls.Config, host string) *tls.Config {
+	config := template.Clone()
+	config.ServerName = host
+	return config
+}
+
+// PoolTLSHandshake Wrap the connection with TLS and complete the handshake within the timeout
+func PoolTLSHandshake(conn net.Conn, template *tls.Config, serverName string, timeout time.Duration) (tlsConn *tls.Conn, err error) {
+	config := template.Clone()
+	if len(config.ServerName) < 1 {
+		config.ServerName = serverName
+	}
+	tlsConn = tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	return
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tlsCert tls.Certificate
+}
+
+// newTestCert Create a certificate for the DNS names, signed by parent or self-signed if parent is nil
+func newTestCert(t *testing.T, commonName string, isCA bool, parent *testCert, dnsNames ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err.Error())
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              dnsNames,
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate failed: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}
+}
+
+// pin The SPKI pin of the certificate
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeFiles Write the certificate and key as PEM files into dir
+func (c *testCert) writeFiles(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshal key failed: %s", err.Error())
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+// poolTLSHandshake Run a handshake of the pool config against a server sending the certificate chain
+func poolTLSHandshake(t *testing.T, config *tls.Config, serverName string, chain ...*testCert) error {
+	serverCert := chain[0].tlsCert
+	for _, c := range chain[1:] {
+		serverCert.Certificate = append(serverCert.Certificate, c.cert.Raw)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err.Error())
+	}
+	defer conn.Close()
+	_, err = PoolTLSHandshake(conn, config, serverName, 5*time.Second)
+	return err
+}
+
+func TestPoolTLSVerifyByDefault(t *testing.T) {
+	skipVerify := NewConfig().Advanced.TLSSkipCertificateVerify
+	if skipVerify {
+		t.Fatal("the pool certificate should be verified by default")
+	}
+
+	pool := newTestCert(t, "pool", false, nil, "pool.example.com")
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{}, skipVerify)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if err := poolTLSHandshake(t, config, "pool.example.com", pool); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with an unknown self-signed certificate got %v, expected a verification error", err)
+	}
+
+	// skipping the verification is an explicit opt-in
+	config, err = NewPoolTLSConfig(&PoolTLSOptions{}, true)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if err := poolTLSHandshake(t, config, "pool.example.com", pool); err != nil {
+		t.Errorf("handshake with verification skipped failed: %s", err.Error())
+	}
+}
+
+func TestPoolTLSPinOnly(t *testing.T) {
+	pool := newTestCert(t, "pool", false, nil, "pool.example.com")
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{Pins: []string{pool.pin()}}, true)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if err := poolTLSHandshake(t, config, "pool.example.com", pool); err != nil {
+		t.Errorf("handshake with the pinned self-signed certificate failed: %s", err.Error())
+	}
+
+	other := newTestCert(t, "other", false, nil, "pool.example.com")
+	if err := poolTLSHandshake(t, config, "pool.example.com", other); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with another certificate got %v, expected a pin mismatch", err)
+	}
+}
+
+func TestPoolTLSPinIgnoresUnverifiedChain(t *testing.T) {
+	pool := newTestCert(t, "pool", false, nil, "pool.example.com")
+	attacker := newTestCert(t, "attacker", false, nil, "pool.example.com")
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{Pins: []string{pool.pin()}}, true)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+
+	// the real pool certificate appended after the attacker's own one must not satisfy the pin
+	err = config.VerifyPeerCertificate([][]byte{attacker.cert.Raw, pool.cert.Raw}, nil)
+	if !errors.Is(err, ErrTLSPinMismatch) {
+		t.Errorf("VerifyPeerCertificate got %v, expected ErrTLSPinMismatch", err)
+	}
+	if err := poolTLSHandshake(t, config, "pool.example.com", attacker, pool); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with the attacker's chain got %v, expected a pin mismatch", err)
+	}
+}
+
+func TestPoolTLSCAAndPinnedCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	pool := newTestCert(t, "pool", false, ca, "pool.example.com")
+
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{CAFile: caFile, Pins: []string{ca.pin()}}, true)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if config.InsecureSkipVerify {
+		t.Error("a CA bundle should turn on the chain verification")
+	}
+	// the pin of a CA in the verified chain is accepted
+	if err := poolTLSHandshake(t, config, "pool.example.com", pool); err != nil {
+		t.Errorf("handshake with a pinned CA failed: %s", err.Error())
+	}
+	// the chain is verified against the host name
+	if err := poolTLSHandshake(t, config, "other.example.com", pool); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with a wrong host name got %v, expected a verify error", err)
+	}
+
+	// a certificate of another CA is refused before the pins are checked
+	otherCA := newTestCert(t, "other ca", true, nil)
+	other := newTestCert(t, "pool", false, otherCA, "pool.example.com")
+	if err := poolTLSHandshake(t, config, "pool.example.com", other, otherCA); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with an unknown CA got %v, expected a verify error", err)
+	}
+}
+
+func TestPoolTLSServerNameOverride(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	pool := newTestCert(t, "pool", false, ca, "stratum.example.com")
+
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{CAFile: caFile, ServerName: "stratum.example.com"}, false)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if err := poolTLSHandshake(t, config, "10.0.0.1", pool); err != nil {
+		t.Errorf("handshake with server_name failed: %s", err.Error())
+	}
+}
+
+func TestPoolTLSOptionErrors(t *testing.T) {
+	cases := []PoolTLSOptions{
+		{Pins: []string{"sha256/not-base64"}},
+		{Pins: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+		{MinVersion: "1.4"},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{ClientCertFile: "only-cert.pem"},
+	}
+	for _, opts := range cases {
+		opts := opts
+		if _, err := NewPoolTLSConfig(&opts, false); err == nil {
+			t.Errorf("NewPoolTLSConfig(%+v) did not fail", opts)
+		}
+	}
+}
+
+func TestRedirectTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	redirected := newTestCert(t, "pool", false, ca, "backup.example.com")
+
+	config, err := NewPoolTLSConfig(&PoolTLSOptions{CAFile: caFile, ServerName: "stratum.example.com"}, false)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	// server_name of the configured pool would be checked against the redirected host
+	if err := poolTLSHandshake(t, config, "backup.example.com", redirected); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with the configured server_name got %v, expected a verify error", err)
+	}
+	if err := poolTLSHandshake(t, RedirectTLSConfig(config, "backup.example.com"), "backup.example.com", redirected); err != nil {
+		t.Errorf("handshake with the redirected host failed: %s", err.Error())
+	}
+	if config.ServerName != "stratum.example.com" {
+		t.Error("the template of the configured pool should not be changed")
+	}
+
+	// the pins of the configured pool still apply
+	pinned, err := NewPoolTLSConfig(&PoolTLSOptions{CAFile: caFile, Pins: []string{newTestCert(t, "other", false, nil).pin()}}, false)
+	if err != nil {
+		t.Fatalf("NewPoolTLSConfig failed: %s", err.Error())
+	}
+	if err := poolTLSHandshake(t, RedirectTLSConfig(pinned, "backup.example.com"), "backup.example.com", redirected); !IsTLSVerifyError(err) {
+		t.Errorf("handshake with an unpinned redirected host got %v, expected a pin mismatch", err)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/btccom/connectproxy"
-	"golang.org/x/net/proxy"
 )
 
 type Dialer interface {
@@ -56,30 +55,36 @@ func RegularProxyURL(url string) string {
 	switch protocol {
 	case "":
 		protocol = "http"
-	case "socks4":
-		fallthrough
-	case "socks4a":
-		fallthrough
-	case "socks5":
-		protocol = "socks"
+	case "socks":
+		// Unspecified socks version, SOCKS5 with remote DNS
+		protocol = "socks5h"
 	}
 	return fmt.Sprintf("%s://%s", protocol, address)
 }
 
-func GetProxyDialer(proxyURL string, timeout time.Duration, insecureSkipVerify bool) (dailer Dialer, err error) {
+// GetProxyDialer socks5:// lets the proxy resolve the pool host unless localDNS is set, socks5h:// always does.
+// keepAlive is the TCP keepalive period of the connection to the proxy, 0 to disable.
+func GetProxyDialer(proxyURL string, timeout time.Duration, keepAlive time.Duration, insecureSkipVerify bool, localDNS bool, resolver *Resolver) (dailer Dialer, err error) {
 	proxyURL = RegularProxyURL(proxyURL)
 	u, err := url.Parse(proxyURL)
 	if err != nil {
 		return
 	}
 
-	if u.Scheme == "socks" {
-		var auth proxy.Auth
-		auth.User = u.User.Username()
-		auth.Password, _ = u.User.Password()
-		dailer, err = proxy.SOCKS5("tcp", u.Host, &auth, &net.Dialer{
-			Timeout: timeout,
-		})
+	switch u.Scheme {
+	case "socks4", "socks4a", "socks5", "socks5h":
+		// socks4 resolves the pool host locally, socks4a and socks5h let the proxy resolve it
+		protocol := u.Scheme
+		if protocol == "socks5" && !localDNS {
+			protocol = "socks5h"
+		}
+		password, _ := u.User.Password()
+		socksDialer := NewSocksDialer(protocol, u.Host, u.User.Username(), password, timeout)
+		socksDialer.Forward.KeepAlive = DialerKeepAlive(keepAlive)
+		if resolver != nil {
+			socksDialer.Resolver = resolver.LookupIP
+		}
+		dailer = socksDialer
 		return
 	}
 
@@ -87,7 +92,8 @@ func GetProxyDialer(proxyURL string, timeout time.Duration, insecureSkipVerify b
 		dailer, err = connectproxy.NewWithConfig(
 			u,
 			&net.Dialer{
-				Timeout: timeout,
+				Timeout:   timeout,
+				KeepAlive: DialerKeepAlive(keepAlive),
 			},
 			&connectproxy.Config{
 				InsecureSkipVerify: insecureSkipVerify,
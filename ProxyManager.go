@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// ProxySelectionFastest Healthy proxies first, ordered by round-trip time
+	ProxySelectionFastest = "fastest"
+	// ProxySelectionOrdered Healthy proxies first, in the order of the config file
+	ProxySelectionOrdered = "ordered"
+)
+
+// ProxyStatus Health and latency statistics of a proxy
+type ProxyStatus struct {
+	URL                 string        `json:"url"`
+	Healthy             bool          `json:"healthy"`
+	RTT                 time.Duration `json:"rtt_ns"`
+	Successes           uint64        `json:"successes"`
+	Failures            uint64        `json:"failures"`
+	ConsecutiveFailures uint64        `json:"consecutive_failures"`
+	LastCheck           time.Time     `json:"last_check"`
+	LastError           string        `json:"last_error,omitempty"`
+
+	index int // position in the config file
+}
+
+// ProxyManager Thread safe proxy health checker and selector
+type ProxyManager struct {
+	lock    sync.Mutex
+	config  *Config
+	proxies []*ProxyStatus
+	byURL   map[string]*ProxyStatus
+}
+
+func NewProxyManager(config *Config) (manager *ProxyManager) {
+	manager = new(ProxyManager)
+	manager.config = config
+	manager.byURL = make(map[string]*ProxyStatus)
+
+	for i, url := range config.Proxy {
+		if _, ok := manager.byURL[url]; ok {
+			continue
+		}
+		// Unchecked proxies are treated as healthy until proven otherwise
+		status := &ProxyStatus{URL: url, Healthy: true, index: i}
+		manager.proxies = append(manager.proxies, status)
+		manager.byURL[url] = status
+	}
+	return
+}
+
+// Run Check all proxies periodically in the background
+func (manager *ProxyManager) Run() {
+	interval := manager.config.Advanced.ProxyHealthCheckIntervalSeconds.Get()
+	if len(manager.proxies) < 1 || interval <= 0 || len(manager.config.Pools) < 1 {
+		return
+	}
+
+	for {
+		manager.checkAll()
+		time.Sleep(interval)
+	}
+}
+
+func (manager *ProxyManager) checkAll() {
+	// The first pool is used as the check target, so the proxy is checked with the route we really use
+	pool := manager.config.Pools[0]
+	target := fmt.Sprintf("%s:%d", pool.Host, pool.Port)
+	timeout := manager.config.Advanced.PoolConnectionDialTimeoutSeconds.Get()
+
+	var wg sync.WaitGroup
+	for _, status := range manager.proxies {
+		wg.Add(1)
+		go func(proxyURL string) {
+			defer wg.Done()
+			rtt, err := manager.check(proxyURL, target, timeout)
+			manager.Report(proxyURL, rtt, err)
+		}(status.URL)
+	}
+	wg.Wait()
+}
+
+func (manager *ProxyManager) check(proxyURL, target string, timeout time.Duration) (rtt time.Duration, err error) {
+	dialer, err := GetProxyDialer(proxyURL, timeout, manager.config.Advanced.PoolTCPKeepAliveSeconds.Get(), manager.config.Advanced.TLSSkipCertificateVerify, manager.config.ProxyLocalDNS, manager.config.resolver)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	rtt = time.Since(start)
+	conn.Close()
+	return
+}
+
+// Report Record the result of a connection attempt through the proxy
+func (manager *ProxyManager) Report(proxyURL string, rtt time.Duration, err error) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	status, ok := manager.byURL[proxyURL]
+	if !ok {
+		return
+	}
+	status.LastCheck = time.Now()
+
+	if err != nil {
+		status.Failures++
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+		if status.Healthy && status.ConsecutiveFailures >= uint64(manager.config.Advanced.ProxyMaxConsecutiveFailures) {
+			status.Healthy = false
+			glog.Warning("[proxy] ", proxyURL, " marked as unhealthy after ", status.ConsecutiveFailures, " failures: ", status.LastError)
+		}
+		return
+	}
+
+	status.Successes++
+	status.ConsecutiveFailures = 0
+	status.LastError = ""
+	if status.RTT == 0 {
+		status.RTT = rtt
+	} else {
+		// exponential moving average, smooth out a single slow connection
+		status.RTT = (status.RTT*3 + rtt) / 4
+	}
+	if !status.Healthy {
+		status.Healthy = true
+		glog.Info("[proxy] ", proxyURL, " is healthy again, rtt: ", rtt)
+	}
+}
+
+// Candidates Proxies in the order they should be tried
+func (manager *ProxyManager) Candidates() (urls []string) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	sorted := make([]*ProxyStatus, len(manager.proxies))
+	copy(sorted, manager.proxies)
+
+	fastest := manager.config.ProxySelection != ProxySelectionOrdered
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		if fastest && a.RTT != b.RTT {
+			// proxies without RTT samples go after the measured ones
+			if a.RTT == 0 || b.RTT == 0 {
+				return b.RTT == 0
+			}
+			return a.RTT < b.RTT
+		}
+		return a.index < b.index
+	})
+
+	for _, status := range sorted {
+		urls = append(urls, status.URL)
+	}
+	return
+}
+
+// Status Snapshot of all proxy statistics
+func (manager *ProxyManager) Status() (list []ProxyStatus) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	for _, status := range manager.proxies {
+		list = append(list, *status)
+	}
+	return
+}
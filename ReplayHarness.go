@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayPoolStub In-memory pool of the replay harness. It answers the handshake of the agent
+// (mining.configure, mining.subscribe and mining.authorize) and passes all other lines to the harness.
+type ReplayPoolStub struct {
+	subscribeResult interface{}
+
+	lock       sync.Mutex
+	conn       net.Conn // pool end of the current connection
+	authorized chan bool
+	lines      chan string
+}
+
+// NewReplayPoolStub subscribeResult is sent as the result of mining.subscribe, nil for a default one
+func NewReplayPoolStub(subscribeResult interface{}) (stub *ReplayPoolStub) {
+	stub = new(ReplayPoolStub)
+	stub.subscribeResult = subscribeResult
+	if stub.subscribeResult == nil {
+		stub.subscribeResult = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", "01"}, JSONRPCArray{"mining.notify", "01"}}, "00000001", 4}
+	}
+	stub.authorized = make(chan bool, 1)
+	stub.lines = make(chan string, 256)
+	return
+}
+
+// Dial Implement Dialer, the agent gets one end of an in-memory pipe
+func (stub *ReplayPoolStub) Dial(network, addr string) (net.Conn, error) {
+	agentConn, poolConn := net.Pipe()
+
+	stub.lock.Lock()
+	stub.conn = poolConn
+	stub.lock.Unlock()
+
+	go stub.serve(poolConn)
+	return agentConn, nil
+}
+
+func (stub *ReplayPoolStub) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		rpcData, err := NewJSONRPCLineBTC(line)
+		if err == nil && isReplayHandshakeMethod(rpcData.Method) {
+			stub.answerHandshake(conn, rpcData)
+			continue
+		}
+		stub.lines <- string(line)
+	}
+}
+
+func (stub *ReplayPoolStub) answerHandshake(conn net.Conn, request *JSONRPCLineBTC) {
+	var response JSONRPCResponse
+	response.ID = request.ID
+
+	switch request.Method {
+	case "mining.configure":
+		response.Result = JSONRPCObj{"version-rolling": true, "version-rolling.mask": "1fffe000"}
+	case "mining.subscribe":
+		response.Result = stub.subscribeResult
+	case "mining.authorize":
+		response.Result = true
+	}
+	bytes, err := response.ToJSONBytesLine()
+	if err != nil {
+		return
+	}
+	conn.Write(bytes)
+
+	if request.Method == "mining.authorize" {
+		select {
+		case stub.authorized <- true:
+		default:
+		}
+	}
+}
+
+// Write Send a line to the agent
+func (stub *ReplayPoolStub) Write(line string) error {
+	stub.lock.Lock()
+	conn := stub.conn
+	stub.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("the agent is not connected to the pool stub")
+	}
+	_, err := conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// Close Close the current connection
+func (stub *ReplayPoolStub) Close() {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	if stub.conn != nil {
+		stub.conn.Close()
+	}
+}
+
+func isReplayHandshakeMethod(method string) bool {
+	return method == "mining.configure" || method == "mining.subscribe" || method == "mining.authorize"
+}
+
+// isReplayHandshakeRecord Pool lines of the agent's handshake, they are answered by the stub instead
+func isReplayHandshakeRecord(record *TraceRecord) bool {
+	rpcData, err := NewJSONRPCLineBTC([]byte(record.Line))
+	if err != nil {
+		return false
+	}
+	if record.Direction == TraceDirectionOut {
+		return isReplayHandshakeMethod(rpcData.Method)
+	}
+	return len(rpcData.Method) < 1 && (rpcData.ID == "conf" || rpcData.ID == "sub" || rpcData.ID == "auth")
+}
+
+// ReplayMismatch The agent did not emit an expected line of the transcript
+type ReplayMismatch struct {
+	Index  int // index of the record in the transcript
+	Record *TraceRecord
+	Got    string // empty if nothing was emitted in time
+}
+
+func (mismatch *ReplayMismatch) Error() string {
+	if len(mismatch.Got) < 1 {
+		return fmt.Sprintf("record %d: timeout, expected %s line of session %d: %s",
+			mismatch.Index, mismatch.Record.Link, mismatch.Record.SessionID, mismatch.Record.Line)
+	}
+	return fmt.Sprintf("record %d: %s line of session %d mismatch\nexpected: %s\n     got: %s",
+		mismatch.Index, mismatch.Record.Link, mismatch.Record.SessionID, mismatch.Record.Line, strings.TrimRight(mismatch.Got, "\r\n"))
+}
+
+// ReplayHarness Feed a transcript (a protocol trace, see TraceRecord) through the miner and pool sessions of the agent,
+// against an in-memory pool stub. Lines received by the agent in the transcript are sent to it, and the lines it emits
+// must match the lines it sent in the transcript. IDs of requests to the pool are not compared, as they depend on the
+// agent's state, the pool's responses are sent with the IDs the agent used.
+//
+// The pool handshake is answered by the stub. Pool state lines recorded when the first traced miner joined its pool
+// connection (the subscribe response, difficulty, version mask and the last job) are sent before the transcript starts.
+type ReplayHarness struct {
+	Config  *Config       // Options of the agent, pools, proxies and listening options are replaced
+	Timeout time.Duration // How long to wait for each line the agent should emit
+	Settle  time.Duration // Pause after each line sent to the agent, so that it is handled before the next one
+
+	stub   *ReplayPoolStub
+	miners map[uint16]*replayMiner
+	ids    map[string]interface{} // request ID in the transcript => request ID sent by the agent
+}
+
+type replayMiner struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func NewReplayHarness(config *Config) (harness *ReplayHarness) {
+	harness = new(ReplayHarness)
+	harness.Config = config
+	harness.Timeout = 5 * time.Second
+	harness.Settle = 20 * time.Millisecond
+	return
+}
+
+func (harness *ReplayHarness) initConfig() {
+	config := harness.Config
+	config.MultiUserMode = false
+	config.AlwaysKeepDownconn = false
+	config.PoolUseTls = false
+	config.UseProxy = false
+	config.Proxy = nil
+	config.DirectConnectWithProxy = false
+	config.AgentListenTLS.Enable = false
+	config.AdminAPI.Enable = false
+	config.ShareJournal.Enable = false
+	config.WorkerMonitor.Enable = false
+	config.EventSinks = nil
+	config.Pools = []PoolInfo{{Host: "replay.pool", Port: 3333, SubAccount: "replay"}}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.Advanced.PoolPing.Method = ""
+	config.Advanced.PoolNotifyTimeoutSeconds = 0
+	config.Init()
+	config.poolDialer = harness.stub
+}
+
+// Run Replay the transcript, return a *ReplayMismatch at the first line the agent did not emit as expected
+func (harness *ReplayHarness) Run(records []*TraceRecord) (err error) {
+	var subscribeResult interface{}
+	var state []*TraceRecord
+	for _, record := range records {
+		if record.Link != TraceLinkPool || record.Direction != TraceDirectionIn {
+			continue
+		}
+		rpcData, err := NewJSONRPCLineBTC([]byte(record.Line))
+		if err == nil && subscribeResult == nil && len(rpcData.Method) < 1 && rpcData.ID == "sub" {
+			subscribeResult = rpcData.Result
+		}
+		// only the state of the first join, the agent keeps its own state after that
+		if record.State && (len(state) < 1 || record.Time.Equal(state[0].Time) && record.SessionID == state[0].SessionID) {
+			state = append(state, record)
+		}
+	}
+
+	harness.stub = NewReplayPoolStub(subscribeResult)
+	harness.miners = make(map[uint16]*replayMiner)
+	harness.ids = make(map[string]interface{})
+	harness.initConfig()
+
+	manager := NewSessionManager(harness.Config)
+	err = manager.start()
+	if err != nil {
+		return
+	}
+	defer harness.stop(manager)
+
+	select {
+	case <-harness.stub.authorized:
+	case <-time.After(harness.Timeout):
+		return errors.New("the agent did not connect to the pool stub")
+	}
+	// the pool connection is ready after the handshake
+	time.Sleep(harness.Settle)
+
+	for _, record := range state {
+		if isReplayHandshakeRecord(record) {
+			continue
+		}
+		err = harness.stub.Write(record.Line)
+		if err != nil {
+			return
+		}
+		time.Sleep(harness.Settle)
+	}
+
+	for i, record := range records {
+		if record.State || record.Link == TraceLinkPool && isReplayHandshakeRecord(record) {
+			continue
+		}
+		err = harness.step(manager, i, record)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (harness *ReplayHarness) step(manager *SessionManager, index int, record *TraceRecord) (err error) {
+	switch {
+	case record.Link == TraceLinkMiner && record.Direction == TraceDirectionIn:
+		miner, err := harness.miner(manager, record.SessionID)
+		if err != nil {
+			return err
+		}
+		_, err = miner.conn.Write([]byte(record.Line + "\n"))
+		if err != nil {
+			return fmt.Errorf("record %d: failed to send the line of session %d: %v", index, record.SessionID, err)
+		}
+		time.Sleep(harness.Settle)
+
+	case record.Link == TraceLinkPool && record.Direction == TraceDirectionIn:
+		err = harness.stub.Write(harness.mapResponseID(record.Line))
+		if err != nil {
+			return fmt.Errorf("record %d: failed to send the pool line: %v", index, err)
+		}
+		time.Sleep(harness.Settle)
+
+	case record.Link == TraceLinkMiner && record.Direction == TraceDirectionOut:
+		miner, ok := harness.miners[record.SessionID]
+		if !ok {
+			return &ReplayMismatch{Index: index, Record: record}
+		}
+		got, ok := harness.receive(miner.lines)
+		if !ok || !replayLinesMatch(record.Line, got, nil) {
+			return &ReplayMismatch{index, record, got}
+		}
+
+	case record.Link == TraceLinkPool && record.Direction == TraceDirectionOut:
+		got, ok := harness.receive(harness.stub.lines)
+		if !ok || !replayLinesMatch(record.Line, got, harness.ids) {
+			return &ReplayMismatch{index, record, got}
+		}
+
+	default:
+		return fmt.Errorf("record %d: unknown link %s or direction %s", index, record.Link, record.Direction)
+	}
+	return
+}
+
+// miner The connection of a miner in the transcript, connected with the same session ID on its first line
+func (harness *ReplayHarness) miner(manager *SessionManager, sessionID uint16) (miner *replayMiner, err error) {
+	miner, ok := harness.miners[sessionID]
+	if ok {
+		return
+	}
+
+	id, err := manager.sessionIDManager.AllocSessionIDFrom(sessionID)
+	if err != nil {
+		return
+	}
+	if id != sessionID {
+		manager.sessionIDManager.FreeSessionID(id)
+		return nil, fmt.Errorf("session id %d is in use", sessionID)
+	}
+
+	minerConn, agentConn := net.Pipe()
+	miner = &replayMiner{minerConn, make(chan string, 256)}
+	harness.miners[sessionID] = miner
+
+	go func() {
+		reader := bufio.NewReader(minerConn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			miner.lines <- line
+		}
+	}()
+	go manager.runDownSession(agentConn, id)
+	return
+}
+
+func (harness *ReplayHarness) receive(lines chan string) (line string, ok bool) {
+	select {
+	case line = <-lines:
+		return line, true
+	case <-time.After(harness.Timeout):
+		return "", false
+	}
+}
+
+// mapResponseID Replace the ID of a pool response with the ID of the request the agent sent
+func (harness *ReplayHarness) mapResponseID(line string) string {
+	var object map[string]interface{}
+	if json.Unmarshal([]byte(line), &object) != nil {
+		return line
+	}
+	if _, isRequest := object["method"]; isRequest {
+		return line
+	}
+	id, ok := harness.ids[fmt.Sprint(object["id"])]
+	if !ok {
+		return line
+	}
+	object["id"] = id
+	bytes, err := json.Marshal(object)
+	if err != nil {
+		return line
+	}
+	return string(bytes)
+}
+
+func (harness *ReplayHarness) stop(manager *SessionManager) {
+	for _, miner := range harness.miners {
+		miner.conn.Close()
+	}
+	harness.stub.Close()
+	manager.SendEvent(EventExit{})
+}
+
+// replayLinesMatch Compare an expected line with a line the agent emitted, as JSON if both are valid JSON.
+// If ids is not nil, the request IDs are not compared but remembered in ids.
+func replayLinesMatch(expected string, got string, ids map[string]interface{}) bool {
+	expected = strings.TrimRight(expected, "\r\n")
+	got = strings.TrimRight(got, "\r\n")
+	if expected == got {
+		return true
+	}
+
+	var expectedObject, gotObject map[string]interface{}
+	if json.Unmarshal([]byte(expected), &expectedObject) != nil || json.Unmarshal([]byte(got), &gotObject) != nil {
+		return false
+	}
+	if ids != nil {
+		expectedID, gotID := expectedObject["id"], gotObject["id"]
+		delete(expectedObject, "id")
+		delete(gotObject, "id")
+		if !reflect.DeepEqual(expectedObject, gotObject) {
+			return false
+		}
+		ids[fmt.Sprint(expectedID)] = gotID
+		return true
+	}
+	return reflect.DeepEqual(expectedObject, gotObject)
+}
+
+// RunReplayCommand Subcommand "replay": replay transcripts through the agent and check its output
+func RunReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("c", "", "Config file of the agent, the default options are used if empty")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for each line the agent should emit")
+	settle := flags.Duration("settle", 20*time.Millisecond, "Pause after each line sent to the agent")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: btcagent replay [options] <transcript>...")
+		fmt.Fprintln(flags.Output(), "Transcripts are protocol trace files, see \"btcagent trace\".")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	// glog writes to its default log files, only the results are printed
+	flag.CommandLine.Parse(nil)
+
+	failed := 0
+	for _, name := range flags.Args() {
+		config := NewConfig()
+		if *configFile != "" {
+			err := config.LoadFromFile(*configFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+				return 1
+			}
+		}
+
+		err := replayTranscriptFile(name, config, *timeout, *settle)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("PASS %s\n", name)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func replayTranscriptFile(name string, config *Config, timeout time.Duration, settle time.Duration) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	records, badLines, err := ReadTraceRecords(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if badLines > 0 {
+		return fmt.Errorf("%d malformed lines", badLines)
+	}
+
+	harness := NewReplayHarness(config)
+	harness.Timeout = timeout
+	harness.Settle = settle
+	return harness.Run(records)
+}
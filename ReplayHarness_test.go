@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replayTranscript Replay a transcript file through the agent, fail the test on the first unexpected line.
+// Field captures of "btcagent trace" can be added to testdata/replay as regression tests.
+func replayTranscript(t *testing.T, path string) {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, badLines, err := ReadTraceRecords(file)
+	file.Close()
+	if err != nil || badLines > 0 {
+		t.Fatalf("%s: %d malformed lines, %v", path, badLines, err)
+	}
+
+	err = NewReplayHarness(NewConfig()).Run(records)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func TestReplayTranscripts(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "replay", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 1 {
+		t.Fatal("no transcripts in testdata/replay")
+	}
+	for _, path := range files {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			replayTranscript(t, path)
+		})
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "replay", "subscribe_authorize_submit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := ReadTraceRecords(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the agent does not answer the authorize request with false
+	records[3].Line = strings.Replace(records[3].Line, "true", "false", 1)
+
+	err = NewReplayHarness(NewConfig()).Run(records)
+	mismatch, ok := err.(*ReplayMismatch)
+	if !ok || mismatch.Index != 3 || !strings.Contains(mismatch.Got, "true") {
+		t.Fatalf("expected mismatch at record 3, got %v", err)
+	}
+}
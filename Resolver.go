@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type resolverCacheItem struct {
+	ips     []net.IP
+	expires time.Time
+	// error of the last lookup, nil if it succeeded
+	err error
+	// closed when the running lookup finishes
+	pending chan struct{}
+}
+
+// Resolver DNS resolver with cache for pool hosts.
+// The last known good addresses are kept and used when DNS lookups fail.
+type Resolver struct {
+	lock  sync.Mutex
+	cache map[string]*resolverCacheItem
+
+	ttl           time.Duration
+	lookupTimeout time.Duration
+	resolver      *net.Resolver
+	lookup        func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// NewResolver Create a resolver. If servers is empty, the system resolver is used.
+// A server is "ip:port" or "ip" (port 53), e.g. a local DNS-over-HTTPS stub at "127.0.0.1:5053".
+func NewResolver(servers []string, ttl time.Duration, lookupTimeout time.Duration) (r *Resolver) {
+	r = new(Resolver)
+	r.cache = make(map[string]*resolverCacheItem)
+	r.ttl = ttl
+	r.lookupTimeout = lookupTimeout
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		return r.resolver.LookupIP(ctx, "ip", host)
+	}
+
+	if len(servers) < 1 {
+		r.resolver = net.DefaultResolver
+		return
+	}
+
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+
+	var next uint32
+	var nextLock sync.Mutex
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		// Servers are used in turn, so a dead server only fails part of the lookups
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			nextLock.Lock()
+			server := addrs[next%uint32(len(addrs))]
+			next++
+			nextLock.Unlock()
+
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	return
+}
+
+// LookupIP Resolve the host, using the cache if possible
+func (r *Resolver) LookupIP(host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	r.lock.Lock()
+	item, ok := r.cache[host]
+	if !ok {
+		item = new(resolverCacheItem)
+		r.cache[host] = item
+	}
+	waited := false
+	for item.pending != nil {
+		// another goroutine is resolving the same host, wait for it
+		pending := item.pending
+		r.lock.Unlock()
+		<-pending
+		r.lock.Lock()
+		waited = true
+	}
+	if len(item.ips) > 0 && time.Now().Before(item.expires) {
+		ips = item.ips
+		r.lock.Unlock()
+		metricDNS.Add("cache_hit", 1)
+		return
+	}
+	if waited && item.err != nil {
+		// the lookup just failed, share its result instead of asking again
+		ips, err = item.ips, item.err
+		r.lock.Unlock()
+		if len(ips) > 0 {
+			metricDNS.Add("stale_served", 1)
+			err = nil
+		}
+		return
+	}
+	pending := make(chan struct{})
+	item.pending = pending
+	r.lock.Unlock()
+
+	metricDNS.Add("lookup", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), r.lookupTimeout)
+	ips, err = r.lookup(ctx, host)
+	cancel()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	close(pending)
+	item.pending = nil
+
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no address found for " + host)
+	}
+	item.err = err
+	if err == nil {
+		item.ips = ips
+		item.expires = time.Now().Add(r.ttl)
+		return
+	}
+
+	metricDNS.Add("lookup_failed", 1)
+	if len(item.ips) > 0 {
+		glog.Warning("[dns] failed to resolve ", host, ", use last known addresses ", item.ips, ": ", err)
+		metricDNS.Add("stale_served", 1)
+		return item.ips, nil
+	}
+	return
+}
+
+// HappyEyeballsDialer Dial all addresses of a host, a new attempt is started
+// if the previous one has not connected after FallbackDelay (RFC 8305)
+type HappyEyeballsDialer struct {
+	Resolver      *Resolver
+	Timeout       time.Duration
+	FallbackDelay time.Duration
+	KeepAlive     time.Duration // net.Dialer KeepAlive of the connections
+}
+
+func NewHappyEyeballsDialer(resolver *Resolver, timeout time.Duration) *HappyEyeballsDialer {
+	return &HappyEyeballsDialer{resolver, timeout, 300 * time.Millisecond, 0}
+}
+
+// sortAddresses Interleave IPv6 and IPv4 addresses, IPv6 first
+func sortAddresses(ips []net.IP) (sorted []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			sorted = append(sorted, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			sorted = append(sorted, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return
+}
+
+func (d *HappyEyeballsDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.Resolver.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	ips = sortAddresses(ips)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	results := make(chan result, len(ips))
+	dialer := net.Dialer{KeepAlive: d.KeepAlive}
+
+	started := 0
+	failed := 0
+	var lastErr error
+
+	// close the connections of the attempts still running
+	drain := func(remaining int) {
+		for i := 0; i < remaining; i++ {
+			if late := <-results; late.conn != nil {
+				late.conn.Close()
+			}
+		}
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+
+	for {
+		select {
+		case <-next.C:
+			if started < len(ips) {
+				target := net.JoinHostPort(ips[started].String(), port)
+				started++
+				go func() {
+					conn, err := dialer.DialContext(ctx, network, target)
+					results <- result{conn, err}
+				}()
+				next.Reset(d.FallbackDelay)
+			}
+		case r := <-results:
+			if r.err == nil {
+				go drain(started - failed - 1)
+				return r.conn, nil
+			}
+			failed++
+			lastErr = r.err
+			if failed >= len(ips) {
+				return nil, lastErr
+			}
+			if failed >= started {
+				// all running attempts failed, start the next one now
+				next.Reset(0)
+			}
+		case <-ctx.Done():
+			go drain(started - failed)
+			return nil, errors.New("dial " + addr + " timeout after trying " + strconv.Itoa(started) + " addresses")
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestResolver Create a resolver whose lookups are answered by lookup
+func newTestResolver(ttl time.Duration, lookup func(host string) ([]net.IP, error)) *Resolver {
+	r := NewResolver(nil, ttl, time.Second)
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		return lookup(host)
+	}
+	return r
+}
+
+func lookupConcurrently(r *Resolver, host string, n int) (ips [][]net.IP, errs []error) {
+	ips = make([][]net.IP, n)
+	errs = make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips[i], errs[i] = r.LookupIP(host)
+		}(i)
+	}
+	wg.Wait()
+	return
+}
+
+func TestResolverConcurrentLookups(t *testing.T) {
+	var lookups int32
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	})
+
+	ips, errs := lookupConcurrently(r, "pool.example.com", 20)
+	for i := range ips {
+		if errs[i] != nil || len(ips[i]) != 1 || !ips[i][0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("lookup %d got %v, %v", i, ips[i], errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("%d lookups for concurrent requests, expected 1", n)
+	}
+}
+
+func TestResolverConcurrentFailedLookups(t *testing.T) {
+	var lookups int32
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("server misbehaving")
+	})
+
+	for round := 1; round <= 2; round++ {
+		_, errs := lookupConcurrently(r, "pool.example.com", 20)
+		for i, err := range errs {
+			if err == nil {
+				t.Fatalf("round %d: lookup %d did not fail", round, i)
+			}
+		}
+		if n := atomic.LoadInt32(&lookups); n != int32(round) {
+			t.Errorf("round %d: %d lookups, expected %d", round, n, round)
+		}
+	}
+}
+
+func TestResolverFailingServer(t *testing.T) {
+	// nothing listens there, so every lookup fails
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	server := conn.LocalAddr().String()
+	conn.Close()
+
+	r := NewResolver([]string{server}, time.Minute, 500*time.Millisecond)
+	_, errs := lookupConcurrently(r, "pool.example.test", 20)
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("lookup %d did not fail", i)
+		}
+	}
+}
+
+func TestResolverStaleFallback(t *testing.T) {
+	var fail int32
+	r := newTestResolver(10*time.Millisecond, func(host string) ([]net.IP, error) {
+		if atomic.LoadInt32(&fail) != 0 {
+			time.Sleep(20 * time.Millisecond)
+			return nil, errors.New("i/o timeout")
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	})
+
+	if _, err := r.LookupIP("pool.example.com"); err != nil {
+		t.Fatalf("lookup failed: %s", err.Error())
+	}
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	ips, errs := lookupConcurrently(r, "pool.example.com", 20)
+	for i := range ips {
+		if errs[i] != nil || len(ips[i]) != 1 || !ips[i][0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("stale lookup %d got %v, %v", i, ips[i], errs[i])
+		}
+	}
+
+	// the stale addresses are replaced once DNS is back
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.2")}, nil
+	}
+	ips2, err := r.LookupIP("pool.example.com")
+	if err != nil || len(ips2) != 1 || !ips2[0].Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("lookup after recovery got %v, %v", ips2, err)
+	}
+}
+
+func TestResolverIPLiteral(t *testing.T) {
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		t.Errorf("IP literal %s was looked up", host)
+		return nil, nil
+	})
+	ips, err := r.LookupIP("2001:db8::1")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got %v, %v", ips, err)
+	}
+}
+
+func TestSortAddresses(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::1"),
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	sorted := sortAddresses(ips)
+	if len(sorted) != len(expected) {
+		t.Fatalf("got %v", sorted)
+	}
+	for i := range expected {
+		if sorted[i].String() != expected[i] {
+			t.Fatalf("got %v, expected %v", sorted, expected)
+		}
+	}
+}
+
+// closedPort Return a local TCP port that refuses connections
+func closedPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	return port
+}
+
+func TestHappyEyeballsDialerFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not available: ", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// 127.0.0.1 refuses the port, the dialer must go on to 127.0.0.2
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, nil
+	})
+	dialer := NewHappyEyeballsDialer(r, 2*time.Second)
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("pool.example.com", port))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err.Error())
+	}
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.2" {
+		t.Errorf("connected to %s, expected 127.0.0.2", conn.RemoteAddr().String())
+	}
+	conn.Close()
+}
+
+func TestHappyEyeballsDialerAllFailed(t *testing.T) {
+	port := closedPort(t)
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1")}, nil
+	})
+	dialer := NewHappyEyeballsDialer(r, 2*time.Second)
+	if conn, err := dialer.Dial("tcp", net.JoinHostPort("pool.example.com", port)); err == nil {
+		conn.Close()
+		t.Fatal("dial to a closed port succeeded")
+	}
+}
+
+func TestHappyEyeballsDialerLookupFailed(t *testing.T) {
+	r := newTestResolver(time.Minute, func(host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	})
+	dialer := NewHappyEyeballsDialer(r, time.Second)
+	if _, err := dialer.Dial("tcp", "pool.example.com:3333"); err == nil {
+		t.Fatal("dial without addresses succeeded")
+	}
+}
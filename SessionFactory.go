@@ -4,6 +4,8 @@ import "net"
 
 type SessionFactory interface {
 	NewUpSession(manager *UpSessionManager, poolIndex int, slot int) (up UpSession)
+	// NewRedirectedUpSession A pool connection to the host given by client.reconnect, with the settings of the pool
+	NewRedirectedUpSession(manager *UpSessionManager, poolIndex int, slot int, host string, port uint16) (up UpSession)
 	NewFakeUpSession(manager *UpSessionManager) (up FakeUpSession)
 	NewDownSession(manager *SessionManager, clientConn net.Conn, sessionID uint16) (down DownSession)
 }
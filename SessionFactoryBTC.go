@@ -9,6 +9,10 @@ func (factory *SessionFactoryBTC) NewUpSession(manager *UpSessionManager, poolIn
 	return NewUpSessionBTC(manager, poolIndex, slot)
 }
 
+func (factory *SessionFactoryBTC) NewRedirectedUpSession(manager *UpSessionManager, poolIndex int, slot int, host string, port uint16) (up UpSession) {
+	return NewRedirectedUpSessionBTC(manager, poolIndex, slot, host, port)
+}
+
 func (factory *SessionFactoryBTC) NewFakeUpSession(manager *UpSessionManager) (up FakeUpSession) {
 	return NewFakeUpSessionBTC(manager)
 }
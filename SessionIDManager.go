@@ -55,6 +55,22 @@ func (manager *SessionIDManager) AllocSessionID() (sessionID uint16, err error)
 	defer manager.lock.Unlock()
 	manager.lock.Lock()
 
+	return manager.allocSessionIDWithoutLock()
+}
+
+// AllocSessionIDFrom Assign the first free session ID from start, used to replay recorded sessions with their IDs
+func (manager *SessionIDManager) AllocSessionIDFrom(start uint16) (sessionID uint16, err error) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	manager.allocIDx = start
+	if manager.allocIDx > manager.maxSessionId {
+		manager.allocIDx = 0
+	}
+	return manager.allocSessionIDWithoutLock()
+}
+
+func (manager *SessionIDManager) allocSessionIDWithoutLock() (sessionID uint16, err error) {
 	if manager.isFullWithoutLock() {
 		sessionID = manager.maxSessionId
 		err = ErrSessionIDFull
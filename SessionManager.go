@@ -10,6 +10,7 @@ import (
 type SessionManager struct {
 	config            *Config                      // Configure
 	tcpListener       net.Listener                 // TCP listening object
+	tlsListener       net.Listener                 // TLS listening object (optional)
 	sessionIDManager  *SessionIDManager            // Session ID Manager
 	upSessionManagers map[string]*UpSessionManager // MAP [Sub Account Name] Mining Session Manager
 	exitChannel       chan bool                    //Exit signal
@@ -26,18 +27,12 @@ func NewSessionManager(config *Config) (manager *SessionManager) {
 }
 
 func (manager *SessionManager) Run() {
-	var err error
-
-	// Initialization Session Manager
-	manager.sessionIDManager, err = NewSessionIDManager(0xfffe)
+	err := manager.start()
 	if err != nil {
 		glog.Fatal("NewSessionIDManager failed: ", err)
 		return
 	}
 
-	// Start event loop
-	go manager.handleEvent()
-
 	// TCP listening
 	listenAddr := fmt.Sprintf("%s:%d", manager.config.AgentListenIp, manager.config.AgentListenPort)
 	glog.Info("startup is successful, listening: ", listenAddr)
@@ -47,13 +42,63 @@ func (manager *SessionManager) Run() {
 		return
 	}
 
+	// TLS listening
+	if manager.config.AgentListenTLS.Enable {
+		tlsConf := &manager.config.AgentListenTLS
+		loader, err := NewTLSCertLoader(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.ClientCAFile, tlsConf.VerifyClientCert,
+			manager.config.Advanced.MinerTLSCertReloadIntervalSeconds.Get())
+		if err != nil {
+			glog.Fatal("failed to load miner TLS certificate: ", err)
+			return
+		}
+
+		listenIp := tlsConf.ListenIp
+		if len(listenIp) < 1 {
+			listenIp = manager.config.AgentListenIp
+		}
+		tlsListenAddr := fmt.Sprintf("%s:%d", listenIp, tlsConf.ListenPort)
+		glog.Info("TLS listening: ", tlsListenAddr)
+		manager.tlsListener, err = NewTLSListener(tlsListenAddr, loader)
+		if err != nil {
+			glog.Fatal("failed to listen on ", tlsListenAddr, ": ", err)
+			return
+		}
+		go manager.acceptLoop(manager.tlsListener, true)
+	}
+
+	manager.acceptLoop(manager.tcpListener, false)
+}
+
+// start Start the event loop, background services and the pool connections of single user mode, without listening
+func (manager *SessionManager) start() (err error) {
+	// Initialization Session Manager
+	manager.sessionIDManager, err = NewSessionIDManager(0xfffe)
+	if err != nil {
+		return
+	}
+
+	// Start event loop
+	go manager.handleEvent()
+
+	// Start proxy health checks
+	go manager.config.proxyManager.Run()
+	if manager.config.workerMonitor != nil {
+		go manager.config.workerMonitor.Run()
+	}
+	if manager.config.eventBus != nil {
+		manager.config.eventBus.Run()
+	}
+
 	// Connect the mine for single user mode
 	if !manager.config.MultiUserMode {
 		manager.createUpSessionManager("")
 	}
+	return
+}
 
+func (manager *SessionManager) acceptLoop(listener net.Listener, useTLS bool) {
 	for {
-		conn, err := manager.tcpListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-manager.exitChannel:
@@ -63,14 +108,21 @@ func (manager *SessionManager) Run() {
 				continue
 			}
 		}
-		go manager.RunDownSession(conn)
+		if useTLS {
+			go manager.RunTLSDownSession(conn)
+		} else {
+			go manager.RunDownSession(conn)
+		}
 	}
 }
 
 func (manager *SessionManager) Stop() {
 	// Exit TCP listening
-	manager.exitChannel <- true
+	close(manager.exitChannel)
 	manager.tcpListener.Close()
+	if manager.tlsListener != nil {
+		manager.tlsListener.Close()
+	}
 
 	// Exit the event cycle
 	manager.SendEvent(EventExit{})
@@ -92,7 +144,10 @@ func (manager *SessionManager) RunDownSession(conn net.Conn) {
 		conn.Close()
 		return
 	}
+	manager.runDownSession(conn, sessionID)
+}
 
+func (manager *SessionManager) runDownSession(conn net.Conn, sessionID uint16) {
 	down := manager.config.sessionFactory.NewDownSession(manager, conn, sessionID)
 	down.Init()
 	if down.Stat() != StatAuthorized {
@@ -105,6 +160,17 @@ func (manager *SessionManager) RunDownSession(conn net.Conn) {
 	manager.SendEvent(EventAddDownSession{down})
 }
 
+func (manager *SessionManager) RunTLSDownSession(conn net.Conn) {
+	timeout := manager.config.Advanced.MinerTLSHandshakeTimeoutSeconds.Get()
+	err := TLSHandshake(conn, timeout)
+	if err != nil {
+		glog.Warning("TLS handshake with miner ", conn.RemoteAddr(), " failed: ", err.Error())
+		conn.Close()
+		return
+	}
+	manager.RunDownSession(conn)
+}
+
 func (manager *SessionManager) SendEvent(event interface{}) {
 	manager.eventChannel <- event
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// ShareJournalSubmit A share sent to the pool
+	ShareJournalSubmit = "submit"
+	// ShareJournalResult The pool's verdict on a share, with all fields of the submit record
+	ShareJournalResult = "result"
+)
+
+// ShareJournalRecord One line of the share journal (JSON Lines)
+type ShareJournalRecord struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	SubAccount  string    `json:"sub_account"`
+	Worker      string    `json:"worker"`
+	Pool        string    `json:"pool"`
+	JobID       string    `json:"job_id"`
+	Difficulty  float64   `json:"difficulty"`
+	ExtraNonce2 string    `json:"extranonce2"`
+	NTime       string    `json:"ntime"`
+	Nonce       string    `json:"nonce"`
+	VersionMask string    `json:"version_mask,omitempty"`
+	Replay      bool      `json:"replay,omitempty"`
+
+	// Only in result records
+	Accepted   bool   `json:"accepted,omitempty"`
+	Status     string `json:"status,omitempty"`
+	PoolError  string `json:"pool_error,omitempty"` // the error as sent by the pool
+	ResponseMs int64  `json:"response_ms,omitempty"`
+}
+
+// ShareJournal Append-only share journal, rotated by file size and time.
+// Records are written by a background goroutine so that a slow disk never blocks pool sessions.
+type ShareJournal struct {
+	dir            string
+	maxSize        int64
+	rotateInterval time.Duration
+	queue          chan *ShareJournalRecord
+
+	file      *os.File
+	fileIndex int
+	size      int64
+	openTime  time.Time
+}
+
+func NewShareJournal(dir string, maxSize int64, rotateInterval time.Duration, queueSize uint) (journal *ShareJournal, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	journal = new(ShareJournal)
+	journal.dir = dir
+	journal.maxSize = maxSize
+	journal.rotateInterval = rotateInterval
+	journal.queue = make(chan *ShareJournalRecord, queueSize)
+
+	err = journal.rotate()
+	if err != nil {
+		return nil, err
+	}
+	go journal.writeLoop()
+	return
+}
+
+// Write Queue a record, drop it if the writer is too slow
+func (journal *ShareJournal) Write(record *ShareJournalRecord) {
+	select {
+	case journal.queue <- record:
+	default:
+		metricShareJournal.Add("dropped", 1)
+	}
+}
+
+func (journal *ShareJournal) writeLoop() {
+	for record := range journal.queue {
+		line, err := json.Marshal(record)
+		if err != nil {
+			glog.Error("[share-journal] failed to encode record: ", err.Error())
+			continue
+		}
+		line = append(line, '\n')
+
+		if journal.file == nil || journal.size+int64(len(line)) > journal.maxSize || time.Since(journal.openTime) >= journal.rotateInterval {
+			err = journal.rotate()
+			if err != nil {
+				glog.Error("[share-journal] failed to rotate journal file: ", err.Error())
+				metricShareJournal.Add("write_errors", 1)
+				continue
+			}
+		}
+
+		n, err := journal.file.Write(line)
+		journal.size += int64(n)
+		if err != nil {
+			glog.Error("[share-journal] failed to write journal: ", err.Error())
+			metricShareJournal.Add("write_errors", 1)
+			continue
+		}
+		metricShareJournal.Add("written", 1)
+	}
+}
+
+func (journal *ShareJournal) rotate() (err error) {
+	if journal.file != nil {
+		journal.file.Close()
+		journal.file = nil
+		metricShareJournal.Add("rotated", 1)
+	}
+
+	now := time.Now()
+	// the index keeps the names unique and in order if files are rotated quickly
+	name := filepath.Join(journal.dir, fmt.Sprintf("shares-%s-%06d.jsonl", now.UTC().Format("20060102-150405"), journal.fileIndex))
+	journal.fileIndex++
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	journal.file = file
+	journal.size = info.Size()
+	journal.openTime = now
+	if glog.V(1) {
+		glog.Info("[share-journal] writing to ", name)
+	}
+	return
+}
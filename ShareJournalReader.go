@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ShareJournalSummary Share statistics of a worker, sub-account or pool
+type ShareJournalSummary struct {
+	Key           string
+	Submitted     uint64
+	Accepted      uint64
+	Rejected      uint64
+	SubmittedDiff float64
+	AcceptedDiff  float64
+	RejectReasons map[string]uint64
+	FirstTime     time.Time
+	LastTime      time.Time
+}
+
+// NoResponse Shares without a verdict from the pool
+func (summary *ShareJournalSummary) NoResponse() uint64 {
+	if summary.Accepted+summary.Rejected > summary.Submitted {
+		return 0
+	}
+	return summary.Submitted - summary.Accepted - summary.Rejected
+}
+
+// ShareJournalSummarizer Aggregate journal records by a field
+type ShareJournalSummarizer struct {
+	GroupBy  string // worker, sub_account or pool
+	From, To time.Time
+
+	Summaries map[string]*ShareJournalSummary
+}
+
+func NewShareJournalSummarizer(groupBy string) *ShareJournalSummarizer {
+	return &ShareJournalSummarizer{GroupBy: groupBy, Summaries: make(map[string]*ShareJournalSummary)}
+}
+
+func (summarizer *ShareJournalSummarizer) key(record *ShareJournalRecord) string {
+	switch summarizer.GroupBy {
+	case "worker":
+		return record.SubAccount + "." + record.Worker
+	case "pool":
+		return record.Pool
+	default:
+		return record.SubAccount
+	}
+}
+
+// InRange Whether the record is in [From, To), a zero time means no limit
+func (summarizer *ShareJournalSummarizer) InRange(record *ShareJournalRecord) bool {
+	return (summarizer.From.IsZero() || !record.Time.Before(summarizer.From)) &&
+		(summarizer.To.IsZero() || record.Time.Before(summarizer.To))
+}
+
+// Add Count a record, records out of the time range are ignored
+func (summarizer *ShareJournalSummarizer) Add(record *ShareJournalRecord) {
+	if !summarizer.InRange(record) {
+		return
+	}
+
+	key := summarizer.key(record)
+	summary, ok := summarizer.Summaries[key]
+	if !ok {
+		summary = &ShareJournalSummary{Key: key, RejectReasons: make(map[string]uint64), FirstTime: record.Time}
+		summarizer.Summaries[key] = summary
+	}
+	if record.Time.Before(summary.FirstTime) {
+		summary.FirstTime = record.Time
+	}
+	if record.Time.After(summary.LastTime) {
+		summary.LastTime = record.Time
+	}
+
+	switch record.Type {
+	case ShareJournalSubmit:
+		summary.Submitted++
+		summary.SubmittedDiff += record.Difficulty
+	case ShareJournalResult:
+		if record.Accepted {
+			summary.Accepted++
+			summary.AcceptedDiff += record.Difficulty
+		} else {
+			summary.Rejected++
+			summary.RejectReasons[record.Status]++
+		}
+	}
+}
+
+// ReadRecords Count all records of a journal file
+func (summarizer *ShareJournalSummarizer) ReadRecords(r io.Reader, each func(*ShareJournalRecord)) (badLines int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		var record ShareJournalRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// the last line may be truncated if the agent was killed
+			badLines++
+			continue
+		}
+		summarizer.Add(&record)
+		if each != nil {
+			each(&record)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Sorted Summaries ordered by key
+func (summarizer *ShareJournalSummarizer) Sorted() (list []*ShareJournalSummary) {
+	for _, summary := range summarizer.Summaries {
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return
+}
+
+// shareJournalFiles Expand directories to the journal files in them, in time order
+func shareJournalFiles(paths []string) (files []string, err error) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "shares-*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		// file names contain the creation time
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return
+}
+
+// RunShareJournalCommand Subcommand "journal": summarize share journal files
+func RunShareJournalCommand(args []string) int {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	groupBy := flags.String("by", "sub_account", "Group shares by worker, sub_account or pool")
+	from := flags.String("from", "", "Only count records at or after this time (RFC3339)")
+	to := flags.String("to", "", "Only count records before this time (RFC3339)")
+	dump := flags.Bool("dump", false, "Print every record in the time range before the summary")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: btcagent journal [options] <journal file or directory>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	switch *groupBy {
+	case "worker", "sub_account", "pool":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -by: %s\n", *groupBy)
+		return 2
+	}
+
+	summarizer := NewShareJournalSummarizer(*groupBy)
+	var err error
+	if *from != "" {
+		if summarizer.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if summarizer.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+			return 2
+		}
+	}
+
+	files, err := shareJournalFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var each func(*ShareJournalRecord)
+	if *dump {
+		encoder := json.NewEncoder(os.Stdout)
+		each = func(record *ShareJournalRecord) {
+			if summarizer.InRange(record) {
+				encoder.Encode(record)
+			}
+		}
+	}
+
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		badLines, err := summarizer.ReadRecords(file, each)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		if badLines > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d malformed lines skipped\n", name, badLines)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSUBMITTED\tACCEPTED\tREJECTED\tNO_RESPONSE\tACCEPTED_DIFF\tREJECT_RATE\tFIRST\tLAST")
+	for _, s := range summarizer.Sorted() {
+		rejectRate := 0.0
+		if s.Accepted+s.Rejected > 0 {
+			rejectRate = float64(s.Rejected) * 100 / float64(s.Accepted+s.Rejected)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.0f\t%.2f%%\t%s\t%s\n", s.Key, s.Submitted, s.Accepted, s.Rejected, s.NoResponse(),
+			s.AcceptedDiff, rejectRate, s.FirstTime.Format(time.RFC3339), s.LastTime.Format(time.RFC3339))
+	}
+	w.Flush()
+
+	for _, s := range summarizer.Sorted() {
+		for reason, count := range s.RejectReasons {
+			fmt.Printf("%s rejected %d: %s\n", s.Key, count, reason)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShareJournalRotateAndSummarize(t *testing.T) {
+	dir := t.TempDir()
+	// small enough to rotate after a few records
+	journal, err := NewShareJournal(dir, 1024, time.Hour, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := ShareJournalRecord{Time: time.Now(), Type: ShareJournalSubmit, SubAccount: "sub", Worker: "w1", Difficulty: 8, JobID: "1"}
+	accepted := submit
+	accepted.Type = ShareJournalResult
+	accepted.Accepted = true
+	rejected := accepted
+	rejected.Accepted = false
+	rejected.Status = STATUS_DUPLICATE_SHARE.ToString()
+
+	records := []ShareJournalRecord{submit, accepted, submit, rejected, submit}
+	for i := 0; i < 4; i++ {
+		for j := range records {
+			record := records[j]
+			journal.Write(&record)
+		}
+	}
+
+	// wait for the background writer
+	deadline := time.Now().Add(5 * time.Second)
+	for metricShareJournal.Get("written") == nil || metricShareJournal.Get("written").String() != "20" {
+		if time.Now().After(deadline) {
+			t.Fatalf("records not written: %v", metricShareJournal.Get("written"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files, err := shareJournalFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("journal should be rotated by size, got %d files", len(files))
+	}
+
+	summarizer := NewShareJournalSummarizer("worker")
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		badLines, err := summarizer.ReadRecords(file, nil)
+		file.Close()
+		if err != nil || badLines != 0 {
+			t.Fatalf("%s: err %v, bad lines %d", filepath.Base(name), err, badLines)
+		}
+	}
+
+	summary := summarizer.Summaries["sub.w1"]
+	if summary == nil {
+		t.Fatalf("missing summary of sub.w1: %v", summarizer.Summaries)
+	}
+	if summary.Submitted != 12 || summary.Accepted != 4 || summary.Rejected != 4 || summary.NoResponse() != 4 {
+		t.Errorf("wrong summary: %+v", *summary)
+	}
+	if summary.AcceptedDiff != 32 {
+		t.Errorf("accepted difficulty should be 32, got %v", summary.AcceptedDiff)
+	}
+	if summary.RejectReasons[STATUS_DUPLICATE_SHARE.ToString()] != 4 {
+		t.Errorf("wrong reject reasons: %v", summary.RejectReasons)
+	}
+}
+
+func TestSubmitResponseStatus(t *testing.T) {
+	cases := []struct {
+		rpc    JSONRPCLineBTC
+		status StratumStatus
+	}{
+		{JSONRPCLineBTC{Result: true}, STATUS_ACCEPT},
+		{JSONRPCLineBTC{Result: false, Error: []interface{}{float64(21), "Job not found", nil}}, STATUS_JOB_NOT_FOUND_OR_STALE},
+		{JSONRPCLineBTC{Error: map[string]interface{}{"code": float64(23), "message": "Low difficulty"}}, STATUS_LOW_DIFFICULTY},
+		{JSONRPCLineBTC{Result: false}, STATUS_REJECT_NO_REASON},
+	}
+	for i, c := range cases {
+		if status := submitResponseStatus(&c.rpc); status != c.status {
+			t.Errorf("case %d: expected %s, got %s", i, c.status.ToString(), status.ToString())
+		}
+	}
+}
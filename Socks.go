@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS protocol stages, used in error messages so operators know which step failed
+const (
+	SocksStageDial      = "connect to proxy"
+	SocksStageResolve   = "resolve target locally"
+	SocksStageGreeting  = "negotiate auth method"
+	SocksStageAuth      = "authentication"
+	SocksStageConnect   = "CONNECT"
+	SocksStageTransport = "read reply"
+)
+
+// SocksError Error of a SOCKS proxy with the failed stage
+type SocksError struct {
+	Protocol string
+	Proxy    string
+	Stage    string
+	Err      error
+}
+
+func (err *SocksError) Error() string {
+	return fmt.Sprintf("%s proxy %s: %s failed: %s", err.Protocol, err.Proxy, err.Stage, err.Err.Error())
+}
+
+func (err *SocksError) Unwrap() error {
+	return err.Err
+}
+
+// SocksDialer SOCKS4, SOCKS4a, SOCKS5 and SOCKS5h client
+type SocksDialer struct {
+	Protocol  string // socks4, socks4a, socks5 or socks5h
+	ProxyAddr string
+	User      string
+	Password  string
+	Timeout   time.Duration
+	Forward   *net.Dialer
+	Resolver  func(host string) ([]net.IP, error)
+}
+
+func NewSocksDialer(protocol string, proxyAddr string, user string, password string, timeout time.Duration) (dialer *SocksDialer) {
+	dialer = new(SocksDialer)
+	dialer.Protocol = protocol
+	dialer.ProxyAddr = proxyAddr
+	dialer.User = user
+	dialer.Password = password
+	dialer.Timeout = timeout
+	dialer.Forward = &net.Dialer{Timeout: timeout}
+	dialer.Resolver = func(host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	}
+	return
+}
+
+// remoteDNS Whether the target hostname is sent to the proxy
+func (d *SocksDialer) remoteDNS() bool {
+	return d.Protocol == "socks4a" || d.Protocol == "socks5h"
+}
+
+func (d *SocksDialer) newError(stage string, err error) error {
+	return &SocksError{d.Protocol, d.ProxyAddr, stage, err}
+}
+
+func (d *SocksDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+
+	var ip net.IP
+	if ip = net.ParseIP(host); ip == nil && !d.remoteDNS() {
+		ip, err = d.resolve(host)
+		if err != nil {
+			err = d.newError(SocksStageResolve, err)
+			return
+		}
+	}
+
+	conn, err = d.Forward.Dial(network, d.ProxyAddr)
+	if err != nil {
+		err = d.newError(SocksStageDial, err)
+		return
+	}
+
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	if d.Protocol == "socks4" || d.Protocol == "socks4a" {
+		err = d.connectV4(conn, host, ip, uint16(port))
+	} else {
+		err = d.connectV5(conn, host, ip, uint16(port))
+	}
+	if err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func (d *SocksDialer) resolve(host string) (ip net.IP, err error) {
+	ips, err := d.Resolver(host)
+	if err != nil {
+		return
+	}
+	for _, item := range ips {
+		if item.To4() != nil {
+			ip = item
+			return
+		}
+	}
+	// SOCKS4 supports IPv4 only
+	if len(ips) > 0 && d.Protocol != "socks4" {
+		ip = ips[0]
+		return
+	}
+	err = fmt.Errorf("no suitable address for %s", host)
+	return
+}
+
+func (d *SocksDialer) connectV4(conn net.Conn, host string, ip net.IP, port uint16) (err error) {
+	// request: VN(4) CD(1) DSTPORT DSTIP USERID NULL [HOSTNAME NULL]
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	if ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return d.newError(SocksStageConnect, errors.New("SOCKS4 does not support IPv6 target "+ip.String()))
+		}
+		req = append(req, ip4...)
+		req = append(req, d.User...)
+		req = append(req, 0)
+	} else {
+		// SOCKS4a: invalid IP 0.0.0.x tells the proxy to resolve the hostname
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, d.User...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	if _, err = conn.Write(req); err != nil {
+		return d.newError(SocksStageConnect, err)
+	}
+
+	// reply: VN(0) CD DSTPORT DSTIP
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return d.newError(SocksStageTransport, err)
+	}
+	switch reply[1] {
+	case 90:
+		return nil
+	case 92, 93:
+		// identd based authentication
+		return d.newError(SocksStageAuth, fmt.Errorf("rejected by identd check (code %d)", reply[1]))
+	default:
+		return d.newError(SocksStageConnect, fmt.Errorf("request rejected or failed (code %d)", reply[1]))
+	}
+}
+
+var socks5ReplyText = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *SocksDialer) connectV5(conn net.Conn, host string, ip net.IP, port uint16) (err error) {
+	// greeting: only "no auth" and "username/password" are offered
+	greeting := []byte{5, 1, 0}
+	if len(d.User) > 0 {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return d.newError(SocksStageGreeting, err)
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return d.newError(SocksStageGreeting, err)
+	}
+	if reply[0] != 5 {
+		return d.newError(SocksStageGreeting, fmt.Errorf("not a SOCKS5 server (version %d)", reply[0]))
+	}
+
+	switch reply[1] {
+	case 0:
+		// no authentication required
+	case 2:
+		if len(d.User) < 1 {
+			return d.newError(SocksStageAuth, errors.New("proxy requires username/password but none configured"))
+		}
+		if len(d.User) > 255 || len(d.Password) > 255 {
+			return d.newError(SocksStageAuth, errors.New("username or password too long"))
+		}
+		auth := []byte{1, byte(len(d.User))}
+		auth = append(auth, d.User...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err = conn.Write(auth); err != nil {
+			return d.newError(SocksStageAuth, err)
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return d.newError(SocksStageAuth, err)
+		}
+		if reply[1] != 0 {
+			return d.newError(SocksStageAuth, errors.New("username/password rejected"))
+		}
+	case 0xff:
+		return d.newError(SocksStageGreeting, errors.New("no acceptable auth method"))
+	default:
+		return d.newError(SocksStageGreeting, fmt.Errorf("unsupported auth method %d", reply[1]))
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := []byte{5, 1, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else if ip != nil {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return d.newError(SocksStageConnect, errors.New("hostname too long"))
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return d.newError(SocksStageConnect, err)
+	}
+
+	// reply: VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return d.newError(SocksStageTransport, err)
+	}
+	if head[1] != 0 {
+		text, ok := socks5ReplyText[head[1]]
+		if !ok {
+			text = fmt.Sprintf("unknown error (code %d)", head[1])
+		}
+		return d.newError(SocksStageConnect, errors.New(text))
+	}
+
+	var addrLen int
+	switch head[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		if _, err = io.ReadFull(conn, head[:1]); err != nil {
+			return d.newError(SocksStageTransport, err)
+		}
+		addrLen = int(head[0])
+	default:
+		return d.newError(SocksStageTransport, fmt.Errorf("unknown address type %d", head[3]))
+	}
+	// skip the bound address and port
+	if _, err = io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return d.newError(SocksStageTransport, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runFakeSocksServer Accept one connection, check the request bytes and write the reply
+func runFakeSocksServer(t *testing.T, exchanges [][2][]byte) (addr string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange[0]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Errorf("fake socks server read failed: %s", err.Error())
+				return
+			}
+			if !bytes.Equal(buf, exchange[0]) {
+				t.Errorf("fake socks server got %v, expected %v", buf, exchange[0])
+				return
+			}
+			conn.Write(exchange[1])
+		}
+		// wait for the client
+		conn.Read(make([]byte, 1))
+	}()
+	return listener.Addr().String()
+}
+
+func TestSocks4aRemoteDNS(t *testing.T) {
+	addr := runFakeSocksServer(t, [][2][]byte{{
+		append([]byte{4, 1, 0x0d, 0x05, 0, 0, 0, 1, 'u', 0}, "pool.example.com\x00"...),
+		{0, 90, 0, 0, 0, 0, 0, 0},
+	}})
+
+	dialer := NewSocksDialer("socks4a", addr, "u", "", time.Second)
+	conn, err := dialer.Dial("tcp", "pool.example.com:3333")
+	if err != nil {
+		t.Fatalf("socks4a dial failed: %s", err.Error())
+	}
+	conn.Close()
+}
+
+func TestSocks5LocalDNS(t *testing.T) {
+	addr := runFakeSocksServer(t, [][2][]byte{
+		{{5, 1, 0}, {5, 0}},
+		{{5, 1, 0, 1, 10, 0, 0, 1, 0x0d, 0x05}, {5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+	})
+
+	dialer := NewSocksDialer("socks5", addr, "", "", time.Second)
+	dialer.Resolver = func(host string) ([]net.IP, error) {
+		if host != "pool.example.com" {
+			t.Errorf("unexpected host to resolve: %s", host)
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	conn, err := dialer.Dial("tcp", "pool.example.com:3333")
+	if err != nil {
+		t.Fatalf("socks5 dial failed: %s", err.Error())
+	}
+	conn.Close()
+}
+
+func TestSocks5AuthFailed(t *testing.T) {
+	addr := runFakeSocksServer(t, [][2][]byte{
+		{{5, 2, 0, 2}, {5, 2}},
+		{{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}, {1, 1}},
+	})
+
+	dialer := NewSocksDialer("socks5h", addr, "user", "pass", time.Second)
+	_, err := dialer.Dial("tcp", "pool.example.com:3333")
+
+	var socksErr *SocksError
+	if !errors.As(err, &socksErr) || socksErr.Stage != SocksStageAuth {
+		t.Fatalf("expected an authentication error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("error text should mention authentication: %s", err.Error())
+	}
+}
+
+func TestSocks5ProxyURLDNS(t *testing.T) {
+	for _, localDNS := range []bool{false, true} {
+		dialer, err := GetProxyDialer("socks5://127.0.0.1:1080", time.Second, 0, false, localDNS, nil)
+		if err != nil {
+			t.Fatalf("GetProxyDialer failed: %s", err.Error())
+		}
+		socksDialer, ok := dialer.(*SocksDialer)
+		if !ok {
+			t.Fatalf("expected a socks dialer, got %T", dialer)
+		}
+		if socksDialer.remoteDNS() == localDNS {
+			t.Errorf("socks5:// with local DNS %v: remote DNS should be %v", localDNS, !localDNS)
+		}
+	}
+}
+
+func TestSocksProxyKeepAlive(t *testing.T) {
+	for period, expected := range map[time.Duration]time.Duration{30 * time.Second: 30 * time.Second, 0: -1} {
+		dialer, err := GetProxyDialer("socks5://127.0.0.1:1080", time.Second, period, false, false, nil)
+		if err != nil {
+			t.Fatalf("GetProxyDialer failed: %s", err.Error())
+		}
+		// set on the connection to the proxy, the SOCKS handshake does not wrap it
+		if keepAlive := dialer.(*SocksDialer).Forward.KeepAlive; keepAlive != expected {
+			t.Errorf("keepalive period %v: the dialer got %v, expected %v", period, keepAlive, expected)
+		}
+	}
+}
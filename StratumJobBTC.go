@@ -24,7 +24,9 @@ func NewStratumJobBTC(json *JSONRPCLineBTC, sessionID uint32) (job *StratumJobBT
 			[7] nTime. The current time. nTime rolling should be supported, but should not increase faster than actual time.
 			[8] Clean Jobs. If true, miners should abort their current work and immediately use the new job. If false, they can still use the current job, but should move to the new one after exhausting the current nonce range.
 	*/
-	glog.Info("JSON Notify:", json)
+	if glog.V(9) {
+		glog.Info("NewStratumJobBTC: ", json)
+	}
 	job = new(StratumJobBTC)
 	job.ID = json.ID
 	job.Method = json.Method
@@ -54,6 +56,11 @@ func (job *StratumJobBTC) ToNotifyLine(firstJob bool) (bytes []byte, err error)
 	return job.ToJSONBytesLine()
 }
 
+func (job *StratumJobBTC) IsClean() bool {
+	clean, _ := job.Params[8].(bool)
+	return clean
+}
+
 func IsFakeJobIDBTC(id string) bool {
 	return len(id) < 1 || id[0] == 'f'
 }
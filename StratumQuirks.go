@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// StratumQuirk A known deviation of a pool from JSON, and its fix.
+// Fix returns nil if the line does not have the quirk.
+type StratumQuirk struct {
+	Name string
+	Fix  func(line []byte) []byte
+}
+
+// Fixes are tried in order, and are accumulated until the line can be decoded
+var poolStratumQuirks = []StratumQuirk{
+	{"padding", fixStratumPadding},
+	{"unquoted_id", fixStratumUnquotedID},
+}
+
+var unquotedIDRegexp = regexp.MustCompile(`("id"\s*:\s*)([A-Za-z_][A-Za-z0-9_.\-]*)(\s*[,}])`)
+
+// fixStratumPadding Remove NUL bytes and the UTF-8 BOM around the JSON
+func fixStratumPadding(line []byte) []byte {
+	fixed := bytes.TrimPrefix(bytes.Trim(line, "\x00\r\n\t "), []byte("\xef\xbb\xbf"))
+	fixed = append(bytes.Trim(fixed, "\x00\t "), '\n')
+	if bytes.Equal(fixed, line) {
+		return nil
+	}
+	return fixed
+}
+
+// fixStratumUnquotedID Quote an ID that is a bare word, such as {"id":auth,...}
+func fixStratumUnquotedID(line []byte) []byte {
+	found := false
+	fixed := unquotedIDRegexp.ReplaceAllFunc(line, func(match []byte) []byte {
+		parts := unquotedIDRegexp.FindSubmatch(match)
+		switch string(parts[2]) {
+		case "true", "false", "null":
+			return match
+		}
+		found = true
+		return []byte(string(parts[1]) + `"` + string(parts[2]) + `"` + string(parts[3]))
+	})
+	if !found {
+		return nil
+	}
+	return fixed
+}
+
+// ParsePoolJSONRPCLine Decode a line from a pool. If it is not valid JSON, the known quirks are fixed before giving up.
+// line is the fixed line and quirks are the names of the applied fixes, err is the error of the original line.
+func ParsePoolJSONRPCLine(jsonBytes []byte) (rpcData *JSONRPCLineBTC, line []byte, quirks []string, err error) {
+	rpcData, err = NewJSONRPCLineBTC(jsonBytes)
+	if err == nil {
+		return rpcData, jsonBytes, nil, nil
+	}
+
+	line = jsonBytes
+	for _, quirk := range poolStratumQuirks {
+		fixed := quirk.Fix(line)
+		if fixed == nil {
+			continue
+		}
+		line = fixed
+		quirks = append(quirks, quirk.Name)
+		if fixedData, e := NewJSONRPCLineBTC(line); e == nil {
+			return fixedData, line, quirks, nil
+		}
+	}
+	return rpcData, jsonBytes, nil, err
+}
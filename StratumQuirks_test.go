@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePoolJSONRPCLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		fixed  string
+		quirks []string
+	}{
+		{"{\"id\":1,\"result\":true}\n", "{\"id\":1,\"result\":true}\n", nil},
+		{"{\"id\":auth,\"result\":true,\"error\":null}\n", "{\"id\":\"auth\",\"result\":true,\"error\":null}\n", []string{"unquoted_id"}},
+		{"\xef\xbb\xbf{\"id\":null,\"method\":\"mining.ping\",\"params\":[]}\x00\x00\n", "{\"id\":null,\"method\":\"mining.ping\",\"params\":[]}\n", []string{"padding"}},
+		{"\x00{\"id\": conn_test }\n", "{\"id\": \"conn_test\" }\n", []string{"padding", "unquoted_id"}},
+	}
+	for _, test := range tests {
+		rpcData, fixed, quirks, err := ParsePoolJSONRPCLine([]byte(test.line))
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if string(fixed) != test.fixed || len(quirks) != len(test.quirks) {
+			t.Errorf("%q: fixed as %q with %v", test.line, fixed, quirks)
+			continue
+		}
+		for i := range quirks {
+			if quirks[i] != test.quirks[i] {
+				t.Errorf("%q: wrong quirks %v", test.line, quirks)
+			}
+		}
+		if rpcData.ID == nil && rpcData.Method == "" {
+			t.Errorf("%q: nothing decoded", test.line)
+		}
+	}
+
+	// "null" is valid JSON, it must not give a nil line
+	if rpcData, _, _, err := ParsePoolJSONRPCLine([]byte("null\n")); err != nil || rpcData == nil {
+		t.Errorf("null line decoded as %v, %v", rpcData, err)
+	}
+
+	// a boolean ID is not a quirk, and garbage is still an error
+	for _, line := range []string{"{\"id\":true,}\n", "not json\n", "{\"id\":1,\"params\":{}}\n"} {
+		if _, fixed, _, err := ParsePoolJSONRPCLine([]byte(line)); err == nil || string(fixed) != line {
+			t.Errorf("%q should not be fixed: %q", line, fixed)
+		}
+	}
+}
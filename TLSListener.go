@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TLSCertLoader Certificate holder for the miner TLS listener.
+// Files are re-read when their modification time changes, so certificates can be replaced without a restart.
+type TLSCertLoader struct {
+	lock sync.Mutex
+
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	verifyClient bool
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	certModTime     time.Time
+	keyModTime      time.Time
+	clientCAModTime time.Time
+
+	lastCheck     time.Time
+	checkInterval time.Duration
+}
+
+// NewTLSCertLoader Load the certificate, key and (optional) client CA bundle
+func NewTLSCertLoader(certFile, keyFile, clientCAFile string, verifyClient bool, checkInterval time.Duration) (loader *TLSCertLoader, err error) {
+	loader = new(TLSCertLoader)
+	loader.certFile = certFile
+	loader.keyFile = keyFile
+	loader.clientCAFile = clientCAFile
+	loader.verifyClient = verifyClient
+	loader.checkInterval = checkInterval
+
+	err = loader.reload()
+	return
+}
+
+func fileModTime(file string) (modTime time.Time, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	modTime = info.ModTime()
+	return
+}
+
+// reload Re-read the files if they have been changed (internal use, not locked)
+func (loader *TLSCertLoader) reload() (err error) {
+	certModTime, err := fileModTime(loader.certFile)
+	if err != nil {
+		return
+	}
+	keyModTime, err := fileModTime(loader.keyFile)
+	if err != nil {
+		return
+	}
+
+	if loader.cert == nil || !certModTime.Equal(loader.certModTime) || !keyModTime.Equal(loader.keyModTime) {
+		cert, e := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+		if e != nil {
+			err = e
+			return
+		}
+		if loader.cert != nil {
+			glog.Info("[TLS] miner listener certificate reloaded: ", loader.certFile)
+		}
+		loader.cert = &cert
+		loader.certModTime = certModTime
+		loader.keyModTime = keyModTime
+	}
+
+	if len(loader.clientCAFile) < 1 {
+		return
+	}
+
+	clientCAModTime, err := fileModTime(loader.clientCAFile)
+	if err != nil {
+		return
+	}
+	if loader.clientCAs == nil || !clientCAModTime.Equal(loader.clientCAModTime) {
+		pemBytes, e := ioutil.ReadFile(loader.clientCAFile)
+		if e != nil {
+			err = e
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			err = fmt.Errorf("no certificate found in %s", loader.clientCAFile)
+			return
+		}
+		if loader.clientCAs != nil {
+			glog.Info("[TLS] miner listener client CA reloaded: ", loader.clientCAFile)
+		}
+		loader.clientCAs = pool
+		loader.clientCAModTime = clientCAModTime
+	}
+	return
+}
+
+// GetConfigForClient Used as tls.Config.GetConfigForClient, so each handshake sees the latest certificate
+func (loader *TLSCertLoader) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	defer loader.lock.Unlock()
+	loader.lock.Lock()
+
+	if time.Since(loader.lastCheck) >= loader.checkInterval {
+		loader.lastCheck = time.Now()
+		err := loader.reload()
+		if err != nil {
+			// keep serving the last good certificate
+			glog.Error("[TLS] failed to reload miner listener certificate: ", err.Error())
+		}
+	}
+
+	if loader.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*loader.cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if loader.clientCAs != nil {
+		config.ClientCAs = loader.clientCAs
+		if loader.verifyClient {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if loader.verifyClient {
+		// no CA bundle, verify against system roots
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewTLSListener Create a TLS listener for miners
+func NewTLSListener(listenAddr string, loader *TLSCertLoader) (listener net.Listener, err error) {
+	tcpListener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return
+	}
+	listener = tls.NewListener(tcpListener, &tls.Config{
+		GetConfigForClient: loader.GetConfigForClient,
+	})
+	return
+}
+
+// TLSHandshake Complete the TLS handshake within the timeout so that a silent client cannot hold a goroutine forever
+func TLSHandshake(conn net.Conn, timeout time.Duration) (err error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	return
+}
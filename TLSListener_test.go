@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startTLSMinerListener Accept TLS miners for the agent until the test ends
+func startTLSMinerListener(t *testing.T, manager *SessionManager, loader *TLSCertLoader) string {
+	listener, err := NewTLSListener("127.0.0.1:0", loader)
+	if err != nil {
+		t.Fatalf("NewTLSListener failed: %s", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go manager.RunTLSDownSession(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialTLSMiner Connect a miner trusting the CA, nil and the error if the handshake fails
+func dialTLSMiner(t *testing.T, addr string, ca *testCert, clientCerts ...tls.Certificate) (*tls.Conn, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{RootCAs: roots, ServerName: "agent.example.com", Certificates: clientCerts})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, nil
+}
+
+func TestTLSMinerConnectAndReload(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	certFile, keyFile := newTestCert(t, "agent-1", false, ca, "agent.example.com").writeFiles(t, dir, "agent")
+	loader, err := NewTLSCertLoader(certFile, keyFile, "", false, 0)
+	if err != nil {
+		t.Fatalf("NewTLSCertLoader failed: %s", err.Error())
+	}
+	addr := startTLSMinerListener(t, manager, loader)
+
+	conn, err := dialTLSMiner(t, addr, ca)
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %s", err.Error())
+	}
+	miner := newMockMinerConn(t, conn)
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	miner.expect("", float64(1))
+	miner.send(`{"id":2,"method":"mining.authorize","params":["mock.worker1",""]}`)
+	if response := miner.expect("", float64(2)); response.Result != true {
+		t.Fatalf("authorize over TLS failed: %+v", response)
+	}
+	jobID := miner.expect("mining.notify", nil).Params[0].(string)
+	if response := miner.submit(3, jobID); response.Result != true {
+		t.Fatalf("share over TLS rejected: %+v", response)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+
+	// a replaced certificate is used by the next handshake, without a restart
+	newTestCert(t, "agent-2", false, ca, "agent.example.com").writeFiles(t, dir, "agent")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	conn, err = dialTLSMiner(t, addr, ca)
+	if err != nil {
+		t.Fatalf("TLS handshake after the reload failed: %s", err.Error())
+	}
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "agent-2" {
+		t.Errorf("the reloaded certificate should be used, got %s", name)
+	}
+
+	// a broken file keeps the last good certificate
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+	conn, err = dialTLSMiner(t, addr, ca)
+	if err != nil {
+		t.Fatalf("TLS handshake with a broken certificate file failed: %s", err.Error())
+	}
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "agent-2" {
+		t.Errorf("the last good certificate should be kept, got %s", name)
+	}
+}
+
+func TestTLSMinerClientCert(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "agent", false, ca, "agent.example.com").writeFiles(t, dir, "agent")
+	loader, err := NewTLSCertLoader(certFile, keyFile, caFile, true, time.Minute)
+	if err != nil {
+		t.Fatalf("NewTLSCertLoader failed: %s", err.Error())
+	}
+	addr := startTLSMinerListener(t, manager, loader)
+
+	// TLS 1.3 reports a refused client certificate on the first read
+	if conn, err := dialTLSMiner(t, addr, ca); err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+			t.Error("a miner without a client certificate should be refused")
+		}
+	}
+
+	client := newTestCert(t, "miner", false, ca)
+	conn, err := dialTLSMiner(t, addr, ca, client.tlsCert)
+	if err != nil {
+		t.Fatalf("TLS handshake with a client certificate failed: %s", err.Error())
+	}
+	miner := newMockMinerConn(t, conn)
+	miner.send(`{"id":1,"method":"mining.subscribe","params":[]}`)
+	if response := miner.expect("", float64(1)); response.Error != nil {
+		t.Errorf("subscribe over mTLS failed: %+v", response)
+	}
+}
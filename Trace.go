@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Links and directions of trace records
+const (
+	TraceLinkMiner = "miner"
+	TraceLinkPool  = "pool"
+
+	// TraceDirectionIn A line received by BTCAgent
+	TraceDirectionIn = "in"
+	// TraceDirectionOut A line sent by BTCAgent
+	TraceDirectionOut = "out"
+)
+
+// TraceFilter Sessions to be traced, all non-empty fields must match
+type TraceFilter struct {
+	SessionID *uint16 `json:"session_id,omitempty"`
+	IP        string  `json:"ip,omitempty"`
+	Worker    string  `json:"worker,omitempty"` // the worker name or the full name "sub_account.worker"
+}
+
+// TraceTarget A miner session to be matched with trace filters
+type TraceTarget struct {
+	SessionID uint16
+	IP        string
+	Worker    string
+	FullName  string
+}
+
+func (filter *TraceFilter) Empty() bool {
+	return filter.SessionID == nil && len(filter.IP) < 1 && len(filter.Worker) < 1
+}
+
+func (filter *TraceFilter) Match(target *TraceTarget) bool {
+	if filter.SessionID != nil && *filter.SessionID != target.SessionID {
+		return false
+	}
+	if len(filter.IP) > 0 && filter.IP != target.IP {
+		return false
+	}
+	if len(filter.Worker) > 0 && filter.Worker != target.Worker && filter.Worker != target.FullName {
+		return false
+	}
+	return true
+}
+
+// TraceRedactedPassword Replaces the password of mining.authorize in trace records
+const TraceRedactedPassword = "******"
+
+// redactTraceLine Remove the password from a mining.authorize line, other lines are returned as they are
+func redactTraceLine(line []byte) string {
+	text := strings.TrimRight(string(line), "\r\n")
+	if !strings.Contains(text, "mining.authorize") {
+		return text
+	}
+	rpcData, err := NewJSONRPCLineBTC([]byte(text))
+	if err != nil || rpcData.Method != "mining.authorize" || len(rpcData.Params) < 2 {
+		return text
+	}
+	if password, ok := rpcData.Params[1].(string); ok && len(password) < 1 {
+		return text
+	}
+	rpcData.Params[1] = TraceRedactedPassword
+	redacted, err := json.Marshal(rpcData)
+	if err != nil {
+		return text
+	}
+	return string(redacted)
+}
+
+// TraceRecord One line of a trace file (JSON Lines)
+type TraceRecord struct {
+	Time      time.Time `json:"time"`
+	SessionID uint16    `json:"session_id"`
+	Link      string    `json:"link"`
+	Direction string    `json:"dir"`
+	Pool      string    `json:"pool,omitempty"`
+	Line      string    `json:"line"`
+	// A line received from the pool before the miner joined the connection, recorded when it joins
+	State bool `json:"state,omitempty"`
+}
+
+// Trace A running or finished trace capture, written to its own capped file
+type Trace struct {
+	ID       uint        `json:"id"`
+	Filter   TraceFilter `json:"filter"`
+	File     string      `json:"file"`
+	MaxSize  int64       `json:"max_size"`
+	Size     int64       `json:"size"`
+	Records  uint64      `json:"records"`
+	Capped   bool        `json:"capped"`
+	Running  bool        `json:"running"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+
+	file *os.File
+}
+
+// write Append a record, return false if the trace has been stopped because of its size limit or an error
+func (trace *Trace) write(record *TraceRecord) bool {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return true
+	}
+	line = append(line, '\n')
+
+	if trace.Size+int64(len(line)) > trace.MaxSize {
+		glog.Info("[trace] trace ", trace.ID, " reached its size limit: ", trace.File)
+		trace.Capped = true
+		trace.stop()
+		metricTrace.Add("capped", 1)
+		return false
+	}
+	_, err = trace.file.Write(line)
+	if err != nil {
+		glog.Error("[trace] failed to write trace ", trace.ID, ": ", err.Error())
+		trace.stop()
+		metricTrace.Add("errors", 1)
+		return false
+	}
+	trace.Size += int64(len(line))
+	trace.Records++
+	metricTrace.Add("records", 1)
+	return true
+}
+
+func (trace *Trace) stop() {
+	trace.Running = false
+	trace.Finished = time.Now()
+	trace.file.Close()
+}
+
+// TraceManager Protocol trace capture of selected miners, switched on and off through the admin API.
+// Records are written synchronously, there is almost no cost for sessions while no trace is running.
+type TraceManager struct {
+	dir     string
+	maxSize int64
+
+	running int32 // number of running traces, read without the lock
+
+	lock   sync.Mutex
+	nextID uint
+	traces []*Trace
+}
+
+func NewTraceManager(dir string, maxSize int64) (manager *TraceManager) {
+	manager = new(TraceManager)
+	manager.dir = dir
+	manager.maxSize = maxSize
+	manager.nextID = 1
+	return
+}
+
+// Active Whether any trace is running. Safe to call on a nil manager.
+func (manager *TraceManager) Active() bool {
+	return manager != nil && atomic.LoadInt32(&manager.running) > 0
+}
+
+// Start Start a trace of sessions matching the filter, maxSize 0 for the default limit
+func (manager *TraceManager) Start(filter TraceFilter, maxSize int64) (trace *Trace, err error) {
+	if filter.Empty() {
+		err = fmt.Errorf("session_id, ip or worker is required")
+		return
+	}
+	if maxSize <= 0 || maxSize > manager.maxSize {
+		maxSize = manager.maxSize
+	}
+	err = os.MkdirAll(manager.dir, 0755)
+	if err != nil {
+		return
+	}
+
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	trace = &Trace{ID: manager.nextID, Filter: filter, MaxSize: maxSize, Running: true, Started: time.Now()}
+	trace.File = filepath.Join(manager.dir, fmt.Sprintf("trace-%s-%d.jsonl", trace.Started.UTC().Format("20060102T150405"), trace.ID))
+	trace.file, err = os.OpenFile(trace.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	manager.nextID++
+	manager.traces = append(manager.traces, trace)
+	atomic.AddInt32(&manager.running, 1)
+	metricTrace.Add("started", 1)
+
+	glog.Info("[trace] trace ", trace.ID, " started: ", trace.File)
+	copied := *trace
+	return &copied, nil
+}
+
+// Stop Stop a running trace, the file is kept
+func (manager *TraceManager) Stop(id uint) (trace *Trace, err error) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	for _, t := range manager.traces {
+		if t.ID == id {
+			if t.Running {
+				t.stop()
+				atomic.AddInt32(&manager.running, -1)
+				glog.Info("[trace] trace ", t.ID, " stopped, ", t.Records, " records: ", t.File)
+			}
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("trace %d not found", id)
+}
+
+// Traces Status of all traces since BTCAgent started
+func (manager *TraceManager) Traces() (traces []Trace) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	traces = make([]Trace, 0, len(manager.traces))
+	for _, trace := range manager.traces {
+		traces = append(traces, *trace)
+	}
+	return
+}
+
+// RecordMiner Record a line of a miner connection
+func (manager *TraceManager) RecordMiner(target *TraceTarget, direction string, line []byte) {
+	if !manager.Active() {
+		return
+	}
+	record := &TraceRecord{time.Now(), target.SessionID, TraceLinkMiner, direction, "", redactTraceLine(line), false}
+
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	for _, trace := range manager.traces {
+		if trace.Running && trace.Filter.Match(target) && !trace.write(record) {
+			atomic.AddInt32(&manager.running, -1)
+		}
+	}
+}
+
+// RecordPool Record a line of a pool connection, in every trace matching one of the miners it belongs to
+func (manager *TraceManager) RecordPool(targets []*TraceTarget, pool string, direction string, line []byte) {
+	if !manager.Active() || len(targets) < 1 {
+		return
+	}
+	now := time.Now()
+	text := redactTraceLine(line)
+
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	for _, trace := range manager.traces {
+		if !trace.Running {
+			continue
+		}
+		for _, target := range targets {
+			if trace.Filter.Match(target) {
+				if !trace.write(&TraceRecord{now, target.SessionID, TraceLinkPool, direction, pool, text, false}) {
+					atomic.AddInt32(&manager.running, -1)
+				}
+				break
+			}
+		}
+	}
+}
+
+// RecordPoolState Record the lines a miner gets from the state of a pool connection when it joins the connection,
+// such as the subscribe response and the last job, so that the trace can be replayed without the earlier traffic
+func (manager *TraceManager) RecordPoolState(target *TraceTarget, pool string, lines [][]byte) {
+	if !manager.Active() {
+		return
+	}
+	now := time.Now()
+
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	for _, trace := range manager.traces {
+		if !trace.Running || !trace.Filter.Match(target) {
+			continue
+		}
+		for _, line := range lines {
+			if line == nil {
+				continue
+			}
+			record := &TraceRecord{now, target.SessionID, TraceLinkPool, TraceDirectionIn, pool, strings.TrimRight(string(line), "\r\n"), true}
+			if !trace.write(record) {
+				atomic.AddInt32(&manager.running, -1)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadTraceRecords Read all records of a trace file
+func ReadTraceRecords(r io.Reader) (records []*TraceRecord, badLines int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		record := new(TraceRecord)
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			// the last line may be truncated if the agent was killed
+			badLines++
+			continue
+		}
+		records = append(records, record)
+	}
+	err = scanner.Err()
+	return
+}
+
+// TraceMinerSessions Lines sent by each miner of the trace, keyed by session ID
+func TraceMinerSessions(records []*TraceRecord) map[uint16][]*TraceRecord {
+	sessions := make(map[uint16][]*TraceRecord)
+	for _, record := range records {
+		if record.Link == TraceLinkMiner && record.Direction == TraceDirectionIn {
+			sessions[record.SessionID] = append(sessions[record.SessionID], record)
+		}
+	}
+	return sessions
+}
+
+// ReplayTraceSession Connect to the agent at addr and send the lines of a miner with their recorded timing,
+// divided by speed. Lines from the agent are passed to onLine until linger after the last line is sent.
+func ReplayTraceSession(addr string, records []*TraceRecord, speed float64, linger time.Duration, onLine func(line string)) error {
+	if len(records) < 1 {
+		return nil
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				onLine(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	first := records[0].Time
+	for _, record := range records {
+		delay := time.Duration(float64(record.Time.Sub(first))/speed) - time.Since(start)
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		_, err = conn.Write([]byte(record.Line + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(linger):
+	}
+	return nil
+}
+
+// RunTraceCommand Subcommand "trace": print a protocol trace, or replay its miner lines against an agent
+func RunTraceCommand(args []string) int {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	agent := flags.String("agent", "", "Replay the miner lines to the agent at host:port, print the trace if empty")
+	speed := flags.Float64("speed", 1, "Replay speed, 2 sends the lines twice as fast as recorded")
+	session := flags.Int("session", -1, "Only print or replay the records of this session ID")
+	linger := flags.Duration("linger", 3*time.Second, "How long to wait for responses after the last line is replayed")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: btcagent trace [options] <trace file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, badLines, err := ReadTraceRecords(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	if badLines > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d malformed lines skipped\n", flags.Arg(0), badLines)
+	}
+	if len(records) < 1 {
+		return 0
+	}
+
+	if *agent == "" {
+		first := records[0].Time
+		for _, record := range records {
+			if *session >= 0 && int(record.SessionID) != *session {
+				continue
+			}
+			peer := record.Link
+			if record.Link == TraceLinkPool {
+				peer += " " + record.Pool
+			}
+			fmt.Printf("%+10.3fs  session %-5d  %-3s  %s  %s\n", record.Time.Sub(first).Seconds(), record.SessionID, record.Direction, peer, record.Line)
+		}
+		return 0
+	}
+
+	sessions := TraceMinerSessions(records)
+	var ids []int
+	for id := range sessions {
+		if *session < 0 || id == uint16(*session) {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+
+	var wg sync.WaitGroup
+	var outputLock sync.Mutex
+	failed := false
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			err := ReplayTraceSession(*agent, sessions[uint16(id)], *speed, *linger, func(line string) {
+				outputLock.Lock()
+				fmt.Printf("session %d <- %s", id, line)
+				outputLock.Unlock()
+			})
+			if err != nil {
+				outputLock.Lock()
+				fmt.Fprintf(os.Stderr, "session %d: %v\n", id, err)
+				failed = true
+				outputLock.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
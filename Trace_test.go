@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTraceCaptureAndCap(t *testing.T) {
+	tracer := NewTraceManager(t.TempDir(), 1024)
+	if tracer.Active() {
+		t.Fatal("no trace should be running")
+	}
+	if _, err := tracer.Start(TraceFilter{}, 0); err == nil {
+		t.Fatal("a trace without filter should be rejected")
+	}
+
+	trace, err := tracer.Start(TraceFilter{Worker: "w1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := &TraceTarget{SessionID: 1, IP: "10.0.0.1", Worker: "w1", FullName: "sub.w1"}
+	other := &TraceTarget{SessionID: 2, IP: "10.0.0.2", Worker: "w2", FullName: "sub.w2"}
+
+	tracer.RecordMiner(traced, TraceDirectionIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`+"\n"))
+	tracer.RecordMiner(other, TraceDirectionIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`+"\n"))
+	tracer.RecordPool([]*TraceTarget{other, traced}, "pool:3333", TraceDirectionIn, []byte(`{"id":null,"method":"mining.set_difficulty","params":[8]}`+"\n"))
+
+	file, err := os.Open(trace.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, badLines, err := ReadTraceRecords(file)
+	file.Close()
+	if err != nil || badLines > 0 || len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d (%d bad lines, %v)", len(records), badLines, err)
+	}
+	if records[0].Link != TraceLinkMiner || records[0].SessionID != 1 || records[0].Line != `{"id":1,"method":"mining.subscribe","params":[]}` {
+		t.Errorf("wrong miner record: %+v", *records[0])
+	}
+	if records[1].Link != TraceLinkPool || records[1].Pool != "pool:3333" || records[1].SessionID != 1 {
+		t.Errorf("wrong pool record: %+v", *records[1])
+	}
+
+	// the trace stops at its size limit
+	for i := 0; i < 20; i++ {
+		tracer.RecordMiner(traced, TraceDirectionOut, []byte(`{"id":null,"method":"mining.notify","params":["1"]}`))
+	}
+	traces := tracer.Traces()
+	if len(traces) != 1 || !traces[0].Capped || traces[0].Running || traces[0].Size > 1024 {
+		t.Fatalf("trace should be capped: %+v", traces)
+	}
+	if tracer.Active() {
+		t.Error("a capped trace should not be running")
+	}
+
+	if _, err := tracer.Stop(100); err == nil {
+		t.Error("stopping an unknown trace should fail")
+	}
+}
+
+func TestTraceRedactsPassword(t *testing.T) {
+	tests := []struct {
+		line     string
+		redacted string
+	}{
+		{`{"id":2,"method":"mining.authorize","params":["sub.w1","secret"]}` + "\n", `{"id":2,"method":"mining.authorize","params":["sub.w1","******"]}`},
+		{`{"id":2,"method":"mining.authorize","params":["sub.w1",""]}`, `{"id":2,"method":"mining.authorize","params":["sub.w1",""]}`},
+		{`{"id":2,"method":"mining.authorize","params":["sub.w1"]}`, `{"id":2,"method":"mining.authorize","params":["sub.w1"]}`},
+		{`{"id":3,"method":"mining.submit","params":["sub.w1","1","00","5f","0"]}`, `{"id":3,"method":"mining.submit","params":["sub.w1","1","00","5f","0"]}`},
+	}
+	for _, test := range tests {
+		if redacted := redactTraceLine([]byte(test.line)); redacted != test.redacted {
+			t.Errorf("%s redacted as %s", test.line, redacted)
+		}
+	}
+}
+
+func TestReplayTraceSession(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// echo server
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			conn.Write(line)
+		}
+	}()
+
+	start := time.Now()
+	records := []*TraceRecord{
+		{Time: start, Link: TraceLinkMiner, Direction: TraceDirectionIn, Line: `{"id":1}`},
+		{Time: start.Add(200 * time.Millisecond), Link: TraceLinkMiner, Direction: TraceDirectionIn, Line: `{"id":2}`},
+	}
+
+	var lines []string
+	err = ReplayTraceSession(listener.Addr().String(), records, 2, 200*time.Millisecond, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[1] != "{\"id\":2}\n" {
+		t.Errorf("wrong replayed lines: %q", lines)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("recorded timing not kept, replay took %v", elapsed)
+	}
+}
@@ -3,18 +3,22 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
 )
 
 type UpSessionBTC struct {
-	id string // Connection identifier for printing logs
+	log *Logger // Logger with the pool connection context
 
 	manager *UpSessionManager
 	config  *Config
@@ -22,13 +26,21 @@ type UpSessionBTC struct {
 
 	subAccount string
 	poolIndex  int
+	poolHost   string // the configured pool, or the host of client.reconnect
+	poolPort   uint16
+	poolURL    string // host:port, with the tls:// prefix for TLS connections
+
+	redirectTimer *time.Timer // returns to the configured pools after following client.reconnect
+	replacedBy    UpSession   // the new connection after a redirection, it gets the events of the miners
 
 	downSessions    map[uint16]*DownSessionBTC
 	serverConn      net.Conn
-	serverReader    *bufio.Reader
+	serverReader    *LineReader
 	readLoopRunning bool
+	malformedLines  uint64 // lines from the pool that cannot be decoded, even after fixing known quirks
 
 	stat            AuthorizeStat
+	readStat        uint32 // copy of stat for the read goroutine, accessed atomically
 	sessionID       uint32
 	versionMask     uint32
 	extraNonce2Size int
@@ -38,16 +50,44 @@ type UpSessionBTC struct {
 
 	eventLoopRunning bool
 	eventChannel     chan interface{}
+	eventLock        sync.RWMutex  // held by the senders, so no event is queued after eventClosed is set
+	eventClosed      bool          // the event loop has stopped, later events are dropped
+	eventDone        chan struct{} // closed with the event loop, releases the senders waiting for space
+	exiting          bool          // UpSessionManager is exiting, nobody can take the miners
+
+	// Miners that left this connection. They are answered if their events arrive after it is closed.
+	movedDownSessions map[uint16]DownSession
 
 	lastJob           *StratumJobBTC
+	rpcSubscribe      []byte // the subscribe response and the last mining.notify, as received
+	rpcNotify         []byte
 	rpcSetVersionMask []byte
 	rpcSetDifficulty  []byte
+	difficulty        float64
+
+	minDifficulties     map[uint16]float64 // minimum difficulties suggested by the miners
+	suggestedDifficulty float64            // the last difficulty sent to the pool with mining.suggest_difficulty
+	suggestUnsupported  bool               // the pool answered mining.suggest_difficulty with an error
 
 	submitIDs   map[uint16]SubmitID
 	submitIndex uint16
 
+	// Shares submitted during a pool outage
+	recentJobIDs  map[string]bool // jobs since the last clean notify, shares of other jobs are stale
+	pendingReplay []*ReplayShareBTC
+	resumeSession *PoolSessionBTC // the lost session of the slot, asked for with mining.subscribe
+	resumed       bool            // the pool gave the extranonce1 of resumeSession back
+	cleanJob      bool            // a clean job was received, jobs of the resumed session are stale unless sent again
+
 	// Used for statistics to disconnect the number of miners, and synchronize to UpsessionManager
 	disconnectedMinerCounter int
+
+	// Liveness watchdog
+	watchdogStop   chan bool
+	lastNotifyTime time.Time
+	lastPingTime   time.Time
+	lastPongTime   time.Time
+	lastDegraded   time.Time
 }
 
 func NewUpSessionBTC(manager *UpSessionManager, poolIndex int, slot int) (up *UpSessionBTC) {
@@ -58,77 +98,134 @@ func NewUpSessionBTC(manager *UpSessionManager, poolIndex int, slot int) (up *Up
 	up.subAccount = manager.subAccount
 	up.poolIndex = poolIndex
 	up.downSessions = make(map[uint16]*DownSessionBTC)
-	up.stat = StatDisconnected
+	up.minDifficulties = make(map[uint16]float64)
+	up.setStat(StatDisconnected)
 	up.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSession)
+	up.eventDone = make(chan struct{})
+	up.movedDownSessions = make(map[uint16]DownSession)
 	up.submitIDs = make(map[uint16]SubmitID)
+	up.recentJobIDs = make(map[string]bool)
+	up.resumeSession, _ = manager.resumeSessions[slot].Load().(*PoolSessionBTC)
 
 	if !up.config.MultiUserMode {
 		up.subAccount = manager.config.Pools[poolIndex].SubAccount
 	}
 
+	pool := manager.config.Pools[poolIndex]
+	up.setPoolAddress(pool.Host, pool.Port)
+
 	return
 }
 
+// NewRedirectedUpSessionBTC A pool connection to the host given by client.reconnect. The proxies, TLS
+// settings and sub-account of the configured pool are kept.
+func NewRedirectedUpSessionBTC(manager *UpSessionManager, poolIndex int, slot int, host string, port uint16) (up *UpSessionBTC) {
+	up = NewUpSessionBTC(manager, poolIndex, slot)
+	up.setPoolAddress(host, port)
+	return
+}
+
+func (up *UpSessionBTC) setPoolAddress(host string, port uint16) {
+	up.poolHost = host
+	up.poolPort = port
+	poolURL := fmt.Sprintf("%s:%d", host, port)
+	if up.config.PoolUseTls {
+		poolURL = "tls://" + poolURL
+	}
+	up.poolURL = poolURL
+	up.log = NewLogger("sub_account", up.subAccount, "pool_slot", up.slot, "pool", poolURL)
+}
+
+// isRedirected Whether the session follows client.reconnect to another host than the configured pool
+func (up *UpSessionBTC) isRedirected() bool {
+	pool := up.config.Pools[up.poolIndex]
+	return up.poolHost != pool.Host || up.poolPort != pool.Port
+}
+
 func (up *UpSessionBTC) Stat() AuthorizeStat {
 	return up.stat
 }
 
-func (up *UpSessionBTC) connect() {
-	pool := up.config.Pools[up.poolIndex]
-	url := fmt.Sprintf("%s:%d", pool.Host, pool.Port)
+func (up *UpSessionBTC) setStat(stat AuthorizeStat) {
+	up.stat = stat
+	atomic.StoreUint32(&up.readStat, uint32(stat))
+}
 
-	if up.config.PoolUseTls {
-		up.id = fmt.Sprintf("pool#%d <%s> [tls://%s] ", up.slot, up.subAccount, url)
-	} else {
-		up.id = fmt.Sprintf("pool#%d <%s> [%s] ", up.slot, up.subAccount, url)
+// connectCandidates The proxies to try in order, "" is the direct connection.
+// The first racing candidates are started at once.
+func (up *UpSessionBTC) connectCandidates() (candidates []string, racing int) {
+	// Proxies ordered by the proxy manager, the best one first
+	proxies := up.config.proxyManager.Candidates()
+	if len(proxies) < 1 {
+		return []string{""}, 1
 	}
 
-	// Try to connect to all proxies and find the fastest one
-	counter := len(up.config.Proxy)
-	for i := 0; i < counter; i++ {
-		go up.tryConnect(pool.Host, url, up.config.Proxy[i])
-	}
+	// The best proxy may race with the direct connection
+	candidates = append(candidates, proxies[0])
 	if up.config.DirectConnectWithProxy {
-		counter++
-		go up.tryConnect(pool.Host, url, "")
+		candidates = append(candidates, "")
 	}
+	racing = len(candidates)
 
-	// Receive connection event
-	for i := 0; i < counter; i++ {
-		event := <-up.eventChannel
-		switch e := event.(type) {
-		case EventUpSessionConnection:
+	candidates = append(candidates, proxies[1:]...)
+	if up.config.DirectConnectAfterProxy && !up.config.DirectConnectWithProxy {
+		candidates = append(candidates, "")
+	}
+	return
+}
+
+func (up *UpSessionBTC) connect() {
+	host := up.poolHost
+	url := fmt.Sprintf("%s:%d", host, up.poolPort)
+	candidates, racing := up.connectCandidates()
+
+	started := 0
+	startNext := func() {
+		go up.tryConnect(host, url, candidates[started])
+		started++
+	}
+	for started < racing {
+		startNext()
+	}
+
+	// The next candidate is started when all running attempts failed,
+	// or when they are still running after the fallback delay.
+	// Late connections are closed by outdatedUpSessionConnection().
+	fallback := time.NewTimer(UpSessionConnectFallbackDelay)
+	defer fallback.Stop()
+
+	for finished := 0; finished < started; {
+		select {
+		case event := <-up.eventChannel:
+			e, ok := event.(EventUpSessionConnection)
+			if !ok {
+				up.log.Error("unknown event: ", event)
+				continue
+			}
+			finished++
 			up.upSessionConnection(e)
 			if up.stat == StatConnected {
 				return
 			}
-		default:
-			glog.Error(up.id, "unknown event: ", e)
+			if finished == started && started < len(candidates) {
+				startNext()
+				fallback.Reset(UpSessionConnectFallbackDelay)
+			}
+		case <-fallback.C:
+			if started < len(candidates) {
+				startNext()
+				fallback.Reset(UpSessionConnectFallbackDelay)
+			}
 		}
 	}
-
-	// No need to try directly
-	if counter > 0 && !up.config.DirectConnectAfterProxy {
-		return
-	}
-
-	// Try directly to
-	go up.tryConnect(pool.Host, url, "")
-	event := <-up.eventChannel
-	switch e := event.(type) {
-	case EventUpSessionConnection:
-		up.upSessionConnection(e)
-	default:
-		glog.Error(up.id, "unknown event: ", e)
-	}
 }
 
 func (up *UpSessionBTC) upSessionConnection(e EventUpSessionConnection) {
 	if e.Error != nil {
 		if len(e.ProxyURL) > 0 {
-			glog.Warning(up.id, "proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
+			up.log.Warning("proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
 		} else {
-			glog.Warning(up.id, "direct connection failed: ", e.Error.Error())
+			up.log.Warning("direct connection failed: ", e.Error.Error())
 		}
 
 		if e.Conn != nil {
@@ -138,19 +235,20 @@ func (up *UpSessionBTC) upSessionConnection(e EventUpSessionConnection) {
 	}
 
 	up.serverConn = e.Conn
-	up.serverReader = e.Reader
-	up.stat = StatConnected
-	up.id += fmt.Sprintf("(%s) ", up.serverConn.RemoteAddr().String())
+	up.serverReader = NewLineReader(e.Reader, int(up.config.Advanced.PoolMaxLineBytes))
+	up.setStat(StatConnected)
+	up.log = up.log.With("remote_addr", up.serverConn.RemoteAddr().String())
 
 	if len(e.ProxyURL) > 0 {
-		glog.Info(up.id, "successfully connected with proxy [", e.ProxyURL, "]")
+		up.log.Info("successfully connected with proxy [", e.ProxyURL, "]")
 	} else {
-		glog.Info(up.id, "successfully connected directly")
+		up.log.Info("successfully connected directly")
 	}
 }
 
 func (up *UpSessionBTC) tryConnect(poolHost, poolURL, proxyURL string) {
 	timeout := up.config.Advanced.PoolConnectionDialTimeoutSeconds.Get()
+	keepAlive := up.config.Advanced.PoolTCPKeepAliveSeconds.Get()
 	insecureSkipVerify := up.config.Advanced.TLSSkipCertificateVerify
 
 	var err error
@@ -159,22 +257,27 @@ func (up *UpSessionBTC) tryConnect(poolHost, poolURL, proxyURL string) {
 	var reader *bufio.Reader
 
 	if len(proxyURL) > 0 {
-		glog.Info(up.id, "connect to pool server with proxy [", proxyURL, "]...")
-		dialer, err = GetProxyDialer(proxyURL, timeout, insecureSkipVerify)
+		up.log.Info("connect to pool server with proxy [", proxyURL, "]...")
+		dialer, err = GetProxyDialer(proxyURL, timeout, keepAlive, insecureSkipVerify, up.config.ProxyLocalDNS, up.config.resolver)
+	} else if up.config.poolDialer != nil {
+		dialer = up.config.poolDialer
 	} else {
-		glog.Info(up.id, "connect to pool server directly...")
-		dialer = &net.Dialer{Timeout: timeout}
+		up.log.Info("connect to pool server directly...")
+		directDialer := NewHappyEyeballsDialer(up.config.resolver, timeout)
+		directDialer.KeepAlive = DialerKeepAlive(keepAlive)
+		dialer = directDialer
 	}
 
 	if err == nil {
+		start := time.Now()
 		conn, err = dialer.Dial("tcp", poolURL)
+		if len(proxyURL) > 0 {
+			up.config.proxyManager.Report(proxyURL, time.Since(start), err)
+		}
+		if err == nil && up.config.PoolUseTls {
+			conn, err = up.tlsHandshake(conn, poolHost, poolURL, timeout)
+		}
 		if err == nil {
-			if up.config.PoolUseTls {
-				conn = tls.Client(conn, &tls.Config{
-					ServerName:         poolHost,
-					InsecureSkipVerify: insecureSkipVerify,
-				})
-			}
 			reader, err = up.testConnection(conn)
 		}
 	}
@@ -182,6 +285,34 @@ func (up *UpSessionBTC) tryConnect(poolHost, poolURL, proxyURL string) {
 	up.SendEvent(EventUpSessionConnection{proxyURL, conn, reader, err})
 }
 
+func (up *UpSessionBTC) tlsHandshake(conn net.Conn, poolHost, poolURL string, timeout time.Duration) (net.Conn, error) {
+	tlsConfig := up.config.Pools[up.poolIndex].tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: up.config.Advanced.TLSSkipCertificateVerify}
+	}
+	if up.isRedirected() {
+		tlsConfig = RedirectTLSConfig(tlsConfig, poolHost)
+	}
+
+	tlsConn, err := PoolTLSHandshake(conn, tlsConfig, poolHost, timeout)
+	if err != nil {
+		if IsTLSVerifyError(err) {
+			metricUpSessionTLS.Add(MetricKey(poolURL, "verify_failed"), 1)
+			up.log.Error("[SECURITY] TLS certificate verification failed, possible man-in-the-middle attack: ", err.Error())
+		} else {
+			metricUpSessionTLS.Add(MetricKey(poolURL, "handshake_failed"), 1)
+		}
+		return tlsConn, err
+	}
+
+	metricUpSessionTLS.Add(MetricKey(poolURL, "handshake_success"), 1)
+	if glog.V(3) {
+		state := tlsConn.ConnectionState()
+		up.log.Info("TLS handshake finished, version: ", tls.VersionName(state.Version), ", cipher suite: ", tls.CipherSuiteName(state.CipherSuite))
+	}
+	return tlsConn, nil
+}
+
 func (up *UpSessionBTC) testConnection(conn net.Conn) (reader *bufio.Reader, err error) {
 	ch := make(chan error, 1)
 	reader = bufio.NewReader(conn)
@@ -191,7 +322,7 @@ func (up *UpSessionBTC) testConnection(conn net.Conn) (reader *bufio.Reader, err
 		// bytes, e := capsRequest.ToJSONBytesLine()
 		// if e == nil {
 		// 	if glog.V(10) {
-		// 		glog.Info(up.id, "testConnection send: ", string(bytes))
+		// 		up.log.Info("testConnection send: ", string(bytes))
 		// 	}
 		// 	conn.SetWriteDeadline(up.getIODeadLine())
 		// 	_, e = conn.Write(bytes)
@@ -199,7 +330,7 @@ func (up *UpSessionBTC) testConnection(conn net.Conn) (reader *bufio.Reader, err
 		// 		conn.SetReadDeadline(up.getIODeadLine())
 		// 		bytes, e = reader.ReadBytes('\n')
 		// 		if glog.V(9) {
-		// 			glog.Info(up.id, "testConnection recv: ", string(bytes))
+		// 			up.log.Info("testConnection recv: ", string(bytes))
 		// 		}
 		// 	}
 		// }
@@ -223,17 +354,53 @@ func (up *UpSessionBTC) writeJSONRequest(jsonData *JSONRPCRequest) (int, error)
 		return 0, err
 	}
 	if glog.V(10) {
-		glog.Info(up.id, "writeJSONRequest: ", string(bytes))
+		up.log.Info("writeJSONRequest: ", string(bytes))
+	}
+	return up.writeBytes(bytes)
+}
+
+func (up *UpSessionBTC) writeJSONResponse(jsonData *JSONRPCResponse) (int, error) {
+	bytes, err := jsonData.ToJSONBytesLine()
+	if err != nil {
+		return 0, err
+	}
+	if glog.V(10) {
+		up.log.Info("writeJSONResponse: ", string(bytes))
 	}
 	return up.writeBytes(bytes)
 }
 
 func (up *UpSessionBTC) writeBytes(bytes []byte) (int, error) {
-	glog.Info("writeBytes before DeadLine: ", string(bytes))
+	return up.writeBytesOf(nil, bytes)
+}
+
+// writeBytesOf Send a line sent for the miner, or for all miners of the connection if down is nil
+func (up *UpSessionBTC) writeBytesOf(down *DownSessionBTC, bytes []byte) (int, error) {
+	if glog.V(12) {
+		up.log.Info("writeBytes: ", string(bytes))
+	}
+	up.traceLine(down, TraceDirectionOut, bytes)
 	up.setWriteDeadline()
 	return up.serverConn.Write(bytes)
 }
 
+// traceLine Record a pool line in the protocol traces of the miner, or of all miners of the connection if down is nil
+func (up *UpSessionBTC) traceLine(down *DownSessionBTC, direction string, line []byte) {
+	tracer := up.config.traceManager
+	if !tracer.Active() {
+		return
+	}
+	var targets []*TraceTarget
+	if down != nil {
+		targets = append(targets, down.TraceTarget())
+	} else {
+		for _, down := range up.downSessions {
+			targets = append(targets, down.TraceTarget())
+		}
+	}
+	tracer.RecordPool(targets, up.poolURL, direction, line)
+}
+
 func (up *UpSessionBTC) getAgentGetCapsRequest(id string) (req JSONRPCRequest) {
 	req.ID = id
 	req.Method = "mining.capabilities"
@@ -263,10 +430,15 @@ func (up *UpSessionBTC) sendInitRequest() (err error) {
 		return
 	}
 
-	// send subscribe request
+	// send subscribe request, with the extranonce1 of the lost session to resume it
 	request.ID = "sub"
 	request.Method = "mining.subscribe"
-	request.SetParams(UpSessionUserAgent)
+	if up.resumeSession != nil && up.resumeSession.Pool == fmt.Sprintf("%s:%d", up.poolHost, up.poolPort) {
+		request.SetParams(UpSessionUserAgent, Uint32ToHex(up.resumeSession.SessionID))
+	} else {
+		up.resumeSession = nil
+		request.SetParams(UpSessionUserAgent)
+	}
 	_, err = up.writeJSONRequest(&request)
 	if err != nil {
 		return
@@ -290,40 +462,64 @@ func (up *UpSessionBTC) sendInitRequest() (err error) {
 }
 
 func (up *UpSessionBTC) exit() {
-	up.stat = StatExit
+	up.exiting = true
+	up.setStat(StatExit)
 	up.close()
 }
 
 func (up *UpSessionBTC) close() {
 	if up.stat == StatAuthorized {
-		up.manager.SendEvent(EventUpSessionBroken{up.slot})
+		up.manager.SendEvent(EventUpSessionBroken{up.slot, up})
 	}
 
-	if up.config.AlwaysKeepDownconn {
-		if up.lastJob != nil {
-			up.manager.SendEvent(EventUpdateFakeJobBTC{up.lastJob})
+	if up.stat == StatAuthorized && up.replacedBy == nil {
+		// the jobs stay valid if the next connection of the slot resumes the session
+		pool := &PoolSessionBTC{fmt.Sprintf("%s:%d", up.poolHost, up.poolPort), up.sessionID, up.recentJobIDs}
+		up.manager.resumeSessions[up.slot].Store(pool)
+
+		if up.config.AlwaysKeepDownconn && up.lastJob != nil {
+			downSessions := make([]uint16, 0, len(up.downSessions))
+			for sessionID := range up.downSessions {
+				downSessions = append(downSessions, sessionID)
+			}
+			up.manager.SendEvent(EventUpdateFakeJobBTC{up.lastJob, pool, downSessions})
 		}
-		for _, down := range up.downSessions {
-			go up.manager.SendEvent(EventAddDownSession{down})
+	}
+
+	// the pool will not respond to the shares waiting for it
+	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
+		for index, submit := range up.submitIDs {
+			if !submit.Replay {
+				up.sendSubmitResponse(submit.SessionID, submit.ID, STATUS_JOB_NOT_FOUND_OR_STALE)
+			}
+			delete(up.submitIDs, index)
 		}
-	} else {
+	}
+
+	if up.stat == StatExit {
+		// UpSessionManager is exiting, nobody can take the miners
 		for _, down := range up.downSessions {
-			go down.SendEvent(EventExit{})
+			down.SendEvent(EventExit{})
 		}
+	} else {
+		up.migrateDownSessions()
 	}
 
+	up.stopTimers()
+
 	up.eventLoopRunning = false
-	up.stat = StatDisconnected
+	up.setStat(StatDisconnected)
 	up.serverConn.Close()
+	up.closeEvents()
 }
 
 func (up *UpSessionBTC) Init() {
 	up.connect()
 	if up.stat != StatConnected {
 		if len(up.config.Proxy) > 0 && (up.config.DirectConnectWithProxy || up.config.DirectConnectAfterProxy) {
-			glog.Error(up.id, "all connections both proxy and direct failed")
+			up.log.Error("all connections both proxy and direct failed")
 		} else if len(up.config.Proxy) > 1 {
-			glog.Error(up.id, "all proxy connections failed")
+			up.log.Error("all proxy connections failed")
 		}
 		return
 	}
@@ -332,7 +528,7 @@ func (up *UpSessionBTC) Init() {
 
 	err := up.sendInitRequest()
 	if err != nil {
-		glog.Error(up.id, "failed to send request to pool server: ", err.Error())
+		up.log.Error("failed to send request to pool server: ", err.Error())
 		up.close()
 		return
 	}
@@ -344,105 +540,179 @@ func (up *UpSessionBTC) handleSetVersionMask(rpcData *JSONRPCLineBTC, jsonBytes
 	up.rpcSetVersionMask = jsonBytes
 
 	if len(rpcData.Params) > 0 {
-		if up.serverCapVersionRolling {
-			versionMaskHex, ok := rpcData.Params[0].(string)
-			if !ok {
-				glog.Error(up.id, "version mask is not a string: ", string(jsonBytes))
-				return
-			}
-			versionMask, err := strconv.ParseUint(versionMaskHex, 16, 32)
-			if err != nil {
-				glog.Error(up.id, "version mask is not a hex: ", string(jsonBytes))
-				return
-			}
-			up.versionMask = uint32(versionMask)
-
-			if glog.V(1) {
-				glog.Info(up.id, "AsicBoost via BTCAgent enabled, allowed version mask: ", versionMaskHex)
-			}
-		} else {
-			// server doesn't support version rolling via BTCAgent
-			up.versionMask = 0
-			rpcData.Params[0] = "00000000"
+		versionMaskHex, ok := rpcData.Params[0].(string)
+		if !ok {
+			up.log.Error("version mask is not a string: ", string(jsonBytes))
+			return
+		}
+		versionMask, err := strconv.ParseUint(versionMaskHex, 16, 32)
+		if err != nil {
+			up.log.Error("version mask is not a hex: ", string(jsonBytes))
+			return
 		}
+		// The pool only sends it if it supports version rolling
+		up.serverCapVersionRolling = true
+		up.setVersionMask(uint32(versionMask))
+	}
+}
+
+// setVersionMask The mask allowed by the pool, the miners get their part of it
+func (up *UpSessionBTC) setVersionMask(versionMask uint32) {
+	up.versionMask = versionMask
+	if glog.V(1) && versionMask != 0 {
+		up.log.Info("AsicBoost via BTCAgent enabled, allowed version mask: ", Uint32ToHex(versionMask))
 	}
 
-	e := EventSendBytes{up.rpcSetVersionMask}
 	for _, down := range up.downSessions {
-		if down.versionMask != 0 {
-			go down.SendEvent(e)
-		}
+		down.SendEvent(EventSetVersionMask{up.versionMask})
 	}
 }
 
 func (up *UpSessionBTC) handleSetDifficulty(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	if up.rpcSetDifficulty == nil {
+	previous := up.difficulty
+	if len(rpcData.Params) > 0 {
+		if difficulty, ok := rpcData.Params[0].(float64); ok {
+			up.difficulty = difficulty
+		}
+	}
+
+	// Later changes are also sent, the pool may follow mining.suggest_difficulty
+	if up.rpcSetDifficulty == nil || up.difficulty != previous {
 		up.rpcSetDifficulty = jsonBytes
 
-		e := EventSendBytes{up.rpcSetDifficulty}
 		for _, down := range up.downSessions {
-			go down.SendEvent(e)
+			down.SendEvent(EventSendBytes{up.rpcSetDifficulty})
 		}
 	}
 }
 
+func (up *UpSessionBTC) suggestDifficulty(e EventSuggestDifficulty) {
+	if _, ok := up.downSessions[e.SessionID]; !ok {
+		return
+	}
+	up.minDifficulties[e.SessionID] = e.Difficulty
+	up.sendSuggestDifficulty()
+}
+
+// sendSuggestDifficulty Ask the pool for the minimum difficulty of the miners.
+// The agent has no vardiff and the pool credits shares with its own difficulty, so the miners
+// only get a higher difficulty once the pool sets it. The pool difficulty is shared by all miners
+// of the connection, it is not suggested while a miner without a minimum is on the connection.
+func (up *UpSessionBTC) sendSuggestDifficulty() {
+	if up.stat != StatAuthorized || up.suggestUnsupported || len(up.downSessions) < 1 {
+		return
+	}
+	var difficulty float64
+	for sessionID := range up.downSessions {
+		minDifficulty, ok := up.minDifficulties[sessionID]
+		if !ok {
+			return
+		}
+		if minDifficulty > difficulty {
+			difficulty = minDifficulty
+		}
+	}
+	// Also sent when the minimum decreases after a miner left
+	if difficulty == up.suggestedDifficulty {
+		return
+	}
+	up.suggestedDifficulty = difficulty
+
+	var request JSONRPCRequest
+	request.ID = "suggest_diff"
+	request.Method = "mining.suggest_difficulty"
+	request.SetParams(difficulty)
+	_, err := up.writeJSONRequest(&request)
+	if err != nil {
+		up.log.Error("failed to send mining.suggest_difficulty: ", err.Error())
+	}
+}
+
 func (up *UpSessionBTC) handleSubScribeResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
 	result, ok := rpcData.Result.([]interface{})
 	if !ok {
-		glog.Error(up.id, "subscribe result is not an array: ", string(jsonBytes))
+		up.log.Error("subscribe result is not an array: ", string(jsonBytes))
 		up.close()
 		return
 	}
 	if len(result) < 3 {
-		glog.Error(up.id, "subscribe result missing items: ", string(jsonBytes))
+		up.log.Error("subscribe result missing items: ", string(jsonBytes))
 		up.close()
 		return
 	}
 	sessionIDHex, ok := result[1].(string)
 	if !ok {
-		glog.Error(up.id, "session id is not a string: ", string(jsonBytes))
+		up.log.Error("session id is not a string: ", string(jsonBytes))
 		up.close()
 		return
 	}
 	sessionID, err := strconv.ParseUint(sessionIDHex, 16, 32)
 	if err != nil {
-		glog.Error(up.id, "session id is not a hex: ", string(jsonBytes))
+		up.log.Error("session id is not a hex: ", string(jsonBytes))
 		up.close()
 		return
 	}
 	up.sessionID = uint32(sessionID)
+	if up.resumeSession != nil {
+		up.resumed = up.sessionID == up.resumeSession.SessionID
+		if up.resumed {
+			metricShareReplay.Add("resumed_sessions", 1)
+			up.log.Info("pool session ", sessionIDHex, " resumed")
+		} else {
+			metricShareReplay.Add("new_sessions", 1)
+			up.log.Info("pool session ", Uint32ToHex(up.resumeSession.SessionID), " not resumed, new session: ", sessionIDHex)
+		}
+	}
 
 	extraNonce2SizeFloat, ok := result[2].(float64)
 	if !ok {
-		glog.Error(up.id, "extra nonce 2 size is not an integer: ", string(jsonBytes))
+		up.log.Error("extra nonce 2 size is not an integer: ", string(jsonBytes))
 		up.close()
 		return
 	}
 	up.extraNonce2Size = int(extraNonce2SizeFloat)
+	up.rpcSubscribe = jsonBytes
 	if up.extraNonce2Size != 4 {
-		glog.Error(up.id, "BTCAgent is not compatible with this server, extra nonce 2 should be 4 bytes but only ", up.extraNonce2Size, " bytes")
+		up.log.Error("BTCAgent is not compatible with this server, extra nonce 2 should be 4 bytes but only ", up.extraNonce2Size, " bytes")
 		up.close()
 		return
 	}
-	up.stat = StatSubScribed
+	up.setStat(StatSubScribed)
 }
 
 func (up *UpSessionBTC) handleConfigureResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	// ignore
+	// {"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}
+	result, ok := rpcData.Result.(map[string]interface{})
+	if !ok {
+		up.log.Warning("pool server does not support mining.configure, AsicBoost disabled: ", string(jsonBytes))
+		return
+	}
+	if enabled, _ := result["version-rolling"].(bool); !enabled {
+		up.log.Warning("pool server does not support version rolling, AsicBoost disabled")
+		return
+	}
+	versionMaskHex, _ := result["version-rolling.mask"].(string)
+	versionMask, err := strconv.ParseUint(versionMaskHex, 16, 32)
+	if err != nil {
+		up.log.Error("version mask is not a hex: ", string(jsonBytes))
+		return
+	}
+	up.serverCapVersionRolling = true
+	up.setVersionMask(uint32(versionMask))
 }
 
 func (up *UpSessionBTC) handleGetCapsResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
 	result, ok := rpcData.Result.(map[string]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, result is not an object: ", string(jsonBytes))
+		up.log.Error("get server capabilities failed, result is not an object: ", string(jsonBytes))
 	}
 	caps, ok := result["capabilities"]
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, missing field capabilities: ", string(jsonBytes))
+		up.log.Error("get server capabilities failed, missing field capabilities: ", string(jsonBytes))
 	}
 	capsArr, ok := caps.([]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
+		up.log.Error("get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
 	}
 	for _, capability := range capsArr {
 		switch capability {
@@ -453,15 +723,15 @@ func (up *UpSessionBTC) handleGetCapsResponse(rpcData *JSONRPCLineBTC, jsonBytes
 		}
 	}
 	if !up.serverCapVersionRolling {
-		glog.Warning(up.id, "[WARNING] pool server does not support ASICBoost")
+		up.log.Warning("[WARNING] pool server does not support ASICBoost")
 	}
 	if up.config.SubmitResponseFromServer {
 		if up.serverCapSubmitResponse {
 			if glog.V(1) {
-				glog.Info(up.id, "pool server will send share response to BTCAgent")
+				up.log.Info("pool server will send share response to BTCAgent")
 			}
 		} else {
-			glog.Warning(up.id, "[WARNING] pool server does not support sendding share response to BTCAgent")
+			up.log.Warning("[WARNING] pool server does not support sendding share response to BTCAgent")
 		}
 	}
 }
@@ -469,12 +739,13 @@ func (up *UpSessionBTC) handleGetCapsResponse(rpcData *JSONRPCLineBTC, jsonBytes
 func (up *UpSessionBTC) handleAuthorizeResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
 	result, ok := rpcData.Result.(bool)
 	if !ok || !result {
-		glog.Error(up.id, "authorize failed: ", rpcData.Error)
+		up.log.Error("authorize failed: ", rpcData.Error)
 		up.close()
 		return
 	}
-	glog.Info(up.id, "authorize success, session id: ", up.sessionID)
-	up.stat = StatAuthorized
+	up.log.Info("authorize success, session id: ", up.sessionID)
+	up.setStat(StatAuthorized)
+	up.sendSuggestDifficulty()
 	//Let the init () function returns
 	up.eventLoopRunning = false
 }
@@ -486,7 +757,7 @@ func (up *UpSessionBTC) connBroken() {
 
 func (up *UpSessionBTC) getIODeadLine() time.Time {
 	var timeout Seconds
-	if up.stat == StatAuthorized {
+	if AuthorizeStat(atomic.LoadUint32(&up.readStat)) == StatAuthorized {
 		timeout = up.config.Advanced.PoolConnectionReadTimeoutSeconds
 	} else {
 		timeout = up.config.Advanced.PoolConnectionDialTimeoutSeconds
@@ -511,44 +782,359 @@ func (up *UpSessionBTC) handleResponse() {
 }
 
 func (up *UpSessionBTC) readLine() {
-	jsonBytes, err := up.serverReader.ReadBytes('\n')
+	jsonBytes, err := up.serverReader.ReadLine()
 	if err != nil {
-		glog.Error(up.id, "failed to read JSON line from pool server: ", err.Error())
+		if err == ErrLineTooLong {
+			metricUpSessionParse.Add("line_too_long", 1)
+			up.log.Error("line from pool server exceeds ", up.config.Advanced.PoolMaxLineBytes, " bytes")
+		} else {
+			up.log.Error("failed to read JSON line from pool server: ", err.Error())
+		}
 		up.connBroken()
 		return
 	}
 	if glog.V(9) {
-		glog.Info(up.id, "readLine: ", string(jsonBytes))
+		up.log.Info("readLine: ", string(jsonBytes))
 	}
 
-	jsonBytes = []byte(strings.Replace(string(jsonBytes), ":auth", ":\"auth\"", 1))
-	rpcData, err := NewJSONRPCLineBTC(jsonBytes)
+	rpcData, jsonBytes, quirks, err := ParsePoolJSONRPCLine(jsonBytes)
 
 	// ignore the json decode error
 	if err != nil {
-		glog.Error(up.id, "failed to decode JSON line from pool server: ", err.Error(), "; ", string(jsonBytes))
+		up.malformedLines++
+		metricUpSessionParse.Add("malformed_lines", 1)
+		up.log.Every("pool.decode_error", LogRateLimitSeconds.Get()).Error("failed to decode JSON line from pool server (", up.malformedLines, " malformed lines): ", err.Error(), "; ", string(jsonBytes))
 		return
 	}
+	for _, quirk := range quirks {
+		metricUpSessionParse.Add(MetricKey("quirk", quirk), 1)
+	}
+	if len(quirks) > 0 && glog.V(3) {
+		up.log.Info("fixed pool quirks ", quirks, ": ", string(jsonBytes))
+	}
 
 	up.SendEvent(EventRecvJSONRPCBTC{rpcData, jsonBytes})
 }
 
 func (up *UpSessionBTC) Run() {
+	now := time.Now()
+	up.lastNotifyTime = now
+	up.lastPongTime = now
+
+	up.watchdogStop = make(chan bool)
+	go up.watchdogTicker(up.watchdogStop)
+
+	if up.isRedirected() {
+		up.redirectTimer = time.AfterFunc(up.config.Advanced.PoolRedirectSeconds.Get(), func() { up.SendEvent(EventRedirectExpired{}) })
+	}
+
 	up.handleEvent()
 }
 
+func (up *UpSessionBTC) watchdogTicker(stop chan bool) {
+	interval := UpSessionCheckAliveInterval
+	// A shorter notify timeout is checked as often, so the miners are not left longer on a silent connection
+	if timeout := up.config.Advanced.PoolNotifyTimeoutSeconds.Get(); timeout > 0 && timeout < interval {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			up.SendEvent(EventCheckAlive{})
+		}
+	}
+}
+
+func (up *UpSessionBTC) checkAlive() {
+	now := time.Now()
+
+	pingMethod := up.config.Advanced.PoolPing.Method
+	pingInterval := up.config.Advanced.PoolPing.IntervalSeconds.Get()
+	if len(pingMethod) > 0 && pingInterval > 0 && now.Sub(up.lastPingTime) >= pingInterval {
+		up.sendPing(pingMethod)
+	}
+
+	notifyTimeout := up.config.Advanced.PoolNotifyTimeoutSeconds.Get()
+	// repeat every notifyTimeout, so the miners are moved once another pool connection is ready
+	if notifyTimeout > 0 && now.Sub(up.lastNotifyTime) >= notifyTimeout && now.Sub(up.lastDegraded) >= notifyTimeout {
+		up.lastDegraded = now
+		metricUpSessionHealth.Add("degraded", 1)
+		up.log.Warning("no mining.notify from pool server for ", now.Sub(up.lastNotifyTime).Round(time.Second),
+			", last ping response ", now.Sub(up.lastPongTime).Round(time.Second), " ago, connection degraded")
+		go up.manager.SendEvent(EventUpSessionDegraded{up.slot})
+	}
+}
+
+func (up *UpSessionBTC) sendPing(method string) {
+	var request JSONRPCRequest
+	request.ID = "ping"
+	request.Method = method
+	request.SetParams()
+
+	up.lastPingTime = time.Now()
+	_, err := up.writeJSONRequest(&request)
+	if err != nil {
+		up.log.Error("failed to send ping to pool server: ", err.Error())
+		up.close()
+		return
+	}
+	metricUpSessionHealth.Add("ping_sent", 1)
+}
+
+func (up *UpSessionBTC) handlePingResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	// Any response (even an error) proves that the connection is alive
+	up.lastPongTime = time.Now()
+	metricUpSessionHealth.Add("pong", 1)
+	if glog.V(5) {
+		up.log.Info("ping response after ", up.lastPongTime.Sub(up.lastPingTime), ": ", string(jsonBytes))
+	}
+}
+
+// respondPoolRequest Answer a request of the pool that needs no action of the miners
+func (up *UpSessionBTC) respondPoolRequest(rpcData *JSONRPCLineBTC, result interface{}) {
+	metricUpSessionRequests.Add(rpcData.Method, 1)
+	if rpcData.ID == nil {
+		return
+	}
+	response := JSONRPCResponse{rpcData.ID, result, nil}
+	_, err := up.writeJSONResponse(&response)
+	if err != nil {
+		up.log.Error("failed to respond to ", rpcData.Method, ": ", err.Error())
+		up.close()
+	}
+}
+
+// handleShowMessage Relay the message to the miners, the operator sees it in the log
+func (up *UpSessionBTC) handleShowMessage(rpcData *JSONRPCLineBTC) {
+	up.log.Info("message from pool server: ", rpcData.Params)
+
+	// A notification for the miners, the ID of the pool means nothing to them
+	message := JSONRPCRequest{nil, rpcData.Method, rpcData.Params}
+	bytes, err := message.ToJSONBytesLine()
+	if err == nil {
+		e := EventSendBytes{bytes}
+		for _, down := range up.downSessions {
+			down.SendEvent(e)
+		}
+	} else {
+		up.log.Error("failed to convert client.show_message to JSON: ", err.Error(), "; ", message)
+	}
+
+	up.respondPoolRequest(rpcData, true)
+}
+
+// handleReconnectRequest The pool asks to reconnect, the miners stay connected to the agent.
+//
+//	{"id":null,"method":"client.reconnect","params":["pool2.example.com",3333,0]}
+//
+// The slot connects to the given host (this one if empty), or to the configured pools if redirections are
+// disabled. The miners are moved once the new connection is ready.
+func (up *UpSessionBTC) handleReconnectRequest(rpcData *JSONRPCLineBTC) {
+	metricUpSessionRequests.Add(rpcData.Method, 1)
+	up.log.Warning("pool server requests reconnection: ", rpcData.Params)
+
+	host := up.poolHost
+	port := up.poolPort
+	var wait time.Duration
+	if len(rpcData.Params) > 0 {
+		if str, ok := rpcData.Params[0].(string); ok && len(str) > 0 {
+			host = str
+		}
+	}
+	if len(rpcData.Params) > 1 {
+		switch value := rpcData.Params[1].(type) {
+		case float64:
+			if value > 0 && value <= math.MaxUint16 {
+				port = uint16(value)
+			}
+		case string:
+			if value, err := strconv.ParseUint(value, 10, 16); err == nil && value > 0 {
+				port = uint16(value)
+			}
+		}
+	}
+	if len(rpcData.Params) > 2 {
+		if seconds, ok := rpcData.Params[2].(float64); ok && seconds > 0 {
+			wait = time.Duration(seconds * float64(time.Second))
+			if wait > UpSessionRedirectMaxWait {
+				wait = UpSessionRedirectMaxWait
+			}
+		}
+	}
+
+	pool := up.config.Pools[up.poolIndex]
+	if up.config.Advanced.PoolRedirectSeconds <= 0 || (host == pool.Host && port == pool.Port) {
+		host = ""
+		port = 0
+	}
+	// before EventUpSessionBroken, the pool may close the connection right after the request
+	up.manager.SendEvent(EventUpSessionRedirect{up.slot, up, up.poolIndex, host, port, wait})
+}
+
+// redirectExpired Return to the configured pools, again later if they are not available
+func (up *UpSessionBTC) redirectExpired() {
+	if up.replacedBy != nil {
+		return
+	}
+	up.log.Info("redirected for ", up.config.Advanced.PoolRedirectSeconds, " seconds, return to the configured pool")
+	up.redirectTimer = time.AfterFunc(up.config.Advanced.PoolRedirectSeconds.Get(), func() { up.SendEvent(EventRedirectExpired{}) })
+	go up.manager.SendEvent(EventUpSessionRedirect{up.slot, up, up.poolIndex, "", 0, 0})
+}
+
+// handOver Give the miners to the connection that replaces this one. Events of the miners that were sent
+// before they moved are forwarded to it, also after this connection is closed by either side.
+func (up *UpSessionBTC) handOver(e EventUpSessionReplaced) {
+	up.log.Info("pool connection replaced, move ", len(up.downSessions), " miners to the new connection")
+	metricUpSessionHealth.Add("handed_over_miners", int64(len(up.downSessions)))
+
+	up.replacedBy = e.Session
+	up.moveDownSessions(func(down *DownSessionBTC) { down.SendEvent(EventSetUpSession{e.Session}) })
+	// Not authorized any more, the slot is not reconnected when the connection is closed
+	up.setStat(StatDisconnected)
+	up.stopTimers()
+	time.AfterFunc(UpSessionHandOverTime, func() { up.SendEvent(EventExit{}) })
+}
+
+// forwardEvent Send the events of the miners to the connection that replaced this one, return false for other events
+func (up *UpSessionBTC) forwardEvent(event interface{}) bool {
+	switch e := event.(type) {
+	case EventAddDownSession:
+		// assigned by UpSessionManager before the replacement
+		e.Session.SendEvent(EventSetUpSession{up.replacedBy})
+	case EventSubmitShareBTC, EventReplaySharesBTC, EventDownSessionBroken, EventSuggestDifficulty:
+		up.replacedBy.SendEvent(event)
+	default:
+		return false
+	}
+	return true
+}
+
+func (up *UpSessionBTC) stopTimers() {
+	if up.watchdogStop != nil {
+		close(up.watchdogStop)
+		up.watchdogStop = nil
+	}
+	if up.redirectTimer != nil {
+		up.redirectTimer.Stop()
+		up.redirectTimer = nil
+	}
+}
+
+// migrateDownSessions Give the miners back to UpSessionManager. It moves them to another ready
+// pool connection, or to the fake session / disconnects them if there is none.
+func (up *UpSessionBTC) migrateDownSessions() {
+	if len(up.downSessions) < 1 {
+		return
+	}
+
+	up.log.Info("move ", len(up.downSessions), " miners to other pool connections")
+	metricUpSessionHealth.Add("migrated_miners", int64(len(up.downSessions)))
+
+	up.moveDownSessions(func(down *DownSessionBTC) { up.manager.SendEvent(EventAddDownSession{down}) })
+}
+
+// moveDownSessions Remove all miners, move sends each of them to its new server session.
+// Shares not replayed yet go with their miners.
+func (up *UpSessionBTC) moveDownSessions(move func(down *DownSessionBTC)) {
+	replayShares := make(map[uint16][]*ReplayShareBTC)
+	for _, share := range up.pendingReplay {
+		replayShares[share.Message.Base.SessionID] = append(replayShares[share.Message.Base.SessionID], share)
+	}
+	up.pendingReplay = nil
+
+	for _, down := range up.downSessions {
+		up.movedDownSessions[down.sessionID] = down
+		shares := replayShares[down.sessionID]
+		go func(down *DownSessionBTC) {
+			if len(shares) > 0 {
+				down.SendEvent(EventReplaySharesBTC{shares})
+			}
+			move(down)
+		}(down)
+	}
+	up.downSessions = make(map[uint16]*DownSessionBTC)
+	up.minDifficulties = make(map[uint16]float64)
+}
+
+// SendEvent Queue the event for the event loop. Miners may still send events after the connection is closed,
+// before they get their new server session, so the events are dropped then instead of blocking the sender.
 func (up *UpSessionBTC) SendEvent(event interface{}) {
-	up.eventChannel <- event
+	up.eventLock.RLock()
+	defer up.eventLock.RUnlock()
+
+	if !up.eventClosed {
+		select {
+		case up.eventChannel <- event:
+			return
+		case <-up.eventDone:
+		}
+	}
+	up.dropEvent(event)
+}
+
+// closeEvents Stop taking events, called when the event loop stops. Events left in the channel are dropped.
+func (up *UpSessionBTC) closeEvents() {
+	close(up.eventDone)
+	up.eventLock.Lock()
+	up.eventClosed = true
+	up.eventLock.Unlock()
+
+	for {
+		select {
+		case event := <-up.eventChannel:
+			up.dropEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// dropEvent Handle an event that arrived after the event loop stopped, in the goroutine of the sender.
+// Events of the miners go to the connection that replaced this one, or the miners are answered.
+func (up *UpSessionBTC) dropEvent(event interface{}) {
+	if up.replacedBy != nil && up.forwardEvent(event) {
+		return
+	}
+	switch e := event.(type) {
+	case EventReplaySharesBTC:
+		// the miner has moved, the shares go with it to its next server session
+		if len(e.Shares) > 0 {
+			if down, ok := up.movedDownSessions[e.Shares[0].Message.Base.SessionID]; ok {
+				down.SendEvent(e)
+			}
+		}
+	case EventAddDownSession:
+		if up.exiting {
+			e.Session.SendEvent(EventExit{})
+		} else {
+			// assigned before the connection was broken, the miner needs another one
+			go up.manager.SendEvent(EventAddDownSession{e.Session})
+		}
+	case EventSubmitShareBTC:
+		metricUpSessionHealth.Add("dropped_shares", 1)
+		// the job came from a closed connection, the pool cannot take the share any more
+		if down, ok := up.movedDownSessions[e.Message.Base.SessionID]; ok {
+			down.SendEvent(EventSubmitResponse{e.ID, STATUS_JOB_NOT_FOUND_OR_STALE})
+		}
+	}
 }
 
 func (up *UpSessionBTC) addDownSession(e EventAddDownSession) {
 	down := e.Session.(*DownSessionBTC)
 	up.downSessions[down.sessionID] = down
+	up.config.traceManager.RecordPoolState(down.TraceTarget(), up.poolURL, [][]byte{up.rpcSubscribe, up.rpcSetVersionMask, up.rpcSetDifficulty, up.rpcNotify})
 
-	if up.rpcSetVersionMask != nil && down.versionMask != 0 {
-		down.SendEvent(EventSendBytes{up.rpcSetVersionMask})
-	}
+	// The miner negotiates its mask again for this pool, a pool without version rolling has the mask 0
+	down.SendEvent(EventSetVersionMask{up.versionMask})
 
+	if minDifficulty := down.MinDifficulty(); minDifficulty > 0 {
+		up.minDifficulties[down.sessionID] = minDifficulty
+	}
 	if up.rpcSetDifficulty != nil {
 		down.SendEvent(EventSendBytes{up.rpcSetDifficulty})
 	}
@@ -556,41 +1142,65 @@ func (up *UpSessionBTC) addDownSession(e EventAddDownSession) {
 	if up.lastJob != nil {
 		bytes, err := up.lastJob.ToNotifyLine(true)
 		if err == nil {
-			down.SendEvent(EventSendBytes{bytes})
+			down.SendEvent(EventSendNotify{bytes, true, time.Time{}})
 		} else {
-			glog.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", up.lastJob)
+			up.log.Warning("failed to convert job to JSON: ", err.Error(), "; ", up.lastJob)
 		}
 	}
+	up.sendSuggestDifficulty()
 }
 
 func (up *UpSessionBTC) handleMiningNotify(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	start := time.Now()
 	job, err := NewStratumJobBTC(rpcData, up.sessionID)
 	if err != nil {
-		glog.Warning(up.id, err.Error(), ": ", string(jsonBytes))
+		up.log.Warning(err.Error(), ": ", string(jsonBytes))
 		return
 	}
 
 	bytes, err := job.ToNotifyLine(false)
 	if err != nil {
-		glog.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", string(jsonBytes))
+		up.log.Warning("failed to convert job to JSON: ", err.Error(), "; ", string(jsonBytes))
 		return
 	}
 
+	e := EventSendNotify{bytes, job.IsClean(), start}
 	for _, down := range up.downSessions {
-		go down.SendEvent(EventSendBytes{bytes})
+		down.SendEvent(e)
+	}
+
+	if clean, ok := job.Params[8].(bool); ok && clean {
+		up.recentJobIDs = make(map[string]bool)
+		up.cleanJob = true
+	}
+	if jobID, ok := job.Params[0].(string); ok {
+		up.recentJobIDs[jobID] = true
 	}
 
 	up.lastJob = job
+	up.rpcNotify = jsonBytes
+	up.lastNotifyTime = time.Now()
+
+	if len(up.pendingReplay) > 0 {
+		shares := up.pendingReplay
+		up.pendingReplay = nil
+		up.replayShares(shares)
+	}
 }
 
 func (up *UpSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 	rpcData := e.RPCData
 	jsonBytes := e.JSONBytes
 
-	glog.Info("UpSessionRecvJSONRPC. RPCData: ", *e.RPCData, ", JSONBytes: ", string(jsonBytes))
+	if glog.V(11) {
+		up.log.Info("recvJSONRPC: ", string(jsonBytes))
+	}
+	// Share responses are traced with their miners
+	if id, ok := rpcData.ID.(string); !ok || !strings.HasPrefix(id, "s.") {
+		up.traceLine(nil, TraceDirectionIn, jsonBytes)
+	}
 
 	if len(rpcData.Method) > 0 {
-		glog.Info("rpcData.Method: ", rpcData.Method)
 		switch rpcData.Method {
 		case "mining.set_version_mask":
 			up.handleSetVersionMask(rpcData, jsonBytes)
@@ -598,8 +1208,17 @@ func (up *UpSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 			up.handleSetDifficulty(rpcData, jsonBytes)
 		case "mining.notify":
 			up.handleMiningNotify(rpcData, jsonBytes)
+		case "mining.ping":
+			up.respondPoolRequest(rpcData, "pong")
+		case "client.get_version":
+			up.respondPoolRequest(rpcData, UpSessionUserAgent)
+		case "client.show_message":
+			up.handleShowMessage(rpcData)
+		case "client.reconnect":
+			up.handleReconnectRequest(rpcData)
 		default:
-			glog.Info(up.id, "[TODO] pool request: ", rpcData)
+			metricUpSessionRequests.Add("unknown", 1)
+			up.log.Every("pool.unknown_request", LogRateLimitSeconds.Get()).Info("[TODO] pool request: ", rpcData)
 		}
 		return
 	}
@@ -613,12 +1232,23 @@ func (up *UpSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 		up.handleSubScribeResponse(rpcData, jsonBytes)
 	case "auth":
 		up.handleAuthorizeResponse(rpcData, jsonBytes)
+	case "ping":
+		up.handlePingResponse(rpcData, jsonBytes)
+	case "suggest_diff":
+		if rpcData.Error != nil {
+			up.suggestUnsupported = true
+			up.log.Every("pool.suggest_difficulty", LogRateLimitSeconds.Get()).Info("mining.suggest_difficulty not supported by the pool: ", rpcData.Error)
+		}
 	case "caps_again":
 		// ignore
 	case "conn_test":
 		// ignore
 	default:
-		glog.Info(up.id, "[TODO] pool response: ", rpcData)
+		if id, ok := rpcData.ID.(string); ok && strings.HasPrefix(id, "s.") {
+			up.handleSubmitResponse(rpcData, jsonBytes)
+			return
+		}
+		up.log.Every("pool.unknown_response", LogRateLimitSeconds.Get()).Info("[TODO] pool response: ", rpcData)
 	}
 }
 
@@ -627,37 +1257,217 @@ func (up *UpSessionBTC) handleSubmitShare(e EventSubmitShareBTC) {
 		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
 		return
 	}
-	glog.Info("handleSubmitShare workerFullName: ", up.downSessions[e.Message.Base.SessionID].fullName)
-	glog.Info("handleSubmitShare. ID: ", e.ID, " message: ", *e.Message)
+	if glog.V(5) {
+		up.log.Info("handleSubmitShare: id ", e.ID, ", session ", e.Message.Base.SessionID, ", job ", e.Message.Base.JobID, ", nonce ", e.Message.Base.Nonce)
+	}
+
+	down, ok := up.downSessions[e.Message.Base.SessionID]
+	if !ok {
+		// The client has been disconnected, ignored
+		return
+	}
 
 	// test request with writeJSONRequest (not writeExMessage)
 
+	responseFromServer := up.config.SubmitResponseFromServer && up.serverCapSubmitResponse
+	requestID := e.ID
+	submit := SubmitID{ID: e.ID, SessionID: e.Message.Base.SessionID, Time: time.Now(), Difficulty: up.difficulty, Worker: down.workerStatus}
+	// The pool's verdict is needed by the journal and the worker monitor
+	if responseFromServer || up.config.shareJournal != nil || up.config.workerMonitor != nil {
+		submit.Record = up.newJournalRecord(down, e.Message, false)
+		requestID = up.addSubmitID(submit)
+	}
+
+	err := up.writeSubmitRequest(requestID, down, e.Message)
+	if err != nil {
+		up.log.Error("failed to submit share: ", err.Error())
+		if !responseFromServer {
+			up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_JOB_NOT_FOUND_OR_STALE)
+		}
+		up.close()
+		return
+	}
+	if submit.Record != nil {
+		up.config.shareJournal.Write(submit.Record)
+	}
+
+	if !responseFromServer {
+		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
+	}
+}
+
+func (up *UpSessionBTC) writeSubmitRequest(id interface{}, down *DownSessionBTC, msg *ExMessageSubmitShareBTC) (err error) {
 	var request JSONRPCRequest
-	request.ID = e.ID
+	request.ID = id
 	request.Method = "mining.submit"
 	request.SetParams(
-		up.downSessions[e.Message.Base.SessionID].fullName,
-		e.Message.Base.JobID,
-		e.Message.Base.ExtraNonce2,
-		e.Message.Time,
-		e.Message.Base.Nonce)
+		down.fullName,
+		msg.Base.JobID,
+		msg.Base.ExtraNonce2,
+		msg.Time,
+		msg.Base.Nonce)
+	// BIP310: the version bits changed by the miner, inside the negotiated mask
+	if msg.VersionMask != 0 {
+		request.AddParams(Uint32ToHex(msg.VersionMask))
+	}
 
-	glog.Info("handleSubmitShare request: ", request)
-	_, err := up.writeJSONRequest(&request)
+	bytes, err := request.ToJSONBytesLine()
+	if err != nil {
+		return
+	}
+	if glog.V(10) {
+		up.log.Info("writeJSONRequest: ", string(bytes))
+	}
+	_, err = up.writeBytesOf(down, bytes)
+	return
+}
+
+// addSubmitID Remember a share until the pool responds, return the request ID sent to the pool
+func (up *UpSessionBTC) addSubmitID(submit SubmitID) string {
+	// The request ID of a miner may be the same as other miners', so use our own
+	id := fmt.Sprintf("s.%d", up.submitIndex)
+	up.submitIDs[up.submitIndex] = submit
+	up.submitIndex++
+	return id
+}
 
+func (up *UpSessionBTC) handleSubmitResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	id, _ := rpcData.ID.(string)
+	index, err := strconv.ParseUint(strings.TrimPrefix(id, "s."), 10, 16)
 	if err != nil {
-		glog.Error(up.id, "failed to submit share: ", err.Error())
-		up.close()
+		up.log.Every("pool.unknown_share_response", LogRateLimitSeconds.Get()).Warning("unknown share response: ", string(jsonBytes))
+		return
+	}
+	submit, ok := up.submitIDs[uint16(index)]
+	if down, exists := up.downSessions[submit.SessionID]; ok && exists {
+		up.traceLine(down, TraceDirectionIn, jsonBytes)
+	}
+	if !ok {
+		if glog.V(3) {
+			up.log.Info("share response without request: ", string(jsonBytes))
+		}
 		return
 	}
+	delete(up.submitIDs, uint16(index))
 
-	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
-		up.submitIDs[up.submitIndex] = SubmitID{e.ID, e.Message.Base.SessionID}
-		up.submitIndex++
-	} else {
-		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
+	status := submitResponseStatus(rpcData)
+	if submit.Replay {
+		if status.IsAccepted() {
+			metricShareReplay.Add("accepted", 1)
+		} else {
+			metricShareReplay.Add("rejected", 1)
+		}
+	} else if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
+		up.sendSubmitResponse(submit.SessionID, submit.ID, status)
+	}
+
+	if monitor := up.config.workerMonitor; monitor != nil {
+		monitor.AddShare(submit.Worker, submit.Difficulty, status.IsAccepted())
+	}
+
+	if submit.Record != nil {
+		result := *submit.Record
+		result.Type = ShareJournalResult
+		result.Time = time.Now()
+		result.Accepted = status.IsAccepted()
+		result.Status = status.ToString()
+		result.ResponseMs = time.Since(submit.Time).Milliseconds()
+		if rpcData.Error != nil {
+			poolError, _ := json.Marshal(rpcData.Error)
+			result.PoolError = string(poolError)
+		}
+		up.config.shareJournal.Write(&result)
+	}
+}
+
+// submitResponseStatus The pool's verdict of a share
+func submitResponseStatus(rpcData *JSONRPCLineBTC) StratumStatus {
+	if accepted, ok := rpcData.Result.(bool); ok && accepted {
+		return STATUS_ACCEPT
+	}
+
+	// stratum: [code, message, data], JSON-RPC 2.0: {"code": code, "message": message}
+	var code interface{}
+	switch e := rpcData.Error.(type) {
+	case []interface{}:
+		if len(e) > 0 {
+			code = e[0]
+		}
+	case map[string]interface{}:
+		code = e["code"]
+	}
+	if c, ok := code.(float64); ok && c > 0 {
+		return StratumStatus(c)
+	}
+	return STATUS_REJECT_NO_REASON
+}
+
+// newJournalRecord Nil if the share journal is disabled
+func (up *UpSessionBTC) newJournalRecord(down *DownSessionBTC, msg *ExMessageSubmitShareBTC, replay bool) (record *ShareJournalRecord) {
+	if up.config.shareJournal == nil {
+		return
 	}
+	record = &ShareJournalRecord{
+		Time:        time.Now(),
+		Type:        ShareJournalSubmit,
+		SubAccount:  down.subAccountName,
+		Worker:      down.workerName,
+		Pool:        fmt.Sprintf("%s:%d", up.poolHost, up.poolPort),
+		JobID:       msg.Base.JobID,
+		Difficulty:  up.difficulty,
+		ExtraNonce2: msg.Base.ExtraNonce2,
+		NTime:       msg.Time,
+		Nonce:       msg.Base.Nonce,
+		Replay:      replay,
+	}
+	if msg.VersionMask != 0 {
+		record.VersionMask = Uint32ToHex(msg.VersionMask)
+	}
+	return
+}
 
+// replayShares Submit the shares buffered during a pool outage if they are still valid for this connection
+func (up *UpSessionBTC) replayShares(shares []*ReplayShareBTC) {
+	if up.lastJob == nil {
+		// wait for the first job to know which shares are stale
+		up.pendingReplay = append(up.pendingReplay, shares...)
+		return
+	}
+
+	maxAge := up.config.Advanced.ShareReplay.MaxAgeSeconds.Get()
+	for _, share := range shares {
+		if time.Since(share.Time) > maxAge {
+			metricShareReplay.Add("dropped_expired", 1)
+			continue
+		}
+		// The coinbase contains the extranonce1 of the pool connection, the share is only valid in the resumed session,
+		// and only for jobs not replaced by a clean one since
+		pool := share.PoolSession
+		if !up.resumed || pool.SessionID != up.sessionID || pool.Pool != up.resumeSession.Pool ||
+			(up.cleanJob && !up.recentJobIDs[share.Message.Base.JobID]) {
+			metricShareReplay.Add("dropped_stale", 1)
+			continue
+		}
+		down, ok := up.downSessions[share.Message.Base.SessionID]
+		if !ok {
+			metricShareReplay.Add("dropped_miner_gone", 1)
+			continue
+		}
+
+		submit := SubmitID{SessionID: share.Message.Base.SessionID, Replay: true, Time: time.Now(), Difficulty: up.difficulty, Worker: down.workerStatus}
+		submit.Record = up.newJournalRecord(down, share.Message, true)
+
+		err := up.writeSubmitRequest(up.addSubmitID(submit), down, share.Message)
+		if err != nil {
+			up.log.Error("failed to replay share: ", err.Error())
+			up.close()
+			return
+		}
+		if submit.Record != nil {
+			up.config.shareJournal.Write(submit.Record)
+		}
+		metricShareReplay.Add("replayed", 1)
+	}
 }
 
 func (up *UpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{}, status StratumStatus) {
@@ -665,16 +1475,18 @@ func (up *UpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{}, sta
 	if !ok {
 		// The client has been disconnected, ignored
 		if glog.V(3) {
-			glog.Info(up.id, "cannot find down session: ", sessionID)
+			up.log.Info("cannot find down session: ", sessionID)
 		}
 		return
 	}
-	go down.SendEvent(EventSubmitResponse{id, status})
+	down.SendEvent(EventSubmitResponse{id, status})
 }
 
 func (up *UpSessionBTC) downSessionBroken(e EventDownSessionBroken) {
 	delete(up.downSessions, e.SessionID)
+	delete(up.minDifficulties, e.SessionID)
 	//up.unregisterWorker(e.SessionID)
+	up.sendSuggestDifficulty()
 
 	if up.disconnectedMinerCounter == 0 {
 		go func() {
@@ -702,14 +1514,21 @@ func (up *UpSessionBTC) handleEvent() {
 	up.eventLoopRunning = true
 	for up.eventLoopRunning {
 		event := <-up.eventChannel
+		if up.replacedBy != nil && up.forwardEvent(event) {
+			continue
+		}
 
 		switch e := event.(type) {
 		case EventAddDownSession:
 			up.addDownSession(e)
 		case EventSubmitShareBTC:
 			up.handleSubmitShare(e)
+		case EventReplaySharesBTC:
+			up.replayShares(e.Shares)
 		case EventDownSessionBroken:
 			up.downSessionBroken(e)
+		case EventSuggestDifficulty:
+			up.suggestDifficulty(e)
 		case EventSendUpdateMinerNum:
 			up.sendUpdateMinerNum()
 		case EventRecvJSONRPCBTC:
@@ -718,10 +1537,19 @@ func (up *UpSessionBTC) handleEvent() {
 			up.close()
 		case EventUpSessionConnection:
 			up.outdatedUpSessionConnection(e)
+		case EventCheckAlive:
+			up.checkAlive()
+		case EventMigrateDownSessions:
+			// the miners are migrated while closing, then the slot reconnects
+			up.close()
+		case EventUpSessionReplaced:
+			up.handOver(e)
+		case EventRedirectExpired:
+			up.redirectExpired()
 		case EventExit:
 			up.exit()
 		default:
-			glog.Error(up.id, "unknown event: ", e)
+			up.log.Error("unknown event: ", e)
 		}
 	}
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDownSession A miner that only records the events sent to it
+type testDownSession struct {
+	DownSession
+	events chan interface{}
+}
+
+func (down *testDownSession) SendEvent(event interface{}) {
+	down.events <- event
+}
+
+// testUpSession A pool session that only records the events sent to it
+type testUpSession struct {
+	UpSession
+	events chan interface{}
+}
+
+func (up *testUpSession) SendEvent(event interface{}) {
+	up.events <- event
+}
+
+func testSubmitEvent(id int, sessionID uint16) EventSubmitShareBTC {
+	msg := new(ExMessageSubmitShareBTC)
+	msg.Base.SessionID = sessionID
+	return EventSubmitShareBTC{id, msg}
+}
+
+func TestPoolRequests(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, nil, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+
+	miner, _ := connectMockMiner(t, manager, "worker1")
+
+	// answered by the agent
+	pool.Request(5, "mining.ping")
+	pool.Request(6, "client.get_version")
+	waitMockPool(t, func() bool { return len(pool.Responses()) >= 2 })
+	for _, response := range pool.Responses() {
+		switch response.ID {
+		case float64(5):
+			if response.Result != "pong" {
+				t.Errorf("wrong ping response: %v", response.Result)
+			}
+		case float64(6):
+			if response.Result != UpSessionUserAgent {
+				t.Errorf("wrong version: %v", response.Result)
+			}
+		default:
+			t.Errorf("unexpected response %v", response.ID)
+		}
+	}
+
+	// relayed to the miners without the ID of the pool
+	pool.Request("msg1", "client.show_message", "maintenance in 10 minutes")
+	if message := miner.expect("client.show_message", nil); message.ID != nil || message.Params[0] != "maintenance in 10 minutes" {
+		t.Errorf("wrong message: %v %v", message.ID, message.Params)
+	}
+	waitMockPool(t, func() bool { return len(pool.Responses()) >= 3 })
+	if response := pool.Responses()[2]; response.ID != "msg1" || response.Result != true {
+		t.Errorf("wrong show_message response: %v %v", response.ID, response.Result)
+	}
+
+	// miners' pings and version queries
+	miner.send(`{"id":3,"method":"mining.ping","params":[]}`)
+	if response := miner.expect("", float64(3)); response.Result != "pong" || response.Error != nil {
+		t.Errorf("wrong ping response: %v %v", response.Result, response.Error)
+	}
+	miner.send(`{"id":4,"method":"client.get_version","params":[]}`)
+	if response := miner.expect("", float64(4)); response.Result != UpSessionUserAgent {
+		t.Errorf("wrong version: %v", response.Result)
+	}
+
+	// the pool connection is renewed, the miner stays connected
+	pool.Request(nil, "client.reconnect")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 1 })
+	miner.expect("mining.notify", nil)
+	miner.send(`{"id":5,"method":"mining.ping","params":[]}`)
+	miner.expect("", float64(5))
+}
+
+func TestPoolRedirect(t *testing.T) {
+	poolA := NewMockPool(NewMockPoolOptions())
+	poolB := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", poolA)
+	network.Add("pool-b:3333", poolB)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolRedirectSeconds = 1
+	}, "pool-a")
+	waitMockPool(t, func() bool { return poolA.Stats().Authorizes > 0 })
+
+	miner, _ := connectMockMiner(t, manager, "worker1")
+
+	// the miner moves to pool B without a fake job
+	poolA.Request(nil, "client.reconnect", "pool-b", 3333, 0)
+	waitMockPool(t, func() bool { return poolB.Stats().Authorizes > 0 })
+	job := miner.expect("mining.notify", nil).Params[0].(string)
+	if strings.HasPrefix(job, "f") {
+		t.Fatal("the miner should not get a fake job")
+	}
+	if response := miner.submit(3, job); response.Result != true {
+		t.Fatalf("share rejected: %+v", response)
+	}
+	waitMockPool(t, func() bool { return poolB.Stats().Accepted == 1 })
+
+	// and back to the configured pool
+	waitMockPool(t, func() bool { return poolA.Stats().Authorizes > 1 })
+	job = miner.expect("mining.notify", nil).Params[0].(string)
+	if response := miner.submit(4, job); response.Result != true {
+		t.Fatalf("share rejected: %+v", response)
+	}
+	waitMockPool(t, func() bool { return poolA.Stats().Accepted == 1 })
+	if poolA.Stats().Disconnects > 0 || poolB.Stats().Disconnects > 0 {
+		t.Error("the pools should not close connections")
+	}
+}
+
+func TestUpSessionClosedEvents(t *testing.T) {
+	down := &testDownSession{events: make(chan interface{}, 100)}
+	up := &UpSessionBTC{
+		eventChannel:      make(chan interface{}, 2),
+		eventDone:         make(chan struct{}),
+		movedDownSessions: map[uint16]DownSession{7: down},
+	}
+
+	// the miner was moved and keeps submitting to the old connection until it learns about the new one
+	up.SendEvent(testSubmitEvent(1, 7))
+	up.SendEvent(testSubmitEvent(2, 7))
+	blocked := make(chan struct{})
+	go func() {
+		up.SendEvent(testSubmitEvent(3, 7))
+		close(blocked)
+	}()
+
+	// the connection is closed with a full channel, the waiting sender is released
+	up.closeEvents()
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sender should not block on a closed session")
+	}
+
+	// later events return at once
+	done := make(chan struct{})
+	go func() {
+		for i := 4; i <= 10; i++ {
+			up.SendEvent(testSubmitEvent(i, 7))
+		}
+		up.SendEvent(EventDownSessionBroken{7})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sender should not block on a closed session")
+	}
+
+	// and every share is answered as stale
+	answered := make(map[interface{}]bool)
+	for len(down.events) > 0 {
+		response, ok := (<-down.events).(EventSubmitResponse)
+		if !ok || response.Status != STATUS_JOB_NOT_FOUND_OR_STALE {
+			t.Fatalf("wrong answer to a share of a closed session: %+v", response)
+		}
+		answered[response.ID] = true
+	}
+	if len(answered) != 10 {
+		t.Errorf("10 shares should be answered, got %d", len(answered))
+	}
+}
+
+func TestPoolRedirectThenClose(t *testing.T) {
+	poolA := NewMockPool(NewMockPoolOptions())
+	poolB := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", poolA)
+	network.Add("pool-b:3333", poolB)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolRedirectSeconds = 60
+	}, "pool-a")
+	waitMockPool(t, func() bool { return poolA.Stats().Authorizes > 0 })
+
+	miner, notify := connectMockMiner(t, manager, "worker1")
+	oldJob := notify.Params[0].(string)
+
+	// pool A closes the connection right after client.reconnect, the miner keeps submitting meanwhile
+	poolA.Request(nil, "client.reconnect", "pool-b", 3333, 0)
+	poolA.DisconnectAll()
+	for id := 3; id < 13; id++ {
+		params, _ := json.Marshal([]string{"mock.worker1", oldJob, "00000001", "60b5e80b", Uint32ToHex(uint32(id))})
+		miner.send(fmt.Sprintf(`{"id":%d,"method":"mining.submit","params":%s}`, id, params))
+	}
+
+	// every share is answered and the miner gets a job of pool B
+	answered := 0
+	job := ""
+	for timeout := time.After(5 * time.Second); answered < 10 || job == ""; {
+		select {
+		case line := <-miner.lines:
+			if line.Method == "mining.notify" && !strings.HasPrefix(line.Params[0].(string), "f") {
+				job = line.Params[0].(string)
+			}
+			if id, ok := line.ID.(float64); ok && line.Method == "" && id >= 3 && id < 13 {
+				answered++
+			}
+		case <-timeout:
+			t.Fatalf("%d of 10 shares answered, job of pool B: %q", answered, job)
+		}
+	}
+	accepted := poolB.Stats().Accepted
+	if poolB.Stats().Authorizes != 1 {
+		t.Fatal("the slot should connect to pool B")
+	}
+	if response := miner.submit(13, job); response.Result != true {
+		t.Fatalf("share rejected by pool B: %+v", response)
+	}
+	waitMockPool(t, func() bool { return poolB.Stats().Accepted > accepted })
+	if poolA.Stats().Accepted > 0 {
+		t.Error("pool A should not get the shares after it closed the connection")
+	}
+}
+
+func TestUpSessionClosedAfterHandOver(t *testing.T) {
+	down := &testDownSession{events: make(chan interface{}, 10)}
+	replacedBy := &testUpSession{events: make(chan interface{}, 10)}
+	up := &UpSessionBTC{
+		eventChannel:      make(chan interface{}, 10),
+		eventDone:         make(chan struct{}),
+		movedDownSessions: map[uint16]DownSession{7: down},
+		replacedBy:        replacedBy,
+	}
+
+	// the pool closed the connection right after client.reconnect, with a share still queued
+	up.SendEvent(testSubmitEvent(1, 7))
+	up.closeEvents()
+	up.SendEvent(testSubmitEvent(2, 7))
+	up.SendEvent(EventAddDownSession{down})
+	up.SendEvent(EventExit{})
+
+	// the shares go to the new connection, not answered as stale
+	for id := 1; id <= 2; id++ {
+		if e, ok := (<-replacedBy.events).(EventSubmitShareBTC); !ok || e.ID != id {
+			t.Fatalf("share %d should be forwarded, got %+v", id, e)
+		}
+	}
+	if e, ok := (<-down.events).(EventSetUpSession); !ok || e.Session != replacedBy {
+		t.Errorf("a miner assigned before the hand-over should move to the new connection, got %+v", e)
+	}
+	if len(down.events) > 0 || len(replacedBy.events) > 0 {
+		t.Error("no other event should be sent")
+	}
+}
+
+func TestMalformedPoolLines(t *testing.T) {
+	pool := NewMockPool(NewMockPoolOptions())
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolMaxLineBytes = 1024
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 0 })
+	miner, _ := connectMockMiner(t, manager, "worker1")
+
+	// a malformed line is counted and skipped, the connection is kept
+	malformed := metricValue(metricUpSessionParse, "malformed_lines")
+	pool.SendLine(`{"id":null,"method":"mining.notify",`)
+	waitMockPool(t, func() bool { return metricValue(metricUpSessionParse, "malformed_lines") != malformed })
+
+	// a known quirk is fixed
+	padding := metricValue(metricUpSessionParse, MetricKey("quirk", "padding"))
+	pool.SendLine("\xef\xbb\xbf" + `{"id":null,"method":"client.show_message","params":["hello"]}` + "\x00")
+	if message := miner.expect("client.show_message", nil); message.Params[0] != "hello" {
+		t.Errorf("wrong message: %v", message.Params)
+	}
+	if metricValue(metricUpSessionParse, MetricKey("quirk", "padding")) == padding {
+		t.Error("the fixed quirk should be counted")
+	}
+	pool.Notify(false)
+	miner.expect("mining.notify", nil)
+	if pool.Stats().Authorizes != 1 {
+		t.Fatal("malformed lines should not break the pool connection")
+	}
+
+	// a too long line breaks it
+	tooLong := metricValue(metricUpSessionParse, "line_too_long")
+	pool.SendLine(`{"id":null,"method":"client.show_message","params":["` + strings.Repeat("x", 2048) + `"]}`)
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 1 })
+	if metricValue(metricUpSessionParse, "line_too_long") == tooLong {
+		t.Error("the too long line should be counted")
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
+import "time"
+
+// SubmitID A share waiting for the pool's response
 type SubmitID struct {
-	ID        interface{}
-	SessionID uint16
+	ID         interface{} // request ID of the miner
+	SessionID  uint16
+	Replay     bool // buffered during a pool outage, the miner has already got a response
+	Time       time.Time
+	Difficulty float64
+	Record     *ShareJournalRecord // nil if the share journal is disabled
+	Worker     *WorkerStatus       // the miner connection in the worker monitor, nil if it is disabled
 }
 
 type UpSession interface {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -11,6 +12,12 @@ type UpSessionInfo struct {
 	minerNum  int
 	ready     bool
 	upSession UpSession
+	backoff   *Backoff
+	pool      string // host:port of the last connected pool
+
+	minDifficulty float64 // minimum difficulty suggested by the first miner of the slot, 0 if none
+
+	redirecting bool // a new connection is made for client.reconnect, before the current one is dropped
 }
 
 type FakeUpSessionInfo struct {
@@ -19,13 +26,17 @@ type FakeUpSessionInfo struct {
 }
 
 type UpSessionManager struct {
-	id         string // Connection identifier for printing logs
+	log        *Logger // Logger with the sub-account context
 	subAccount string
 	config     *Config
 	parent     *SessionManager
 
 	upSessions    []UpSessionInfo
 	fakeUpSession FakeUpSessionInfo
+	poolBreakers  []*CircuitBreaker // index: pool index
+
+	// *PoolSessionBTC of each slot, stored by the lost connection and resumed by the next one of the slot
+	resumeSessions []atomic.Value
 
 	eventChannel chan interface{}
 
@@ -43,12 +54,28 @@ func NewUpSessionManager(subAccount string, config *Config, parent *SessionManag
 
 	upSessions := make([]UpSessionInfo, manager.config.Advanced.PoolConnectionNumberPerSubAccount)
 	manager.upSessions = upSessions[:]
+	manager.resumeSessions = make([]atomic.Value, len(upSessions))
+	for i := range manager.upSessions {
+		manager.upSessions[i].backoff = NewBackoff(
+			manager.config.Advanced.ReconnectBackoff.MinSeconds.Get(),
+			manager.config.Advanced.ReconnectBackoff.MaxSeconds.Get(),
+			manager.config.Advanced.ReconnectBackoff.Multiplier)
+	}
 	manager.fakeUpSession.upSession = manager.config.sessionFactory.NewFakeUpSession(manager)
 
+	// Breakers are per sub-account, so a wrong sub-account cannot block the pool for others
+	manager.poolBreakers = make([]*CircuitBreaker, len(manager.config.Pools))
+	for i := range manager.poolBreakers {
+		manager.poolBreakers[i] = NewCircuitBreaker(
+			manager.config.Advanced.PoolCircuitBreaker.Failures,
+			manager.config.Advanced.PoolCircuitBreaker.OpenSeconds.Get())
+	}
+
 	manager.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSessionManager)
 
+	manager.log = NewLogger()
 	if manager.config.MultiUserMode {
-		manager.id = fmt.Sprintf("<%s> ", manager.subAccount)
+		manager.log = NewLogger("sub_account", manager.subAccount)
 	}
 	return
 }
@@ -64,17 +91,86 @@ func (manager *UpSessionManager) Run() {
 }
 
 func (manager *UpSessionManager) connect(slot int) {
-	for i := range manager.config.Pools {
+	up, poolURL := manager.connectPools(slot)
+	if up == nil {
+		manager.SendEvent(EventUpSessionInitFailed{slot})
+		return
+	}
+	go up.Run()
+	manager.SendEvent(EventUpSessionReady{slot, up, poolURL})
+}
+
+// connectPools Connect the slot to the first configured pool that accepts it, nil if all fail
+func (manager *UpSessionManager) connectPools(slot int) (UpSession, string) {
+	for i, pool := range manager.config.Pools {
+		breaker := manager.poolBreakers[i]
+		poolURL := fmt.Sprintf("%s:%d", pool.Host, pool.Port)
+		if !breaker.Allow() {
+			if glog.V(3) {
+				manager.log.Info("pool#", slot, " skip pool ", poolURL, ", circuit breaker is open")
+			}
+			continue
+		}
+
+		metricReconnect.Add("attempts", 1)
 		up := manager.config.sessionFactory.NewUpSession(manager, i, slot)
 		up.Init()
 
 		if up.Stat() == StatAuthorized {
+			breaker.Success()
+			metricReconnect.Add("success", 1)
+			return up, poolURL
+		}
+
+		metricReconnect.Add("failures", 1)
+		metricReconnect.Add(MetricKey(poolURL, "failures"), 1)
+		if breaker.Failure() {
+			metricReconnect.Add("circuit_open", 1)
+			manager.log.Warning("pool ", poolURL, " keeps failing, circuit breaker opened, skip it for ",
+				manager.config.Advanced.PoolCircuitBreaker.OpenSeconds, " seconds")
+		}
+	}
+	return nil, ""
+}
+
+// redirect Make the new connection of a redirected slot, the current one is replaced if it succeeds
+func (manager *UpSessionManager) redirect(e EventUpSessionRedirect) {
+	time.Sleep(e.Wait)
+
+	if len(e.Host) < 1 {
+		up, poolURL := manager.connectPools(e.Slot)
+		if up != nil {
 			go up.Run()
-			manager.SendEvent(EventUpSessionReady{slot, up})
-			return
 		}
+		manager.SendEvent(EventUpSessionRedirected{e.Slot, e.Session, up, poolURL})
+		return
+	}
+
+	poolURL := fmt.Sprintf("%s:%d", e.Host, e.Port)
+	metricReconnect.Add("redirect_attempts", 1)
+	up := manager.config.sessionFactory.NewRedirectedUpSession(manager, e.PoolIndex, e.Slot, e.Host, e.Port)
+	up.Init()
+	if up.Stat() != StatAuthorized {
+		metricReconnect.Add("redirect_failures", 1)
+		manager.SendEvent(EventUpSessionRedirected{e.Slot, e.Session, nil, poolURL})
+		return
+	}
+	go up.Run()
+	manager.SendEvent(EventUpSessionRedirected{e.Slot, e.Session, up, poolURL})
+}
+
+// reconnect Connect the slot again after the backoff delay
+func (manager *UpSessionManager) reconnect(slot int) {
+	info := &manager.upSessions[slot]
+	delay := info.backoff.Next()
+
+	if glog.V(1) {
+		manager.log.Info("pool#", slot, " reconnect in ", delay.Round(time.Millisecond), ", attempt ", info.backoff.Attempt())
 	}
-	manager.SendEvent(EventUpSessionInitFailed{slot})
+	go func() {
+		time.Sleep(delay)
+		manager.connect(slot)
+	}()
 }
 
 func (manager *UpSessionManager) SendEvent(event interface{}) {
@@ -84,17 +180,32 @@ func (manager *UpSessionManager) SendEvent(event interface{}) {
 func (manager *UpSessionManager) addDownSession(e EventAddDownSession) {
 	defer manager.tryPrintMinerNum()
 
-	var selected *UpSessionInfo
+	var selected, fallback *UpSessionInfo
+	minDifficulty := e.Session.MinDifficulty()
 
-	// Looking for a server for the minimum number of connections
+	// Looking for a server for the minimum number of connections.
+	// The pool sets one difficulty for all miners of a connection, so miners suggesting
+	// another minimum difficulty are kept apart while there are enough connections.
 	for i := range manager.upSessions {
 		info := &manager.upSessions[i]
-		if info.ready && (selected == nil || info.minerNum < selected.minerNum) {
+		if !info.ready {
+			continue
+		}
+		if fallback == nil || info.minerNum < fallback.minerNum {
+			fallback = info
+		}
+		if (info.minerNum < 1 || info.minDifficulty == minDifficulty) && (selected == nil || info.minerNum < selected.minerNum) {
 			selected = info
 		}
 	}
+	if selected == nil {
+		selected = fallback
+	}
 
 	if selected != nil {
+		if selected.minerNum < 1 {
+			selected.minDifficulty = minDifficulty
+		}
 		selected.minerNum++
 		e.Session.SendEvent(EventSetUpSession{selected.upSession})
 		return
@@ -119,25 +230,27 @@ func (manager *UpSessionManager) upSessionReady(e EventUpSessionReady) {
 	info := &manager.upSessions[e.Slot]
 	info.upSession = e.Session
 	info.ready = true
+	info.pool = e.Pool
+	info.backoff.Reset()
+	manager.config.eventBus.PublishPoolEvent(LifecyclePoolConnected, manager.subAccount, e.Slot, e.Pool, "")
 
 	// Get the miner back from FakeUpSession
 	manager.fakeUpSession.upSession.SendEvent(EventTransferDownSessions{})
 }
 
 func (manager *UpSessionManager) upSessionInitFailed(e EventUpSessionInitFailed) {
+	manager.config.eventBus.PublishPoolEvent(LifecyclePoolConnectFailed, manager.subAccount, e.Slot, "", "failed to connect to all pool servers")
+
 	if manager.initSuccess {
-		glog.Error(manager.id, "Failed to connect to all ", len(manager.config.Pools), " pool servers, please check your configuration! Retry in 5 seconds.")
-		go func() {
-			time.Sleep(5 * time.Second)
-			manager.connect(e.Slot)
-		}()
+		manager.log.Error("Failed to connect to all ", len(manager.config.Pools), " pool servers, please check your configuration!")
+		manager.reconnect(e.Slot)
 		return
 	}
 
 	manager.initFailureCounter++
 
 	if manager.initFailureCounter >= len(manager.upSessions) {
-		glog.Error(manager.id, "Too many connection failure to pool, please check your sub-account or pool configurations! Sub-account: ", manager.subAccount, ", pools: ", manager.config.Pools)
+		manager.log.Error("Too many connection failure to pool, please check your sub-account or pool configurations! Sub-account: ", manager.subAccount, ", pools: ", manager.config.Pools)
 
 		manager.parent.SendEvent(EventStopUpSessionManager{manager.subAccount})
 		return
@@ -145,13 +258,98 @@ func (manager *UpSessionManager) upSessionInitFailed(e EventUpSessionInitFailed)
 }
 
 func (manager *UpSessionManager) upSessionBroken(e EventUpSessionBroken) {
+	info := &manager.upSessions[e.Slot]
+	if info.upSession != e.Session {
+		// replaced after a redirection
+		return
+	}
+
 	defer manager.tryPrintMinerNum()
 
-	info := &manager.upSessions[e.Slot]
 	info.ready = false
 	info.minerNum = 0
+	manager.config.eventBus.PublishPoolEvent(LifecyclePoolDisconnected, manager.subAccount, e.Slot, info.pool, "")
 
-	go manager.connect(e.Slot)
+	if info.redirecting {
+		// the new connection is on its way
+		return
+	}
+	// Delay with jitter, so that all slots (and all agents) do not hit the pool at the same moment
+	manager.reconnect(e.Slot)
+}
+
+// upSessionRedirect The pool sent client.reconnect, or a redirected slot returns to the configured pools
+func (manager *UpSessionManager) upSessionRedirect(e EventUpSessionRedirect) {
+	info := &manager.upSessions[e.Slot]
+	if !info.ready || info.upSession != e.Session || info.redirecting {
+		return
+	}
+	info.redirecting = true
+
+	target := "the configured pools"
+	if len(e.Host) > 0 {
+		target = fmt.Sprintf("%s:%d", e.Host, e.Port)
+	}
+	manager.log.Info("pool#", e.Slot, " connect to ", target, " in ", e.Wait, ", then move the miners")
+	go manager.redirect(e)
+}
+
+func (manager *UpSessionManager) upSessionRedirected(e EventUpSessionRedirected) {
+	info := &manager.upSessions[e.Slot]
+	info.redirecting = false
+
+	if e.Session == nil {
+		manager.log.Warning("pool#", e.Slot, " failed to connect to ", e.Pool, " after client.reconnect")
+		if !info.ready {
+			manager.reconnect(e.Slot)
+		}
+		return
+	}
+
+	defer manager.tryPrintMinerNum()
+
+	replaced := info.ready && info.upSession == e.Old
+	info.upSession = e.Session
+	info.ready = true
+	info.pool = e.Pool
+	info.backoff.Reset()
+	manager.config.eventBus.PublishPoolEvent(LifecyclePoolConnected, manager.subAccount, e.Slot, e.Pool, "redirected by client.reconnect")
+
+	if replaced {
+		// the miners go straight to the new connection, the count of the slot is kept
+		go e.Old.SendEvent(EventUpSessionReplaced{e.Session})
+	} else {
+		info.minerNum = 0
+	}
+	// Get the miner back from FakeUpSession
+	manager.fakeUpSession.upSession.SendEvent(EventTransferDownSessions{})
+}
+
+func (manager *UpSessionManager) upSessionDegraded(e EventUpSessionDegraded) {
+	info := &manager.upSessions[e.Slot]
+	if !info.ready {
+		return
+	}
+
+	healthy := 0
+	for i := range manager.upSessions {
+		if i != e.Slot && manager.upSessions[i].ready {
+			healthy++
+		}
+	}
+	if healthy < 1 {
+		manager.log.Warning("pool#", e.Slot, " degraded but there is no other pool connection, keep it")
+		return
+	}
+
+	defer manager.tryPrintMinerNum()
+
+	manager.config.eventBus.PublishPoolEvent(LifecyclePoolDegraded, manager.subAccount, e.Slot, info.pool, "no job from the pool for too long, miners are moved")
+
+	// Stop assigning miners to the slot, then let it hand over its miners and reconnect
+	info.ready = false
+	info.minerNum = 0
+	go info.upSession.SendEvent(EventMigrateDownSessions{})
 }
 
 func (manager *UpSessionManager) updateMinerNum(e EventUpdateMinerNum) {
@@ -160,7 +358,7 @@ func (manager *UpSessionManager) updateMinerNum(e EventUpdateMinerNum) {
 	manager.upSessions[e.Slot].minerNum -= e.DisconnectedMinerCounter
 
 	if glog.V(3) {
-		glog.Info(manager.id, "miner num update, slot: ", e.Slot, ", miners: ", manager.upSessions[e.Slot].minerNum)
+		manager.log.Info("miner num update, slot: ", e.Slot, ", miners: ", manager.upSessions[e.Slot].minerNum)
 	}
 
 	if manager.config.MultiUserMode {
@@ -169,7 +367,7 @@ func (manager *UpSessionManager) updateMinerNum(e EventUpdateMinerNum) {
 			minerNum += manager.upSessions[i].minerNum
 		}
 		if minerNum < 1 {
-			glog.Info(manager.id, "no miners on sub-account ", manager.subAccount, ", close pool connections")
+			manager.log.Info("no miners on sub-account ", manager.subAccount, ", close pool connections")
 			manager.parent.SendEvent(EventStopUpSessionManager{manager.subAccount})
 		}
 	}
@@ -215,7 +413,7 @@ func (manager *UpSessionManager) printMinerNum() {
 			pools++
 		}
 	}
-	glog.Info(manager.id, "connection number changed, pool servers: ", pools, ", miners: ", miners)
+	manager.log.Info("connection number changed, pool servers: ", pools, ", miners: ", miners)
 	manager.printingMinerNum = false
 }
 
@@ -232,6 +430,12 @@ func (manager *UpSessionManager) handleEvent() {
 			manager.addDownSession(e)
 		case EventUpSessionBroken:
 			manager.upSessionBroken(e)
+		case EventUpSessionDegraded:
+			manager.upSessionDegraded(e)
+		case EventUpSessionRedirect:
+			manager.upSessionRedirect(e)
+		case EventUpSessionRedirected:
+			manager.upSessionRedirected(e)
 		case EventUpdateMinerNum:
 			manager.updateMinerNum(e)
 		case EventUpdateFakeMinerNum:
@@ -244,7 +448,7 @@ func (manager *UpSessionManager) handleEvent() {
 			manager.exit()
 			return
 		default:
-			glog.Error("[UpSessionManager] unknown event: ", event)
+			manager.log.Error("[UpSessionManager] unknown event: ", event)
 		}
 	}
 }
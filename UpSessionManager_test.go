@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// jobExtraNonce1 The extranonce1 of the pool connection that sent the job, at the end of coinbase1
+func jobExtraNonce1(notify *JSONRPCLineBTC) uint32 {
+	coinbase1, _ := notify.Params[2].(string)
+	if len(coinbase1) < 8 {
+		return 0
+	}
+	value, _ := strconv.ParseUint(coinbase1[len(coinbase1)-8:], 16, 32)
+	return uint32(value)
+}
+
+func TestWatchdogMovesMinersOffSilentSlot(t *testing.T) {
+	options := NewMockPoolOptions()
+	options.NotifyInterval = 200 * time.Millisecond
+	pool := NewMockPool(options)
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolConnectionNumberPerSubAccount = 2
+		config.Advanced.PoolNotifyTimeoutSeconds = 1
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 1 })
+
+	miner, notify := connectMockMiner(t, manager, "worker1")
+	silent := jobExtraNonce1(notify)
+
+	// the pool connection of the miner stays open but sends no more jobs
+	degraded := metricValue(metricUpSessionHealth, "degraded")
+	pool.Mute(silent)
+	notify = miner.expect("mining.notify", nil)
+	for jobExtraNonce1(notify) == silent {
+		notify = miner.expect("mining.notify", nil)
+	}
+	if degraded == metricValue(metricUpSessionHealth, "degraded") {
+		t.Error("the silent pool connection should be counted as degraded")
+	}
+	if response := miner.submit(3, notify.Params[0].(string)); response.Result != true {
+		t.Fatalf("share rejected on the other pool connection: %+v", response)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+
+	// the degraded slot is connected again
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 2 })
+}
+
+func TestPoolPing(t *testing.T) {
+	options := NewMockPoolOptions()
+	options.NotifyInterval = 200 * time.Millisecond
+	pool := NewMockPool(options)
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	sent := metricValue(metricUpSessionHealth, "ping_sent")
+	pongs := metricValue(metricUpSessionHealth, "pong")
+	degraded := metricValue(metricUpSessionHealth, "degraded")
+	startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolPing.Method = "mining.ping"
+		config.Advanced.PoolPing.IntervalSeconds = 1
+		config.Advanced.PoolNotifyTimeoutSeconds = 1
+	}, "pool-a")
+
+	// the mock pool answers the ping with an error, which still proves the connection is alive
+	waitMockPool(t, func() bool {
+		return metricValue(metricUpSessionHealth, "ping_sent") != sent && metricValue(metricUpSessionHealth, "pong") != pongs
+	})
+	if degraded != metricValue(metricUpSessionHealth, "degraded") {
+		t.Error("a pool sending jobs should not be degraded")
+	}
+}
+
+func TestMinersMigrateAfterPoolDisconnect(t *testing.T) {
+	options := NewMockPoolOptions()
+	options.Difficulty = 16
+	pool := NewMockPool(options)
+	network := NewMockPoolNetwork()
+	network.Add("pool-a:3333", pool)
+
+	manager := startMockPoolAgent(t, network, func(config *Config) {
+		config.Advanced.PoolConnectionNumberPerSubAccount = 2
+	}, "pool-a")
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 1 })
+
+	miner, notify := connectMockMiner(t, manager, "worker1")
+	broken := jobExtraNonce1(notify)
+
+	// the miner goes straight to the other ready slot, not to fake jobs
+	migrated := metricValue(metricUpSessionHealth, "migrated_miners")
+	pool.Disconnect(broken)
+	// the difficulty of the new slot comes first, then its job with clean jobs set
+	if difficulty := miner.expect("mining.set_difficulty", nil).Params[0]; difficulty != float64(16) {
+		t.Errorf("the miner should get the difficulty of the new slot, got %v", difficulty)
+	}
+	notify = miner.expect("mining.notify", nil)
+	if jobID := notify.Params[0].(string); IsFakeJobIDBTC(jobID) {
+		t.Fatalf("the miner should be moved to the other pool connection, got the fake job %s", jobID)
+	}
+	if jobExtraNonce1(notify) == broken {
+		t.Fatal("the job should come from the other pool connection")
+	}
+	if clean := notify.Params[8]; clean != true {
+		t.Errorf("the first job of the new slot should clean the old jobs, got %v", clean)
+	}
+	if migrated == metricValue(metricUpSessionHealth, "migrated_miners") {
+		t.Error("the migrated miner is not counted")
+	}
+	if response := miner.submit(3, notify.Params[0].(string)); response.Result != true {
+		t.Fatalf("share rejected on the other pool connection: %+v", response)
+	}
+	waitMockPool(t, func() bool { return pool.Stats().Accepted == 1 })
+
+	// the broken slot is connected again
+	waitMockPool(t, func() bool { return pool.Stats().Authorizes > 2 })
+}
@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // IP2Long IP转整数
@@ -190,6 +191,15 @@ func IPAsWorkerName(format string, ip string) string {
 	return format
 }
 
+// DialerKeepAlive The net.Dialer KeepAlive of a TCP keepalive period, period 0 to disable.
+// The dialer sets it on the TCP connection itself, before a proxy or TLS wraps it.
+func DialerKeepAlive(period time.Duration) time.Duration {
+	if period <= 0 {
+		return -1
+	}
+	return period
+}
+
 func IsEnabled(option bool) string {
 	if option {
 		return "Enabled"
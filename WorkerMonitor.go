@@ -0,0 +1,363 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Hashrate samples are summed into buckets, the longest window decides how many are kept
+	hashrateBucketSeconds = 10
+	hashrateBuckets       = 3600 / hashrateBucketSeconds
+)
+
+// Hashrate windows
+var (
+	HashrateWindow1m  = 1 * time.Minute
+	HashrateWindow15m = 15 * time.Minute
+	HashrateWindow1h  = 1 * time.Hour
+)
+
+// Worker alert types
+const (
+	AlertWorkerOffline      = "worker_offline"
+	AlertWorkerLowHashrate  = "worker_low_hashrate"
+	AlertWorkerRecovered    = "worker_recovered"
+	AlertWorkerDisconnected = "worker_disconnected"
+)
+
+// HashrateCounter Accepted share difficulty in fixed time buckets, covering the last hour
+type HashrateCounter struct {
+	buckets    [hashrateBuckets]float64
+	lastBucket int64 // index of the newest bucket since the Unix epoch
+}
+
+func (counter *HashrateCounter) advance(now time.Time) {
+	bucket := now.Unix() / hashrateBucketSeconds
+	if counter.lastBucket == 0 || bucket-counter.lastBucket >= hashrateBuckets {
+		counter.buckets = [hashrateBuckets]float64{}
+	} else {
+		for i := counter.lastBucket + 1; i <= bucket; i++ {
+			counter.buckets[i%hashrateBuckets] = 0
+		}
+	}
+	if bucket > counter.lastBucket {
+		counter.lastBucket = bucket
+	}
+}
+
+// Add Count an accepted share
+func (counter *HashrateCounter) Add(now time.Time, difficulty float64) {
+	counter.advance(now)
+	counter.buckets[counter.lastBucket%hashrateBuckets] += difficulty
+}
+
+// Hashrate Hashes per second over the window, including the current bucket
+func (counter *HashrateCounter) Hashrate(now time.Time, window time.Duration) float64 {
+	counter.advance(now)
+	n := int64(window.Seconds()) / hashrateBucketSeconds
+	if n < 1 {
+		n = 1
+	}
+	if n > hashrateBuckets {
+		n = hashrateBuckets
+	}
+	var sum float64
+	for i := int64(0); i < n; i++ {
+		sum += counter.buckets[(counter.lastBucket-i)%hashrateBuckets]
+	}
+	// a share of difficulty 1 takes 2^32 hashes on average
+	return sum * math.Pow(2, 32) / window.Seconds()
+}
+
+// WorkerStatus Hashrate and liveness of a miner connection
+type WorkerStatus struct {
+	SessionID    uint16    `json:"session_id"`
+	SubAccount   string    `json:"sub_account"`
+	Worker       string    `json:"worker"`
+	Hashrate1m   float64   `json:"hashrate_1m"`
+	Hashrate15m  float64   `json:"hashrate_15m"`
+	Hashrate1h   float64   `json:"hashrate_1h"`
+	Accepted     uint64    `json:"accepted"`
+	Rejected     uint64    `json:"rejected"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastShare    time.Time `json:"last_share"`
+	Disconnected bool      `json:"disconnected,omitempty"`
+	Offline      bool      `json:"offline,omitempty"`
+	LowHashrate  bool      `json:"low_hashrate,omitempty"`
+	DisconnectAt time.Time `json:"disconnected_at,omitempty"`
+	counter      HashrateCounter
+	alerted      bool // an offline or low hashrate alert has been sent
+}
+
+// SubAccountStatus Hashrate of all miners of a sub-account
+type SubAccountStatus struct {
+	SubAccount  string  `json:"sub_account"`
+	Workers     int     `json:"workers"`
+	Offline     int     `json:"offline"`
+	Hashrate1m  float64 `json:"hashrate_1m"`
+	Hashrate15m float64 `json:"hashrate_15m"`
+	Hashrate1h  float64 `json:"hashrate_1h"`
+}
+
+// WorkerAlert Sent to the notifiers when a worker goes quiet or recovers
+type WorkerAlert struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	SubAccount  string    `json:"sub_account"`
+	Worker      string    `json:"worker"`
+	SessionID   uint16    `json:"session_id"`
+	Hashrate15m float64   `json:"hashrate_15m"`
+	LastShare   time.Time `json:"last_share"`
+	Message     string    `json:"message"`
+}
+
+// WorkerMonitor Thread safe hashrate estimation of all miners with offline alerts
+type WorkerMonitor struct {
+	lock    sync.Mutex
+	config  *Config
+	workers map[uint16]*WorkerStatus
+	// Disconnected miners are kept until they come back or are considered offline
+	disconnected []*WorkerStatus
+	// Per sub-account counters outlive the miner connections
+	subAccounts map[string]*HashrateCounter
+
+	notifiers []AlertNotifier
+	alerts    chan *WorkerAlert
+}
+
+func NewWorkerMonitor(config *Config, notifiers []AlertNotifier) (monitor *WorkerMonitor) {
+	monitor = new(WorkerMonitor)
+	monitor.config = config
+	monitor.workers = make(map[uint16]*WorkerStatus)
+	monitor.subAccounts = make(map[string]*HashrateCounter)
+	monitor.notifiers = notifiers
+	monitor.alerts = make(chan *WorkerAlert, WorkerMonitorAlertQueueSize)
+	return
+}
+
+// Run Check workers and send alerts in the background
+func (monitor *WorkerMonitor) Run() {
+	go monitor.notifyLoop()
+
+	interval := monitor.config.WorkerMonitor.CheckIntervalSeconds.Get()
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		monitor.check(time.Now())
+	}
+}
+
+// AddWorker A miner has been authorized, its shares are counted with the returned status
+func (monitor *WorkerMonitor) AddWorker(sessionID uint16, subAccount string, worker string) (status *WorkerStatus) {
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	now := time.Now()
+	// The miner has reconnected, forget its old connection
+	kept := monitor.disconnected[:0]
+	for _, status := range monitor.disconnected {
+		if status.SubAccount == subAccount && status.Worker == worker {
+			if status.alerted {
+				monitor.sendAlert(status, AlertWorkerRecovered, "worker reconnected", now)
+			}
+			continue
+		}
+		kept = append(kept, status)
+	}
+	monitor.disconnected = kept
+
+	status = &WorkerStatus{SessionID: sessionID, SubAccount: subAccount, Worker: worker, ConnectedAt: now, LastShare: now}
+	monitor.workers[sessionID] = status
+	return
+}
+
+// RemoveWorker A miner has been disconnected, it is kept until it is considered offline
+func (monitor *WorkerMonitor) RemoveWorker(sessionID uint16) {
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	status, ok := monitor.workers[sessionID]
+	if !ok {
+		return
+	}
+	status.Disconnected = true
+	status.DisconnectAt = time.Now()
+	// The session ID may be reused by a new miner
+	delete(monitor.workers, sessionID)
+	monitor.disconnected = append(monitor.disconnected, status)
+}
+
+// AddShare Count the pool's verdict of a share.
+// The status of the miner connection is passed rather than the session ID,
+// the ID may belong to another miner when a late verdict arrives.
+func (monitor *WorkerMonitor) AddShare(status *WorkerStatus, difficulty float64, accepted bool) {
+	if status == nil {
+		return
+	}
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	now := time.Now()
+	status.LastShare = now
+	if !accepted {
+		status.Rejected++
+		return
+	}
+	status.Accepted++
+	status.counter.Add(now, difficulty)
+
+	counter, ok := monitor.subAccounts[status.SubAccount]
+	if !ok {
+		counter = new(HashrateCounter)
+		monitor.subAccounts[status.SubAccount] = counter
+	}
+	counter.Add(now, difficulty)
+}
+
+func (monitor *WorkerMonitor) check(now time.Time) {
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	offlineAfter := monitor.config.WorkerMonitor.OfflineAfterSeconds.Get()
+	minHashrate := monitor.config.WorkerMonitor.MinHashrateTHs * 1e12
+
+	kept := monitor.disconnected[:0]
+	for _, status := range monitor.disconnected {
+		if offlineAfter > 0 && now.Sub(status.DisconnectAt) < offlineAfter {
+			kept = append(kept, status)
+			continue
+		}
+		// Offline detection is disabled, forget disconnected miners at once
+		if offlineAfter > 0 && !status.alerted {
+			monitor.sendAlert(status, AlertWorkerDisconnected, "worker disconnected and did not come back", now)
+		}
+	}
+	monitor.disconnected = kept
+
+	for _, status := range monitor.workers {
+		hashrate := status.counter.Hashrate(now, HashrateWindow15m)
+		offline := offlineAfter > 0 && now.Sub(status.LastShare) >= offlineAfter
+		// The 15m hashrate is too low for a new miner
+		lowHashrate := !offline && minHashrate > 0 && now.Sub(status.ConnectedAt) >= HashrateWindow15m && hashrate < minHashrate
+
+		if offline && !status.Offline {
+			monitor.sendAlert(status, AlertWorkerOffline, "no shares since "+status.LastShare.Format(time.RFC3339), now)
+		} else if lowHashrate && !status.LowHashrate {
+			monitor.sendAlert(status, AlertWorkerLowHashrate, "15m hashrate below the threshold", now)
+		} else if !offline && !lowHashrate && status.alerted {
+			monitor.sendAlert(status, AlertWorkerRecovered, "worker is submitting shares again", now)
+		}
+		status.Offline = offline
+		status.LowHashrate = lowHashrate
+		status.alerted = offline || lowHashrate
+	}
+}
+
+// sendAlert Queue an alert, the lock must be held
+func (monitor *WorkerMonitor) sendAlert(status *WorkerStatus, alertType string, message string, now time.Time) {
+	alert := &WorkerAlert{
+		Type:        alertType,
+		Time:        now,
+		SubAccount:  status.SubAccount,
+		Worker:      status.Worker,
+		SessionID:   status.SessionID,
+		Hashrate15m: status.counter.Hashrate(now, HashrateWindow15m),
+		LastShare:   status.LastShare,
+		Message:     message,
+	}
+	glog.Warning("[worker-monitor] ", alert.Type, ": ", alert.SubAccount, ".", alert.Worker, ", ", message)
+	metricWorkerMonitor.Add(alertType, 1)
+
+	select {
+	case monitor.alerts <- alert:
+	default:
+		metricWorkerMonitor.Add("alerts_dropped", 1)
+	}
+}
+
+func (monitor *WorkerMonitor) notifyLoop() {
+	for alert := range monitor.alerts {
+		for _, notifier := range monitor.notifiers {
+			err := notifier.Notify(alert)
+			if err != nil {
+				glog.Warning("[worker-monitor] ", notifier.Name(), " notifier failed: ", err.Error())
+				metricWorkerMonitor.Add(MetricKey(notifier.Name(), "failures"), 1)
+			}
+		}
+	}
+}
+
+// Workers Snapshot of all miners, ordered by sub-account and worker name
+func (monitor *WorkerMonitor) Workers() (list []WorkerStatus) {
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	now := time.Now()
+	all := make([]*WorkerStatus, 0, len(monitor.workers)+len(monitor.disconnected))
+	for _, status := range monitor.workers {
+		all = append(all, status)
+	}
+	all = append(all, monitor.disconnected...)
+
+	for _, status := range all {
+		status.Hashrate1m = status.counter.Hashrate(now, HashrateWindow1m)
+		status.Hashrate15m = status.counter.Hashrate(now, HashrateWindow15m)
+		status.Hashrate1h = status.counter.Hashrate(now, HashrateWindow1h)
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SubAccount != list[j].SubAccount {
+			return list[i].SubAccount < list[j].SubAccount
+		}
+		return list[i].Worker < list[j].Worker
+	})
+	return
+}
+
+// SubAccounts Hashrate of every sub-account
+func (monitor *WorkerMonitor) SubAccounts() (list []SubAccountStatus) {
+	defer monitor.lock.Unlock()
+	monitor.lock.Lock()
+
+	now := time.Now()
+	statusMap := make(map[string]*SubAccountStatus)
+	for name, counter := range monitor.subAccounts {
+		statusMap[name] = &SubAccountStatus{
+			SubAccount:  name,
+			Hashrate1m:  counter.Hashrate(now, HashrateWindow1m),
+			Hashrate15m: counter.Hashrate(now, HashrateWindow15m),
+			Hashrate1h:  counter.Hashrate(now, HashrateWindow1h),
+		}
+	}
+	subAccount := func(name string) *SubAccountStatus {
+		status, ok := statusMap[name]
+		if !ok {
+			status = &SubAccountStatus{SubAccount: name}
+			statusMap[name] = status
+		}
+		return status
+	}
+	for _, worker := range monitor.workers {
+		status := subAccount(worker.SubAccount)
+		status.Workers++
+		if worker.Offline {
+			status.Offline++
+		}
+	}
+	for _, worker := range monitor.disconnected {
+		subAccount(worker.SubAccount).Offline++
+	}
+
+	for _, status := range statusMap {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SubAccount < list[j].SubAccount })
+	return
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type testNotifier struct {
+	alerts chan *WorkerAlert
+}
+
+func (notifier *testNotifier) Name() string {
+	return "test"
+}
+
+func (notifier *testNotifier) Notify(alert *WorkerAlert) error {
+	notifier.alerts <- alert
+	return nil
+}
+
+func TestHashrateCounter(t *testing.T) {
+	var counter HashrateCounter
+	start := time.Unix(1600000000, 0)
+
+	// difficulty 60 per minute for 15 minutes
+	for i := 0; i < 15*6; i++ {
+		counter.Add(start.Add(time.Duration(i)*10*time.Second), 10)
+	}
+	now := start.Add(15*time.Minute - time.Second)
+
+	expected := 60 * math.Pow(2, 32) / 60
+	if hashrate := counter.Hashrate(now, HashrateWindow15m); math.Abs(hashrate-expected) > 1 {
+		t.Errorf("15m hashrate should be %v, got %v", expected, hashrate)
+	}
+	if hashrate := counter.Hashrate(now, HashrateWindow1h); math.Abs(hashrate-expected/4) > 1 {
+		t.Errorf("1h hashrate should be %v, got %v", expected/4, hashrate)
+	}
+
+	// old shares leave the window
+	if hashrate := counter.Hashrate(now.Add(2*time.Hour), HashrateWindow1h); hashrate != 0 {
+		t.Errorf("hashrate should be 0 after the window, got %v", hashrate)
+	}
+}
+
+func TestWorkerMonitorOfflineAlert(t *testing.T) {
+	config := NewConfig()
+	config.WorkerMonitor.OfflineAfterSeconds = 60
+	notifier := &testNotifier{make(chan *WorkerAlert, 10)}
+	monitor := NewWorkerMonitor(config, []AlertNotifier{notifier})
+	go monitor.notifyLoop()
+
+	status := monitor.AddWorker(1, "sub", "w1")
+	monitor.AddShare(status, 1024, true)
+
+	monitor.check(time.Now())
+	select {
+	case alert := <-notifier.alerts:
+		t.Fatalf("unexpected alert: %+v", *alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	monitor.check(time.Now().Add(2 * time.Minute))
+	alert := <-notifier.alerts
+	if alert.Type != AlertWorkerOffline || alert.Worker != "w1" {
+		t.Fatalf("expected offline alert of w1, got %+v", *alert)
+	}
+
+	// only alert once
+	monitor.check(time.Now().Add(3 * time.Minute))
+	select {
+	case alert := <-notifier.alerts:
+		t.Fatalf("duplicate alert: %+v", *alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	monitor.AddShare(status, 1024, true)
+	monitor.check(time.Now())
+	if alert := <-notifier.alerts; alert.Type != AlertWorkerRecovered {
+		t.Fatalf("expected recovered alert, got %+v", *alert)
+	}
+
+	accounts := monitor.SubAccounts()
+	if len(accounts) != 1 || accounts[0].Workers != 1 || accounts[0].Hashrate1m <= 0 {
+		t.Errorf("wrong sub-account status: %+v", accounts)
+	}
+}
+
+func TestWorkerMonitorReusedSessionID(t *testing.T) {
+	monitor := NewWorkerMonitor(NewConfig(), nil)
+
+	old := monitor.AddWorker(1, "sub", "w1")
+	monitor.RemoveWorker(1)
+	monitor.AddWorker(1, "sub", "w2")
+
+	// the verdict of a share sent before w1 disconnected arrives late
+	monitor.AddShare(old, 1024, true)
+	workers := monitor.Workers()
+	if len(workers) != 2 {
+		t.Fatalf("expected w1 and w2, got %+v", workers)
+	}
+	for _, status := range workers {
+		switch status.Worker {
+		case "w1":
+			if status.Accepted != 1 {
+				t.Errorf("the share should be counted for w1: %+v", status)
+			}
+		case "w2":
+			if status.Accepted != 0 || status.Hashrate1m != 0 {
+				t.Errorf("w2 reuses the session ID but did not submit the share: %+v", status)
+			}
+		}
+	}
+}
@@ -6,5 +6,6 @@ require (
 	github.com/bits-and-blooms/bitset v1.2.2
 	github.com/btccom/connectproxy v0.0.0-20200725203833-3582e84f0c9b
 	github.com/golang/glog v1.0.0
-	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 )
+
+require golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect